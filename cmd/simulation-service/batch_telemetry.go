@@ -1,12 +1,12 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
 	"time"
-
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 // BatchTelemetry represents MQTT batch telemetry data
@@ -17,73 +17,200 @@ type BatchTelemetry struct {
 	BatchSize  int         `json:"batch_size"`
 }
 
-// TelemetryBatchSender handles batch telemetry sending
+// BatchConfig controls how telemetry is grouped into batch messages
+type BatchConfig struct {
+	Size     int    `yaml:"size"`      // telemetry per batch, default 10
+	Timeout  string `yaml:"timeout"`   // simulated time after which a partial batch is sent, default 30s
+	MaxBytes int    `yaml:"max_bytes"` // encoded size limit of a batch, 0 = unlimited
+	GroupBy  string `yaml:"group_by"`  // splits batches sharing a topic, e.g. "{vehicle_type}"
+}
+
+// batchEnvelopeBytes is a generous estimate of a batch's size without its telemetry
+const batchEnvelopeBytes = 96
+
+// pendingBatch is telemetry waiting to be sent under one key
+type pendingBatch struct {
+	telemetry []Telemetry
+	bytes     int       // estimated encoded size
+	started   time.Time // simulation time of the first record
+}
+
+// TelemetryBatchSender groups telemetry into batches by key and hands them to send.
+// A batch is sent when it is full, when the next record would exceed MaxBytes, or when
+// BatchTimeout of simulation time has passed since its first record. Once started, a
+// background flusher checks the timeout even when no more telemetry arrives.
 type TelemetryBatchSender struct {
 	BatchSize    int
 	BatchTimeout time.Duration
-	batches      map[string][]Telemetry
-	lastSend     map[string]time.Time
+	MaxBytes     int
+	Encoding     PayloadEncoding // used to estimate sizes for MaxBytes
+	Clock        Clock
+	send         func(key string, batch *BatchTelemetry) error
+	mu           sync.Mutex
+	batches      map[string]*pendingBatch
+	sequence     int64
+	stop         chan struct{}
+	done         chan struct{}
 }
 
 // NewTelemetryBatchSender creates a new batch sender
-func NewTelemetryBatchSender(batchSize int, timeout time.Duration) *TelemetryBatchSender {
+func NewTelemetryBatchSender(batchSize int, timeout time.Duration, clock Clock, send func(key string, batch *BatchTelemetry) error) *TelemetryBatchSender {
 	return &TelemetryBatchSender{
 		BatchSize:    batchSize,
 		BatchTimeout: timeout,
-		batches:      make(map[string][]Telemetry),
-		lastSend:     make(map[string]time.Time),
+		Encoding:     EncodingJSON,
+		Clock:        clock,
+		send:         send,
+		batches:      make(map[string]*pendingBatch),
 	}
 }
 
-// AddTelemetry adds telemetry to batch
-func (tbs *TelemetryBatchSender) AddTelemetry(topic string, telemetry Telemetry) (bool, *BatchTelemetry) {
-	tbs.batches[topic] = append(tbs.batches[topic], telemetry)
-	
-	// Check if batch is full or timeout reached
-	now := time.Now()
-	lastSend, exists := tbs.lastSend[topic]
-	
-	batchReady := len(tbs.batches[topic]) >= tbs.BatchSize ||
-		(exists && now.Sub(lastSend) >= tbs.BatchTimeout)
-	
-	if batchReady && len(tbs.batches[topic]) > 0 {
-		batch := tbs.createBatch(topic)
-		tbs.batches[topic] = nil
-		tbs.lastSend[topic] = now
-		return true, batch
+// Start runs the background flusher until Close
+func (tbs *TelemetryBatchSender) Start() {
+	tbs.stop = make(chan struct{})
+	tbs.done = make(chan struct{})
+	go tbs.run()
+}
+
+// run sends timed-out batches, checking ten times per timeout
+func (tbs *TelemetryBatchSender) run() {
+	defer close(tbs.done)
+	for {
+		select {
+		case <-tbs.stop:
+			return
+		case <-time.After(tbs.checkInterval()):
+			if err := tbs.flushExpired(); err != nil {
+				log.Printf("Failed to send batch: %v", err)
+			}
+		}
 	}
-	
-	return false, nil
 }
 
-// createBatch creates a batch telemetry message
-func (tbs *TelemetryBatchSender) createBatch(topic string) *BatchTelemetry {
-	telemetries := tbs.batches[topic]
-	
+// checkInterval converts a tenth of the timeout to wall-clock time at the current
+// simulation speed, between 10ms and 1s
+func (tbs *TelemetryBatchSender) checkInterval() time.Duration {
+	interval := tbs.BatchTimeout / 10
+	if clock, ok := tbs.Clock.(*VirtualClock); ok {
+		interval = clock.WallInterval(interval)
+	}
+	return min(max(interval, 10*time.Millisecond), time.Second)
+}
+
+// AddTelemetry adds telemetry to the batch of a key and sends the batches that are ready
+func (tbs *TelemetryBatchSender) AddTelemetry(key string, telemetry Telemetry) error {
+	size := 0
+	if tbs.MaxBytes > 0 {
+		if data, err := tbs.Encoding.Marshal(&telemetry); err == nil {
+			size = len(data) + 1
+		}
+	}
+	now := tbs.Clock.Now()
+
+	var ready []*BatchTelemetry
+	tbs.mu.Lock()
+	batch := tbs.batches[key]
+	if batch != nil && tbs.MaxBytes > 0 && batch.bytes+size > tbs.MaxBytes {
+		ready = append(ready, tbs.take(key, now))
+		batch = nil
+	}
+	if batch == nil {
+		batch = &pendingBatch{bytes: batchEnvelopeBytes, started: now}
+		tbs.batches[key] = batch
+	}
+	batch.telemetry = append(batch.telemetry, telemetry)
+	batch.bytes += size
+	if len(batch.telemetry) >= tbs.BatchSize || now.Sub(batch.started) >= tbs.BatchTimeout {
+		ready = append(ready, tbs.take(key, now))
+	}
+	tbs.mu.Unlock()
+
+	var errs []error
+	for _, b := range ready {
+		errs = append(errs, tbs.send(key, b))
+	}
+	return errors.Join(errs...)
+}
+
+// flushExpired sends every batch whose timeout has passed
+func (tbs *TelemetryBatchSender) flushExpired() error {
+	now := tbs.Clock.Now()
+	return tbs.flush(func(batch *pendingBatch) bool {
+		return now.Sub(batch.started) >= tbs.BatchTimeout
+	})
+}
+
+// FlushAll sends every pending batch in key order
+func (tbs *TelemetryBatchSender) FlushAll() error {
+	return tbs.flush(func(*pendingBatch) bool { return true })
+}
+
+// flush sends the batches selected by due, in key order
+func (tbs *TelemetryBatchSender) flush(due func(*pendingBatch) bool) error {
+	now := tbs.Clock.Now()
+	tbs.mu.Lock()
+	var keys []string
+	for key, batch := range tbs.batches {
+		if due(batch) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	ready := make([]*BatchTelemetry, len(keys))
+	for i, key := range keys {
+		ready[i] = tbs.take(key, now)
+	}
+	tbs.mu.Unlock()
+
+	var errs []error
+	for i, key := range keys {
+		errs = append(errs, tbs.send(key, ready[i]))
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the background flusher and sends all pending batches
+func (tbs *TelemetryBatchSender) Close() error {
+	if tbs.stop != nil {
+		close(tbs.stop)
+		<-tbs.done
+		tbs.stop = nil
+	}
+	return tbs.FlushAll()
+}
+
+// take removes the pending batch of a key and turns it into a batch message.
+// The caller holds mu.
+func (tbs *TelemetryBatchSender) take(key string, now time.Time) *BatchTelemetry {
+	telemetries := tbs.batches[key].telemetry
+	delete(tbs.batches, key)
+	tbs.sequence++
+
 	return &BatchTelemetry{
-		BatchID:    generateBatchID(),
-		Timestamp:  time.Now().Unix(),
+		BatchID:    generateBatchID(now, tbs.sequence),
+		Timestamp:  now.Unix(),
 		Vehicles:   telemetries,
 		BatchSize:  len(telemetries),
 	}
 }
 
-// generateBatchID generates a unique batch ID
-func generateBatchID() string {
-	return fmt.Sprintf("batch_%d", time.Now().UnixNano())
+// generateBatchID generates a unique batch ID from simulation time and a sequence
+// number, so seeded runs produce identical IDs
+func generateBatchID(now time.Time, sequence int64) string {
+	return fmt.Sprintf("batch_%d_%d", now.UnixNano(), sequence)
 }
 
-// SendBatchTelemetry sends batch telemetry via MQTT
-func SendBatchTelemetry(client mqtt.Client, topic string, batch *BatchTelemetry) {
-	data, err := json.Marshal(batch)
+// SendBatchTelemetry sends batch telemetry via MQTT. Publish failures are logged
+// when the broker reports them.
+func SendBatchTelemetry(client *MQTTPublisher, topic string, qos byte, encoding PayloadEncoding, batch *BatchTelemetry) error {
+	data, err := encoding.Marshal(batch)
 	if err != nil {
-		log.Printf("Failed to marshal batch telemetry: %v", err)
-		return
-	}
-
-	token := client.Publish(topic, 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("Failed to publish batch telemetry: %v", token.Error())
+		return fmt.Errorf("failed to marshal batch telemetry: %w", err)
 	}
-}
\ No newline at end of file
+	client.PublishAsync(topic, qos, false, data, func(err error) {
+		if err != nil {
+			log.Printf("Failed to publish batch telemetry: %v", err)
+		}
+	})
+	return nil
+}
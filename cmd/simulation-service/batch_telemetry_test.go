@@ -0,0 +1,85 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelemetryBatchSender(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		key     string // telemetry added for key; empty checks the timeout only
+	}
+	tests := []struct {
+		name     string
+		maxBytes int
+		steps    []step
+		want     []string // sent batches as key and vehicle IDs
+		pending  int      // batches left for FlushAll
+	}{
+		{"full batch", 0,
+			[]step{{0, "a"}, {time.Second, "a"}, {time.Second, "a"}},
+			[]string{"a:1,2,3"}, 0},
+		{"keys batch separately", 0,
+			[]step{{0, "a"}, {0, "b"}, {0, "a"}, {0, "a"}},
+			[]string{"a:1,3,4"}, 1},
+		{"timeout on the next record", 0,
+			[]step{{0, "a"}, {30 * time.Second, "a"}},
+			[]string{"a:1,2"}, 0},
+		{"timeout without telemetry", 0,
+			[]step{{0, "a"}, {10 * time.Second, "b"}, {20 * time.Second, ""}},
+			[]string{"a:1"}, 1},
+		{"not yet timed out", 0,
+			[]step{{0, "a"}, {29 * time.Second, ""}},
+			nil, 1},
+		{"max bytes", 500,
+			[]step{{0, "a"}, {0, "a"}, {0, "a"}},
+			[]string{"a:1,2"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewSteppedClock(time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC))
+			var sent []string
+			sender := NewTelemetryBatchSender(3, 30*time.Second, clock, func(key string, batch *BatchTelemetry) error {
+				var ids []string
+				for _, telemetry := range batch.Vehicles {
+					ids = append(ids, strconv.Itoa(telemetry.VehicleID))
+				}
+				if batch.BatchSize != len(batch.Vehicles) {
+					t.Errorf("batch size %d for %d records", batch.BatchSize, len(batch.Vehicles))
+				}
+				sent = append(sent, key+":"+strings.Join(ids, ","))
+				return nil
+			})
+			sender.MaxBytes = tt.maxBytes
+
+			for i, step := range tt.steps {
+				clock.Advance(step.advance)
+				var err error
+				if step.key != "" {
+					err = sender.AddTelemetry(step.key, Telemetry{VehicleID: i + 1, Timestamp: clock.Now().Unix(), Lat: 35.7219, Lon: 51.3347})
+				} else {
+					err = sender.flushExpired()
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+			}
+			if !slices.Equal(sent, tt.want) {
+				t.Errorf("sent %v, want %v", sent, tt.want)
+			}
+
+			before := len(sent)
+			if err := sender.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if flushed := len(sent) - before; flushed != tt.pending {
+				t.Errorf("Close sent %d batches, want %d", flushed, tt.pending)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current simulation time
+type Clock interface {
+	Now() time.Time
+}
+
+// VirtualClock maps wall-clock time onto simulation time scaled by a speed factor.
+// A speed of 60 means one wall-clock second advances the simulation by one minute.
+type VirtualClock struct {
+	mu        sync.RWMutex
+	simStart  time.Time // simulation time at the last rebase
+	wallStart time.Time // wall-clock time at the last rebase
+	speed     float64
+}
+
+// NewVirtualClock creates a clock starting at start and running at the given speed factor
+func NewVirtualClock(start time.Time, speed float64) *VirtualClock {
+	if speed <= 0 {
+		speed = 1.0
+	}
+	return &VirtualClock{
+		simStart:  start,
+		wallStart: time.Now(),
+		speed:     speed,
+	}
+}
+
+// Now returns the current simulation time
+func (c *VirtualClock) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.now(time.Now())
+}
+
+func (c *VirtualClock) now(wall time.Time) time.Time {
+	elapsed := wall.Sub(c.wallStart)
+	return c.simStart.Add(time.Duration(float64(elapsed) * c.speed))
+}
+
+// Speed returns the current time-warp factor
+func (c *VirtualClock) Speed() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.speed
+}
+
+// SetSpeed changes the time-warp factor without making simulation time jump
+func (c *VirtualClock) SetSpeed(speed float64) {
+	if speed <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := time.Now()
+	c.simStart = c.now(wall)
+	c.wallStart = wall
+	c.speed = speed
+}
+
+// WallInterval converts a simulation-time interval into the wall-clock interval
+// needed to cover it at the current speed
+func (c *VirtualClock) WallInterval(simInterval time.Duration) time.Duration {
+	wall := time.Duration(float64(simInterval) / c.Speed())
+	if wall < time.Millisecond {
+		wall = time.Millisecond
+	}
+	return wall
+}
+
+// SteppedClock is a manually advanced clock used when the simulation runs
+// as fast as possible instead of against the wall clock
+type SteppedClock struct {
+	mu  sync.RWMutex
+	now time.Time
+}
+
+// NewSteppedClock creates a stepped clock starting at start
+func NewSteppedClock(start time.Time) *SteppedClock {
+	return &SteppedClock{now: start}
+}
+
+// Now returns the current simulation time
+func (c *SteppedClock) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *SteppedClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
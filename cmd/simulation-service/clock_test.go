@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		speed   float64
+		elapsed time.Duration // wall-clock time since the start
+		want    time.Time
+	}{
+		{"real time", 1, 90 * time.Second, start.Add(90 * time.Second)},
+		{"minute per second", 60, 2 * time.Second, start.Add(2 * time.Minute)},
+		{"day in 24 minutes", 60, 24 * time.Minute, start.Add(24 * time.Hour)},
+		{"slow motion", 0.5, time.Minute, start.Add(30 * time.Second)},
+		{"invalid speed runs in real time", -3, time.Second, start.Add(time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewVirtualClock(start, tt.speed)
+			if got := clock.now(clock.wallStart.Add(tt.elapsed)); !got.Equal(tt.want) {
+				t.Errorf("simulation time %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVirtualClockSetSpeed(t *testing.T) {
+	start := time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)
+	clock := NewVirtualClock(start, 1)
+	clock.wallStart = clock.wallStart.Add(-time.Hour) // an hour has passed at real time
+
+	before := clock.Now()
+	clock.SetSpeed(3600)
+	after := clock.Now()
+	// Changing the speed does not make simulation time jump; the few microseconds
+	// between the calls are an hour at most at 3600x
+	if after.Before(before) || after.Sub(before) > time.Hour {
+		t.Errorf("simulation time moved from %s to %s when changing speed", before, after)
+	}
+	if got := clock.now(clock.wallStart.Add(time.Second)); !got.Equal(clock.simStart.Add(time.Hour)) {
+		t.Errorf("a wall second after the speed change is %s, want an hour after %s", got, clock.simStart)
+	}
+
+	clock.SetSpeed(0)
+	if clock.Speed() != 3600 {
+		t.Errorf("speed 0 was accepted, speed is now %g", clock.Speed())
+	}
+}
+
+func TestVirtualClockWallInterval(t *testing.T) {
+	tests := []struct {
+		speed    float64
+		interval time.Duration
+		want     time.Duration
+	}{
+		{1, 5 * time.Second, 5 * time.Second},
+		{60, 5 * time.Second, 5 * time.Second / 60},
+		{0.5, time.Second, 2 * time.Second},
+		{1e6, time.Second, time.Millisecond}, // never below a millisecond
+	}
+	for _, tt := range tests {
+		clock := NewVirtualClock(time.Now(), tt.speed)
+		if got := clock.WallInterval(tt.interval); got != tt.want {
+			t.Errorf("WallInterval(%s) at %gx = %s, want %s", tt.interval, tt.speed, got, tt.want)
+		}
+	}
+}
+
+func TestSteppedClock(t *testing.T) {
+	start := time.Date(2026, 1, 5, 23, 59, 58, 0, time.UTC)
+	clock := NewSteppedClock(start)
+	steps := []struct {
+		advance time.Duration
+		want    time.Time
+	}{
+		{0, start},
+		{time.Second, start.Add(time.Second)},
+		{5 * time.Second, time.Date(2026, 1, 6, 0, 0, 4, 0, time.UTC)},
+		{24 * time.Hour, time.Date(2026, 1, 7, 0, 0, 4, 0, time.UTC)},
+	}
+	for i, step := range steps {
+		if got := clock.Advance(step.advance); !got.Equal(step.want) {
+			t.Errorf("step %d: Advance returned %s, want %s", i, got, step.want)
+		}
+		if got := clock.Now(); !got.Equal(step.want) {
+			t.Errorf("step %d: Now returned %s, want %s", i, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ConnectivityConfig describes where and when devices lose cellular coverage
+type ConnectivityConfig struct {
+	DeadZones      []Area  `yaml:"dead_zones"`      // areas without coverage
+	OutageRate     float64 `yaml:"outage_rate"`     // random outages per vehicle per hour
+	OutageDuration string  `yaml:"outage_duration"` // mean duration of a random outage
+	BufferSize     int     `yaml:"buffer_size"`     // max points stored on the device (oldest dropped)
+	FlushRate      int     `yaml:"flush_rate"`      // buffered points uploaded per update after reconnect
+}
+
+// Enabled reports whether any connectivity loss is configured
+func (c ConnectivityConfig) Enabled() bool {
+	return len(c.DeadZones) > 0 || c.OutageRate > 0
+}
+
+// ConnectivityState is a device's coverage and its store-and-forward buffer
+type ConnectivityState struct {
+	cfg            ConnectivityConfig
+	rng            *rand.Rand
+	outageDuration time.Duration
+	outageUntil    time.Time
+	lastUpdate     time.Time
+	buffer         []Telemetry
+	Online         bool
+	Buffered       int // points stored during outages
+	Replayed       int // buffered points uploaded after reconnecting
+	Dropped        int // points lost to buffer overflow
+}
+
+// NewConnectivityState creates the connectivity state of one device
+func NewConnectivityState(cfg ConnectivityConfig, rng *rand.Rand) *ConnectivityState {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1000
+	}
+	if cfg.FlushRate <= 0 {
+		cfg.FlushRate = 20
+	}
+	return &ConnectivityState{
+		cfg:            cfg,
+		rng:            rng,
+		outageDuration: parseDuration(cfg.OutageDuration, 3*time.Minute),
+		Online:         true,
+	}
+}
+
+// inDeadZone reports whether the position has no coverage
+func (c *ConnectivityState) inDeadZone(lat, lon float64) bool {
+	for i := range c.cfg.DeadZones {
+		if c.cfg.DeadZones[i].Contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// Process applies coverage to a new telemetry point and returns the points the device
+// uploads now. Without coverage the point is buffered with its original timestamp and
+// signal 0; after reconnecting, the live point goes first and the backlog follows in
+// bursts of flush_rate points, flagged as replayed.
+func (c *ConnectivityState) Process(t *Telemetry, now time.Time) []Telemetry {
+	// Start a random outage with probability 1 - exp(-rate * dt)
+	if c.cfg.OutageRate > 0 && !c.lastUpdate.IsZero() && !now.Before(c.outageUntil) {
+		hours := now.Sub(c.lastUpdate).Hours()
+		if c.rng.Float64() < 1-math.Exp(-c.cfg.OutageRate*hours) {
+			duration := time.Duration(c.rng.ExpFloat64() * float64(c.outageDuration))
+			c.outageUntil = now.Add(duration)
+		}
+	}
+	c.lastUpdate = now
+
+	c.Online = !now.Before(c.outageUntil) && !c.inDeadZone(t.Lat, t.Lon)
+	if !c.Online {
+		t.Signal = 0
+		if len(c.buffer) >= c.cfg.BufferSize {
+			c.buffer = c.buffer[1:]
+			c.Dropped++
+		}
+		c.buffer = append(c.buffer, *t)
+		c.Buffered++
+		return nil
+	}
+
+	out := []Telemetry{*t}
+	flush := c.cfg.FlushRate
+	if flush > len(c.buffer) {
+		flush = len(c.buffer)
+	}
+	for _, buffered := range c.buffer[:flush] {
+		buffered.Replayed = true
+		out = append(out, buffered)
+	}
+	c.buffer = c.buffer[flush:]
+	c.Replayed += flush
+	return out
+}
+
+// Flush uploads the whole backlog at once, flagged as replayed, when the device is
+// about to go away with points still in its buffer
+func (c *ConnectivityState) Flush() []Telemetry {
+	out := make([]Telemetry, len(c.buffer))
+	for i, buffered := range c.buffer {
+		buffered.Replayed = true
+		out[i] = buffered
+	}
+	c.Replayed += len(c.buffer)
+	c.buffer = nil
+	return out
+}
+
+// Pending returns the number of points waiting in the device buffer
+func (c *ConnectivityState) Pending() int {
+	return len(c.buffer)
+}
+
+// Outage takes the device out of coverage until the given time
+func (c *ConnectivityState) Outage(until time.Time) {
+	if until.After(c.outageUntil) {
+		c.outageUntil = until
+	}
+}
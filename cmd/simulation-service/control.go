@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"vehicle-tracking-simulation/internal/route-service/models"
+)
+
+// ControlConfig enables the HTTP control API in live mode
+type ControlConfig struct {
+	Listen string `yaml:"listen"` // e.g. ":8090"; empty disables the API
+}
+
+var (
+	errVehicleNotFound = errors.New("vehicle not found")
+	errVehicleExists   = errors.New("vehicle ID already in use")
+	errVehicleRetired  = errors.New("vehicle has retired")
+)
+
+// VehicleState is a vehicle's current state as reported by the control API
+type VehicleState struct {
+	VehicleID     int        `json:"vehicle_id"`
+	VehicleType   string     `json:"vehicle_type"`
+	RouteID       int        `json:"route_id"`
+	Trip          int        `json:"trip"`
+	Status        string     `json:"status"`
+	Lat           float64    `json:"lat"`
+	Lon           float64    `json:"lon"`
+	Speed         float64    `json:"spd"` // km/h
+	Heading       float64    `json:"hdg"`
+	DistanceM     float64    `json:"distance_m"`     // driven on the current route
+	RouteLengthM  float64    `json:"route_length_m"` // RouteIterator.TotalLength
+	Progress      float64    `json:"progress"`       // fraction of the current route driven
+	SpeedFactor   float64    `json:"speed_factor"`
+	LastUpdate    time.Time  `json:"last_update"`              // simulation time of the last step
+	NextDeparture *time.Time `json:"next_departure,omitempty"` // scheduled departures only
+}
+
+// vehicleState describes a vehicle. The caller holds mu.
+func (e *Engine) vehicleState(v *VehicleSimulator) VehicleState {
+	lat, lon, heading := v.position()
+	state := VehicleState{
+		VehicleID:    v.VehicleID,
+		VehicleType:  v.TypeName,
+		RouteID:      v.Route.Metadata.ID,
+		Trip:         v.Trip,
+		Status:       v.Status(),
+		Lat:          lat,
+		Lon:          lon,
+		Speed:        v.CurrentSpeed * 3.6,
+		Heading:      heading,
+		DistanceM:    v.DistanceTraveled,
+		RouteLengthM: v.RouteIterator.TotalLength,
+		SpeedFactor:  v.speedFactor(),
+		LastUpdate:   v.LastUpdateTime,
+	}
+	if v.Departures != nil && !v.Departures.Next.IsZero() {
+		next := v.Departures.Next
+		state.NextDeparture = &next
+	}
+	if v.Paused || v.Stopped || v.Parked || v.Waiting {
+		state.Speed = 0
+	}
+	if state.RouteLengthM > 0 {
+		state.Progress = math.Min(1, v.DistanceTraveled/state.RouteLengthM)
+	}
+	return state
+}
+
+// find returns a vehicle that has not been removed. The caller holds mu.
+func (e *Engine) find(id int) (*VehicleSimulator, error) {
+	for _, vehicle := range e.vehicles {
+		if vehicle.VehicleID == id && !vehicle.Removed {
+			return vehicle, nil
+		}
+	}
+	return nil, errVehicleNotFound
+}
+
+// VehicleStates returns the state of every vehicle that has not been removed
+func (e *Engine) VehicleStates() []VehicleState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	states := make([]VehicleState, 0, len(e.vehicles))
+	for _, vehicle := range e.vehicles {
+		if !vehicle.Removed {
+			states = append(states, e.vehicleState(vehicle))
+		}
+	}
+	return states
+}
+
+// VehicleState returns the state of one vehicle
+func (e *Engine) VehicleState(id int) (VehicleState, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vehicle, err := e.find(id)
+	if err != nil {
+		return VehicleState{}, err
+	}
+	return e.vehicleState(vehicle), nil
+}
+
+// Control pauses, resumes or stops one vehicle
+func (e *Engine) Control(id int, action string) (VehicleState, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vehicle, err := e.find(id)
+	if err != nil {
+		return VehicleState{}, err
+	}
+	if vehicle.Retired {
+		return VehicleState{}, errVehicleRetired
+	}
+	e.apply(vehicle, action)
+	log.Printf("Control: %s vehicle %d", action, id)
+	return e.vehicleState(vehicle), nil
+}
+
+// ControlFleet pauses, resumes or stops every vehicle and returns how many it applied to
+func (e *Engine) ControlFleet(action string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	count := 0
+	for _, vehicle := range e.vehicles {
+		if vehicle.Removed || vehicle.Retired {
+			continue
+		}
+		e.apply(vehicle, action)
+		count++
+	}
+	log.Printf("Control: %s fleet (%d vehicles)", action, count)
+	return count
+}
+
+// apply changes a vehicle's state. A paused vehicle stands still and keeps
+// reporting; a stopped vehicle goes offline until it is resumed. The caller holds mu.
+func (e *Engine) apply(v *VehicleSimulator, action string) {
+	switch action {
+	case "pause":
+		v.Paused = true
+	case "resume":
+		v.Paused = false
+		if v.Stopped {
+			v.Stopped = false
+			e.sendStateEvent(v, EventOnline)
+		}
+	case "stop":
+		if !v.Stopped {
+			v.Stopped = true
+			e.sendStateEvent(v, EventOffline)
+		}
+	}
+}
+
+// sendStateEvent announces a vehicle going offline or online
+func (e *Engine) sendStateEvent(v *VehicleSimulator, eventType string) {
+	event := e.newEvent(v, eventType)
+	e.sendEvent(v, &event)
+}
+
+// newEvent creates an event at the vehicle's last reported position
+func (e *Engine) newEvent(v *VehicleSimulator, eventType string) VehicleEvent {
+	lat, lon, _ := v.position()
+	if last := e.report.LastTelemetry(v); last != nil {
+		lat, lon = last.Lat, last.Lon
+	}
+	return VehicleEvent{
+		VehicleID: v.VehicleID,
+		Timestamp: e.clock.Now().Unix(),
+		Type:      eventType,
+		RouteID:   v.Route.Metadata.ID,
+		Trip:      v.Trip,
+		Lat:       lat,
+		Lon:       lon,
+		Reversed:  v.RouteIterator.Reversed,
+	}
+}
+
+// sendEvent publishes an event outside the vehicle's own step
+func (e *Engine) sendEvent(v *VehicleSimulator, event *VehicleEvent) {
+	start := time.Now()
+	e.sink.SendEventAsync(v, event, func(err error) {
+		e.published(v, start, "event", err)
+	})
+}
+
+// SetSpeedFactor changes the speed multiplier of one vehicle
+func (e *Engine) SetSpeedFactor(id int, factor float64) (VehicleState, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vehicle, err := e.find(id)
+	if err != nil {
+		return VehicleState{}, err
+	}
+	vehicle.SpeedFactor = factor
+	log.Printf("Control: vehicle %d speed factor %.2f", id, factor)
+	return e.vehicleState(vehicle), nil
+}
+
+// SetFleetSpeedFactor changes the speed multiplier of every vehicle
+func (e *Engine) SetFleetSpeedFactor(factor float64) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	count := 0
+	for _, vehicle := range e.vehicles {
+		if !vehicle.Removed {
+			vehicle.SpeedFactor = factor
+			count++
+		}
+	}
+	log.Printf("Control: fleet speed factor %.2f (%d vehicles)", factor, count)
+	return count
+}
+
+// SetClockSpeed changes the time-warp factor and re-times the ticker
+func (e *Engine) SetClockSpeed(speed float64) {
+	e.clock.SetSpeed(speed)
+	select {
+	case e.retick <- struct{}{}:
+	default:
+	}
+}
+
+// AddVehicle starts simulating a vehicle on route. A zero id takes the route's ID
+// when it is free and the next unused ID otherwise; IDs of removed vehicles are not
+// reused, so every vehicle keeps its own entry in the run report.
+func (e *Engine) AddVehicle(id int, route *Route) (VehicleState, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	used := make(map[int]bool, len(e.vehicles))
+	next := 1
+	for _, vehicle := range e.vehicles {
+		used[vehicle.VehicleID] = true
+		next = max(next, vehicle.VehicleID+1)
+	}
+	switch {
+	case id > 0 && used[id]:
+		return VehicleState{}, errVehicleExists
+	case id <= 0 && route.Metadata.ID > 0 && !used[route.Metadata.ID]:
+		id = route.Metadata.ID
+	case id <= 0:
+		id = next
+	}
+	if route.Metadata.ID == 0 {
+		route.Metadata.ID = id
+	}
+
+	vehicle, err := newSimulator(id, route, e.config, e.clock, e.pool)
+	if err != nil {
+		return VehicleState{}, err
+	}
+	vehicle.Faults = e.faults.NewInjector(id, e.config.Simulation.RandomSeed)
+	if e.departures != nil {
+		e.departures.assign(vehicle, e.config.Simulation.RandomSeed, e.clock.Now())
+	}
+	if err := e.sink.AddVehicle(vehicle); err != nil {
+		return VehicleState{}, err
+	}
+	e.vehicles = append(e.vehicles, vehicle)
+	e.report.AddVehicle(vehicle)
+	e.reshard()
+	log.Printf("Control: added vehicle %d on route %d", id, route.Metadata.ID)
+	return e.vehicleState(vehicle), nil
+}
+
+// RemoveVehicle stops simulating a vehicle, announcing it offline if it was reporting
+func (e *Engine) RemoveVehicle(id int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vehicle, err := e.find(id)
+	if err != nil {
+		return err
+	}
+	// The device uploads what it buffered during an outage before it goes
+	for _, telemetry := range flushBuffered(vehicle, e.clock.Now()) {
+		start := time.Now()
+		e.report.RecordTelemetry(vehicle, &telemetry)
+		e.sink.SendTelemetryAsync(vehicle, &telemetry, func(err error) {
+			e.published(vehicle, start, "telemetry", err)
+		})
+	}
+	if !vehicle.Stopped && !vehicle.Retired && e.report.LastTelemetry(vehicle) != nil {
+		e.sendStateEvent(vehicle, EventOffline)
+	}
+	if err := e.sink.RemoveVehicle(vehicle); err != nil {
+		log.Printf("Control: failed to release vehicle %d in the sinks: %v", id, err)
+	}
+	vehicle.Removed = true
+	e.reshard()
+	log.Printf("Control: removed vehicle %d", id)
+	return nil
+}
+
+// RouteGeometry is the polyline of a route driven by at least one vehicle
+type RouteGeometry struct {
+	RouteID int          `json:"route_id"`
+	Points  [][2]float64 `json:"points"` // [lat, lon]
+}
+
+// RouteGeometries returns the routes the vehicles are currently driving
+func (e *Engine) RouteGeometries() []RouteGeometry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	seen := make(map[*Route]bool)
+	var geometries []RouteGeometry
+	for _, vehicle := range e.vehicles {
+		if vehicle.Removed || seen[vehicle.Route] {
+			continue
+		}
+		seen[vehicle.Route] = true
+		geometries = append(geometries, RouteGeometry{
+			RouteID: vehicle.Route.Metadata.ID,
+			Points:  decodePolyline(vehicle.Route.Route.Geometry),
+		})
+	}
+	return geometries
+}
+
+// ControlServer serves the HTTP control API of a running simulation, the position
+// feed and the map viewer
+type ControlServer struct {
+	engine *Engine
+	feed   *PositionFeed
+	router *mux.Router
+	server *http.Server
+}
+
+// NewControlServer creates the control API
+func NewControlServer(cfg ControlConfig, engine *Engine, feed *PositionFeed) *ControlServer {
+	s := &ControlServer{
+		engine: engine,
+		feed:   feed,
+		router: mux.NewRouter(),
+	}
+	s.setupRoutes()
+	s.server = &http.Server{Addr: cfg.Listen, Handler: s.router}
+	return s
+}
+
+// setupRoutes configures the API routes
+func (s *ControlServer) setupRoutes() {
+	s.router.HandleFunc("/health", s.Health).Methods("GET")
+	s.router.HandleFunc("/api/v1/vehicles", s.ListVehicles).Methods("GET")
+	s.router.HandleFunc("/api/v1/vehicles", s.AddVehicle).Methods("POST")
+	s.router.HandleFunc("/api/v1/vehicles/{id:[0-9]+}", s.GetVehicle).Methods("GET")
+	s.router.HandleFunc("/api/v1/vehicles/{id:[0-9]+}", s.RemoveVehicle).Methods("DELETE")
+	s.router.HandleFunc("/api/v1/vehicles/{id:[0-9]+}/{action:pause|resume|stop}", s.ControlVehicle).Methods("POST")
+	s.router.HandleFunc("/api/v1/vehicles/{id:[0-9]+}/speed", s.SetVehicleSpeed).Methods("PUT")
+	s.router.HandleFunc("/api/v1/fleet/{action:pause|resume|stop}", s.ControlFleet).Methods("POST")
+	s.router.HandleFunc("/api/v1/fleet/speed", s.SetFleetSpeed).Methods("PUT")
+	s.router.HandleFunc("/api/v1/clock", s.GetClock).Methods("GET")
+	s.router.HandleFunc("/api/v1/clock", s.SetClock).Methods("PUT")
+	s.router.HandleFunc("/api/v1/routes", s.ListRoutes).Methods("GET")
+	s.router.Handle("/api/v1/feed", s.feed).Methods("GET")
+	s.router.HandleFunc("/", serveViewer).Methods("GET")
+}
+
+// Start listens on the configured address and serves in the background
+func (s *ControlServer) Start() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.server.Addr, err)
+	}
+	log.Printf("Control API listening on %s", listener.Addr())
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Control API stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops accepting requests and waits briefly for running ones
+func (s *ControlServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// Health reports that the simulation is running
+func (s *ControlServer) Health(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "running",
+		"service": "simulation-service",
+	})
+}
+
+// ListVehicles handles GET /api/v1/vehicles
+func (s *ControlServer) ListVehicles(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, s.engine.VehicleStates())
+}
+
+// ListRoutes handles GET /api/v1/routes
+func (s *ControlServer) ListRoutes(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, s.engine.RouteGeometries())
+}
+
+// GetVehicle handles GET /api/v1/vehicles/{id}
+func (s *ControlServer) GetVehicle(w http.ResponseWriter, r *http.Request) {
+	state, err := s.engine.VehicleState(vehicleID(r))
+	respondState(w, http.StatusOK, state, err)
+}
+
+// ControlVehicle handles POST /api/v1/vehicles/{id}/pause, /resume and /stop
+func (s *ControlServer) ControlVehicle(w http.ResponseWriter, r *http.Request) {
+	state, err := s.engine.Control(vehicleID(r), mux.Vars(r)["action"])
+	respondState(w, http.StatusOK, state, err)
+}
+
+// speedRequest is the body of the speed endpoints
+type speedRequest struct {
+	Factor float64 `json:"factor"` // speed multiplier of vehicles
+	Speed  float64 `json:"speed"`  // time-warp factor of the clock
+}
+
+// decodeSpeed reads a speed request and checks that the field it needs is positive
+func decodeSpeed(w http.ResponseWriter, r *http.Request, field string) (float64, bool) {
+	var req speedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return 0, false
+	}
+	value := req.Factor
+	if field == "speed" {
+		value = req.Speed
+	}
+	if !(value > 0) || math.IsInf(value, 0) {
+		respondError(w, http.StatusBadRequest, field+" must be a positive number")
+		return 0, false
+	}
+	return value, true
+}
+
+// SetVehicleSpeed handles PUT /api/v1/vehicles/{id}/speed
+// Request body: {"factor": 1.5}
+func (s *ControlServer) SetVehicleSpeed(w http.ResponseWriter, r *http.Request) {
+	factor, ok := decodeSpeed(w, r, "factor")
+	if !ok {
+		return
+	}
+	state, err := s.engine.SetSpeedFactor(vehicleID(r), factor)
+	respondState(w, http.StatusOK, state, err)
+}
+
+// ControlFleet handles POST /api/v1/fleet/pause, /resume and /stop
+func (s *ControlServer) ControlFleet(w http.ResponseWriter, r *http.Request) {
+	action := mux.Vars(r)["action"]
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"action":   action,
+		"vehicles": s.engine.ControlFleet(action),
+	})
+}
+
+// SetFleetSpeed handles PUT /api/v1/fleet/speed
+// Request body: {"factor": 1.5}
+func (s *ControlServer) SetFleetSpeed(w http.ResponseWriter, r *http.Request) {
+	factor, ok := decodeSpeed(w, r, "factor")
+	if !ok {
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"factor":   factor,
+		"vehicles": s.engine.SetFleetSpeedFactor(factor),
+	})
+}
+
+// GetClock handles GET /api/v1/clock
+func (s *ControlServer) GetClock(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"time":  s.engine.clock.Now(),
+		"speed": s.engine.clock.Speed(),
+	})
+}
+
+// SetClock handles PUT /api/v1/clock
+// Request body: {"speed": 60}
+func (s *ControlServer) SetClock(w http.ResponseWriter, r *http.Request) {
+	speed, ok := decodeSpeed(w, r, "speed")
+	if !ok {
+		return
+	}
+	s.engine.SetClockSpeed(speed)
+	s.GetClock(w, r)
+}
+
+// addVehicleRequest is the body of POST /api/v1/vehicles: either a route file or
+// start and end coordinates routed by the route service
+type addVehicleRequest struct {
+	VehicleID int                `json:"vehicle_id"` // optional
+	RouteFile string             `json:"route_file"` // relative to routes_path
+	Start     *models.Coordinate `json:"start"`
+	End       *models.Coordinate `json:"end"`
+	Profile   string             `json:"profile"` // route service profile, default car
+}
+
+// AddVehicle handles POST /api/v1/vehicles
+// Request body: {"route_file": "route_000042.json"} or
+// {"start": {"latitude": 51.5, "longitude": -0.1}, "end": {"latitude": 51.51, "longitude": -0.12}}
+func (s *ControlServer) AddVehicle(w http.ResponseWriter, r *http.Request) {
+	var req addVehicleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+
+	var route *Route
+	var err error
+	switch {
+	case req.RouteFile != "":
+		path, err := routeFilePath(s.engine.config.Simulation.RoutesPath, req.RouteFile)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		route, err = loadRouteFile(path)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case req.Start != nil && req.End != nil:
+		if req.Profile == "" {
+			req.Profile = "car"
+		}
+		route, err = s.engine.routes.FindRoute(*req.Start, *req.End, req.Profile)
+		if err != nil {
+			respondError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	default:
+		respondError(w, http.StatusBadRequest, "route_file or start and end are required")
+		return
+	}
+
+	state, err := s.engine.AddVehicle(req.VehicleID, route)
+	respondState(w, http.StatusCreated, state, err)
+}
+
+// routeFilePath resolves a route file requested through the API. A relative name is
+// relative to routes_path; either way the file must be inside routes_path, so the API
+// cannot read other files on the server.
+func routeFilePath(root, name string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	// Resolve symbolic links, so a link cannot point outside routes_path
+	for _, p := range []*string{&root, &path} {
+		resolved, err := filepath.EvalSymlinks(*p)
+		if err != nil {
+			return "", fmt.Errorf("route file %s not found", name)
+		}
+		*p = resolved
+	}
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("route file %s is outside routes_path", name)
+	}
+	return path, nil
+}
+
+// RemoveVehicle handles DELETE /api/v1/vehicles/{id}
+func (s *ControlServer) RemoveVehicle(w http.ResponseWriter, r *http.Request) {
+	if err := s.engine.RemoveVehicle(vehicleID(r)); err != nil {
+		respondState(w, http.StatusOK, VehicleState{}, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// vehicleID returns the {id} route variable; the route pattern ensures it is numeric
+func vehicleID(r *http.Request) int {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	return id
+}
+
+// respondState sends a vehicle state, or the error with its status code
+func respondState(w http.ResponseWriter, statusCode int, state VehicleState, err error) {
+	switch {
+	case errors.Is(err, errVehicleNotFound):
+		respondError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errVehicleExists), errors.Is(err, errVehicleRetired):
+		respondError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	default:
+		respondJSON(w, statusCode, state)
+	}
+}
+
+// respondJSON sends a JSON response
+func respondJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(data)
+}
+
+// respondError sends an error response
+func respondError(w http.ResponseWriter, statusCode int, message string) {
+	respondJSON(w, statusCode, map[string]interface{}{
+		"error": message,
+	})
+}
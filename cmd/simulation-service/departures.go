@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What a vehicle reports before its first departure
+const (
+	WaitParked = "parked" // speed 0 at the start of its route, engine off
+	WaitIdle   = "idle"   // speed 0 at the start of its route, engine on
+	WaitNone   = "none"   // nothing until it departs
+)
+
+// DepartureConfig schedules departures. Without a schedule every vehicle departs at the
+// simulation start.
+type DepartureConfig struct {
+	Stagger string           `yaml:"stagger"` // random delay of every departure, up to this window
+	File    string           `yaml:"file"`    // CSV of fixed departures: route_id, departure
+	Shifts  []DepartureShift `yaml:"shifts"`  // recurring departures
+	Before  string           `yaml:"before"`  // parked (default), idle or none
+}
+
+// Enabled reports whether departures are scheduled
+func (c DepartureConfig) Enabled() bool {
+	return c.Stagger != "" || c.File != "" || len(c.Shifts) > 0
+}
+
+// DepartureShift is a recurring departure, e.g. weekday trips at 07:00 and 16:30
+type DepartureShift struct {
+	Days   []string `yaml:"days"`   // mon..sun, weekdays or weekend; empty means every day
+	Times  []string `yaml:"times"`  // local times of day, "07:00" or "07:00:30"
+	Routes []int    `yaml:"routes"` // route IDs; empty means every route
+}
+
+// departureShift is a parsed DepartureShift
+type departureShift struct {
+	days   [7]bool // by time.Weekday
+	times  []time.Duration
+	routes map[int]bool
+}
+
+// departurePlan is the parsed schedule of the whole fleet
+type departurePlan struct {
+	stagger  time.Duration
+	before   string
+	location *time.Location      // of the simulation start, for times of day
+	fixed    map[int][]time.Time // by route ID, sorted
+	shifts   []departureShift
+}
+
+// weekdays maps day names to weekdays
+var weekdays = map[string][]time.Weekday{
+	"sun": {time.Sunday}, "mon": {time.Monday}, "tue": {time.Tuesday}, "wed": {time.Wednesday},
+	"thu": {time.Thursday}, "fri": {time.Friday}, "sat": {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekend":  {time.Saturday, time.Sunday},
+}
+
+// parseTimeOfDay parses "15:04" or "15:04:05" into the time since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+				time.Duration(t.Second())*time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q: must be HH:MM or HH:MM:SS", value)
+}
+
+// newDeparturePlan parses the configuration and reads the departure file. Times of
+// day are in the time zone of the simulation start.
+func newDeparturePlan(cfg DepartureConfig, start time.Time) (*departurePlan, error) {
+	plan := &departurePlan{stagger: parseDuration(cfg.Stagger, 0), before: cfg.Before, location: start.Location()}
+	switch plan.before {
+	case "":
+		plan.before = WaitParked
+	case WaitParked, WaitIdle, WaitNone:
+	default:
+		return nil, fmt.Errorf("invalid before %q: must be parked, idle or none", cfg.Before)
+	}
+
+	for i, shift := range cfg.Shifts {
+		parsed := departureShift{routes: make(map[int]bool)}
+		for _, name := range shift.Days {
+			days, ok := weekdays[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("shift %d: invalid day %q", i+1, name)
+			}
+			for _, day := range days {
+				parsed.days[day] = true
+			}
+		}
+		if len(shift.Days) == 0 {
+			parsed.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		for _, value := range shift.Times {
+			offset, err := parseTimeOfDay(value)
+			if err != nil {
+				return nil, fmt.Errorf("shift %d: %w", i+1, err)
+			}
+			parsed.times = append(parsed.times, offset)
+		}
+		if len(parsed.times) == 0 {
+			return nil, fmt.Errorf("shift %d has no times", i+1)
+		}
+		for _, id := range shift.Routes {
+			parsed.routes[id] = true
+		}
+		plan.shifts = append(plan.shifts, parsed)
+	}
+
+	if cfg.File != "" {
+		fixed, err := loadDepartureFile(cfg.File, start)
+		if err != nil {
+			return nil, err
+		}
+		plan.fixed = fixed
+	}
+	return plan, nil
+}
+
+// loadDepartureFile reads fixed departures from a CSV file with a header row and the
+// columns route_id and departure. A route can have several rows, one per trip. A
+// departure is an RFC3339 time or a time of day on the simulation start date.
+func loadDepartureFile(path string, start time.Time) (map[int][]time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open departure file: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read departure file: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("departure file %s is empty", path)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"route_id", "departure"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("departure file %s has no %s column", path, name)
+		}
+	}
+	field := func(row []string, name string) string {
+		if i := columns[name]; i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	midnight := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
+	departures := make(map[int][]time.Time)
+	for line, row := range rows[1:] {
+		routeID, err := strconv.Atoi(field(row, "route_id"))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid route_id: %w", path, line+2, err)
+		}
+		value := field(row, "departure")
+		departure, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			offset, err := parseTimeOfDay(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid departure %q: must be RFC3339 or HH:MM", path, line+2, value)
+			}
+			departure = midnight.Add(offset)
+		}
+		departures[routeID] = append(departures[routeID], departure)
+	}
+	for _, times := range departures {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	}
+	return departures, nil
+}
+
+// DepartureSchedule holds a vehicle's departure times. A vehicle with fixed or
+// recurring departures only leaves on schedule; with just a stagger, only its first
+// departure is delayed.
+type DepartureSchedule struct {
+	Next   time.Time // next departure; zero when none is left
+	Before string    // parked, idle or none before the first departure
+
+	plan      *departurePlan
+	fixed     []time.Time
+	shifts    []departureShift
+	scheduled bool       // fixed or recurring departures gate every trip
+	rng       *rand.Rand // separate from the vehicle's, so its clean values do not change
+}
+
+// schedule creates the schedule of a vehicle on a route
+func (p *departurePlan) schedule(vehicleID, routeID int, seed int64, start time.Time) *DepartureSchedule {
+	s := &DepartureSchedule{
+		Before: p.before,
+		plan:   p,
+		fixed:  p.fixed[routeID],
+		rng:    rand.New(rand.NewSource(vehicleSeed(seed, vehicleID) ^ 0xde9a27)),
+	}
+	for _, shift := range p.shifts {
+		if len(shift.routes) == 0 || shift.routes[routeID] {
+			s.shifts = append(s.shifts, shift)
+		}
+	}
+	s.scheduled = len(s.fixed) > 0 || len(s.shifts) > 0
+
+	slot := start
+	if s.scheduled {
+		var ok bool
+		if slot, ok = s.slotAfter(start.Add(-time.Nanosecond)); !ok {
+			return s // no departure left; the vehicle stays at the start of its route
+		}
+	}
+	s.Next = s.stagger(slot)
+	return s
+}
+
+// stagger adds the random delay to a departure slot
+func (s *DepartureSchedule) stagger(slot time.Time) time.Time {
+	if s.plan.stagger <= 0 {
+		return slot
+	}
+	return slot.Add(time.Duration(s.rng.Int63n(int64(s.plan.stagger))))
+}
+
+// slotAfter returns the first fixed or recurring departure after t
+func (s *DepartureSchedule) slotAfter(t time.Time) (time.Time, bool) {
+	var best time.Time
+	for _, departure := range s.fixed {
+		if departure.After(t) {
+			best = departure
+			break
+		}
+	}
+
+	// A week ahead covers every recurring slot
+	t = t.In(s.plan.location)
+	for day := 0; day <= 7; day++ {
+		date := t.AddDate(0, 0, day)
+		for _, shift := range s.shifts {
+			if !shift.days[date.Weekday()] {
+				continue
+			}
+			for _, offset := range shift.times {
+				slot := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, t.Location()).Add(offset)
+				if slot.After(t) && (best.IsZero() || slot.Before(best)) {
+					best = slot
+				}
+			}
+		}
+	}
+	return best, !best.IsZero()
+}
+
+// Due reports whether a vehicle may depart at t. A nil schedule is always due.
+func (s *DepartureSchedule) Due(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	if s.Next.IsZero() {
+		return !s.scheduled // a stagger only delays the first departure
+	}
+	return !t.Before(s.Next)
+}
+
+// Scheduled reports whether fixed or recurring departures gate every trip. Such a
+// vehicle also departs again after parking at its destination.
+func (s *DepartureSchedule) Scheduled() bool {
+	return s != nil && s.scheduled
+}
+
+// Departed moves the schedule on to the next slot after t. A vehicle that departs
+// late skips the slots it missed.
+func (s *DepartureSchedule) Departed(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.Next = time.Time{}
+	if slot, ok := s.slotAfter(t); s.scheduled && ok {
+		s.Next = s.stagger(slot)
+	}
+}
+
+// assign gives a vehicle its schedule from start. The vehicle waits at the start of
+// its route until its first departure.
+func (p *departurePlan) assign(v *VehicleSimulator, seed int64, start time.Time) {
+	v.Departures = p.schedule(v.VehicleID, v.Route.Metadata.ID, seed, start)
+	v.Waiting = v.Departures.Next.IsZero() || v.Departures.Next.After(start)
+}
+
+// setupDepartures gives every vehicle a departure schedule and returns the plan for
+// vehicles added later, or nil when departures are not scheduled
+func setupDepartures(config *Config, simulators []*VehicleSimulator, start time.Time) (*departurePlan, error) {
+	cfg := config.Simulation.Departures
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	plan, err := newDeparturePlan(cfg, start)
+	if err != nil {
+		return nil, err
+	}
+
+	var first, last time.Time
+	waiting := 0
+	for _, simulator := range simulators {
+		plan.assign(simulator, config.Simulation.RandomSeed, start)
+		schedule := simulator.Departures
+		if simulator.Waiting {
+			waiting++
+		}
+		if schedule.Next.IsZero() {
+			log.Printf("Warning: vehicle %d has no departure after %s", simulator.VehicleID, start.Format(time.RFC3339))
+			continue
+		}
+		if first.IsZero() || schedule.Next.Before(first) {
+			first = schedule.Next
+		}
+		if schedule.Next.After(last) {
+			last = schedule.Next
+		}
+	}
+	if !first.IsZero() {
+		log.Printf("Departures: %d of %d vehicles wait (%s), first departs %s, last %s",
+			waiting, len(simulators), plan.before, first.Format(time.RFC3339), last.Format(time.RFC3339))
+	}
+	return plan, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// monday is 2026-01-05, a Monday
+func monday(clock string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", "2026-01-05 "+clock)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestDepartureSchedule(t *testing.T) {
+	weekdays := DepartureShift{Days: []string{"weekdays"}, Times: []string{"07:00", "16:30"}}
+	tests := []struct {
+		name    string
+		cfg     DepartureConfig
+		fixed   []time.Time // departure file rows of the route
+		routeID int
+		start   time.Time
+		want    time.Time // first departure; zero for none
+	}{
+		{"stagger only", DepartureConfig{Stagger: "0s"}, nil, 1, monday("06:00"), monday("06:00")},
+		{"next slot today", DepartureConfig{Shifts: []DepartureShift{weekdays}}, nil, 1, monday("06:00"), monday("07:00")},
+		{"slot at start", DepartureConfig{Shifts: []DepartureShift{weekdays}}, nil, 1, monday("07:00"), monday("07:00")},
+		{"later slot today", DepartureConfig{Shifts: []DepartureShift{weekdays}}, nil, 1, monday("08:00"), monday("16:30")},
+		{"next day", DepartureConfig{Shifts: []DepartureShift{weekdays}}, nil, 1, monday("17:00"), monday("07:00").AddDate(0, 0, 1)},
+		{"over the weekend",
+			DepartureConfig{Shifts: []DepartureShift{weekdays}}, nil, 1,
+			monday("17:00").AddDate(0, 0, 4), monday("07:00").AddDate(0, 0, 7)},
+		{"weekend shift",
+			DepartureConfig{Shifts: []DepartureShift{{Days: []string{"sat"}, Times: []string{"10:00:30"}}}}, nil, 1,
+			monday("06:00"), monday("10:00").Add(30*time.Second).AddDate(0, 0, 5)},
+		{"other route",
+			DepartureConfig{Shifts: []DepartureShift{{Times: []string{"07:00"}, Routes: []int{2}}}}, nil, 1,
+			monday("06:00"), monday("06:00")},
+		{"fixed before shift",
+			DepartureConfig{Shifts: []DepartureShift{weekdays}}, []time.Time{monday("06:45")}, 1,
+			monday("06:00"), monday("06:45")},
+		{"fixed departures used up",
+			DepartureConfig{}, []time.Time{monday("05:00")}, 1,
+			monday("06:00"), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := newDeparturePlan(tt.cfg, tt.start)
+			if err != nil {
+				t.Fatalf("newDeparturePlan: %v", err)
+			}
+			if tt.fixed != nil {
+				plan.fixed = map[int][]time.Time{tt.routeID: tt.fixed}
+			}
+
+			schedule := plan.schedule(1, tt.routeID, 7, tt.start)
+			if !schedule.Next.Equal(tt.want) {
+				t.Errorf("first departure %s, want %s", schedule.Next, tt.want)
+			}
+		})
+	}
+}
+
+func TestDepartureScheduleDeparted(t *testing.T) {
+	shifts := []DepartureShift{{Days: []string{"weekdays"}, Times: []string{"07:00", "16:30"}}}
+	tests := []struct {
+		name     string
+		cfg      DepartureConfig
+		departed time.Time
+		want     time.Time // next departure; zero for none
+		due      bool      // whether the vehicle may depart again right away
+	}{
+		{"next slot", DepartureConfig{Shifts: shifts}, monday("07:00"), monday("16:30"), false},
+		{"late departure skips missed slots", DepartureConfig{Shifts: shifts}, monday("17:00"), monday("07:00").AddDate(0, 0, 1), false},
+		{"friday evening", DepartureConfig{Shifts: shifts}, monday("16:30").AddDate(0, 0, 4), monday("07:00").AddDate(0, 0, 7), false},
+		{"stagger only departs once", DepartureConfig{Stagger: "10m"}, monday("06:05"), time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := newDeparturePlan(tt.cfg, monday("06:00"))
+			if err != nil {
+				t.Fatalf("newDeparturePlan: %v", err)
+			}
+			schedule := plan.schedule(1, 1, 7, monday("06:00"))
+			schedule.Departed(tt.departed)
+			if !schedule.Next.Equal(tt.want) {
+				t.Errorf("next departure %s, want %s", schedule.Next, tt.want)
+			}
+			if due := schedule.Due(tt.departed.Add(time.Minute)); due != tt.due {
+				t.Errorf("Due a minute after departing = %v, want %v", due, tt.due)
+			}
+		})
+	}
+}
+
+func TestDepartureStagger(t *testing.T) {
+	plan, err := newDeparturePlan(DepartureConfig{Stagger: "30m"}, monday("06:00"))
+	if err != nil {
+		t.Fatalf("newDeparturePlan: %v", err)
+	}
+	spread := make(map[time.Time]bool)
+	for id := 1; id <= 50; id++ {
+		first := plan.schedule(id, 1, 7, monday("06:00")).Next
+		if first.Before(monday("06:00")) || !first.Before(monday("06:30")) {
+			t.Errorf("vehicle %d departs at %s, outside the stagger window", id, first)
+		}
+		if again := plan.schedule(id, 1, 7, monday("06:00")).Next; !again.Equal(first) {
+			t.Errorf("vehicle %d departs at %s and then %s with the same seed", id, first, again)
+		}
+		spread[first] = true
+	}
+	if len(spread) < 40 {
+		t.Errorf("50 vehicles share %d departure times", len(spread))
+	}
+}
+
+func TestParseDepartureConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  DepartureConfig
+	}{
+		{"unknown day", DepartureConfig{Shifts: []DepartureShift{{Days: []string{"someday"}, Times: []string{"07:00"}}}}},
+		{"bad time", DepartureConfig{Shifts: []DepartureShift{{Times: []string{"7am"}}}}},
+		{"no times", DepartureConfig{Shifts: []DepartureShift{{Days: []string{"mon"}}}}},
+		{"unknown before", DepartureConfig{Stagger: "1m", Before: "asleep"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newDeparturePlan(tt.cfg, monday("06:00")); err == nil {
+				t.Error("invalid configuration accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceCredentials are the MQTT credentials of one simulated device
+type DeviceCredentials struct {
+	ClientID string
+	Username string
+	Password string
+	CertFile string
+	KeyFile  string
+}
+
+// loadDeviceCredentials reads per-device credentials from a CSV file with a header row.
+// The vehicle_id column is required; client_id, username, password, cert_file and
+// key_file are optional.
+func loadDeviceCredentials(path string) (map[int]DeviceCredentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open credentials file: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("credentials file %s is empty", path)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["vehicle_id"]; !ok {
+		return nil, fmt.Errorf("credentials file %s has no vehicle_id column", path)
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	credentials := make(map[int]DeviceCredentials, len(rows)-1)
+	for line, row := range rows[1:] {
+		vehicleID, err := strconv.Atoi(field(row, "vehicle_id"))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid vehicle_id: %w", path, line+2, err)
+		}
+		credentials[vehicleID] = DeviceCredentials{
+			ClientID: field(row, "client_id"),
+			Username: field(row, "username"),
+			Password: field(row, "password"),
+			CertFile: field(row, "cert_file"),
+			KeyFile:  field(row, "key_file"),
+		}
+	}
+	return credentials, nil
+}
+
+// deviceMQTTConfig derives the connection settings of one device from the shared
+// configuration: its own client ID, credentials, status topic and queue file
+func deviceMQTTConfig(base MQTTConfig, v *VehicleSimulator, topics *TopicTemplates,
+	credentials map[int]DeviceCredentials) MQTTConfig {
+	cfg := base
+	cfg.Quiet = true
+
+	template := cfg.ClientIDTemplate
+	if template == "" {
+		template = "vehicle_{vehicle_id}"
+	}
+	cfg.ClientID = topics.expand(template, v)
+
+	if creds, ok := credentials[v.VehicleID]; ok {
+		if creds.ClientID != "" {
+			cfg.ClientID = creds.ClientID
+		}
+		if creds.Username != "" {
+			cfg.Username = creds.Username
+			cfg.Password = creds.Password
+		}
+		if creds.CertFile != "" {
+			cfg.TLS.CertFile = creds.CertFile
+			cfg.TLS.KeyFile = creds.KeyFile
+		}
+	}
+
+	// Each device announces its own status and keeps its own queue file
+	cfg.Will.Topic = topics.expand(cfg.Will.Topic, v)
+	if cfg.OfflineQueue.Type == "file" {
+		path := cfg.OfflineQueue.Path
+		if path == "" {
+			path = "mqtt_queue.jsonl"
+		}
+		ext := filepath.Ext(path)
+		cfg.OfflineQueue.Path = strings.TrimSuffix(path, ext) + "_" + cfg.ClientID + ext
+	}
+	return cfg
+}
+
+// deviceClients are the MQTT clients of the vehicles in per-device mode
+type deviceClients struct {
+	config      *Config
+	topics      *TopicTemplates
+	credentials map[int]DeviceCredentials
+	inflight    *InflightLimiter
+	connector   *deviceConnector
+
+	mu         sync.Mutex     // vehicles are added and removed through the control API
+	clientIDs  map[string]int // vehicle ID by client ID
+	publishers []*MQTTPublisher
+	removed    map[*MQTTPublisher]bool // the connector skips them
+	closing    sync.WaitGroup          // clients of removed vehicles disconnecting
+}
+
+// createDeviceClients gives every simulator its own MQTT client. The clients are
+// created unconnected, so vehicles queue telemetry until their connection is up,
+// and connections are opened in the background at connect_rate per second until
+// the clients are closed.
+func createDeviceClients(config *Config, simulators []*VehicleSimulator, topics *TopicTemplates,
+	inflight *InflightLimiter) (*deviceClients, error) {
+	devices := &deviceClients{
+		config:    config,
+		topics:    topics,
+		inflight:  inflight,
+		clientIDs: make(map[string]int, len(simulators)),
+		removed:   make(map[*MQTTPublisher]bool),
+	}
+	if config.MQTT.CredentialsFile != "" {
+		var err error
+		devices.credentials, err = loadDeviceCredentials(config.MQTT.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded credentials for %d devices from %s", len(devices.credentials), config.MQTT.CredentialsFile)
+	}
+
+	missing := 0
+	for _, simulator := range simulators {
+		if _, err := devices.create(simulator); err != nil {
+			closePublishers(devices.publishers)
+			return nil, err
+		}
+		if _, ok := devices.credentials[simulator.VehicleID]; devices.credentials != nil && !ok {
+			missing++
+		}
+	}
+	if missing > 0 {
+		log.Printf("Warning: %d vehicles have no entry in %s and use the shared credentials",
+			missing, config.MQTT.CredentialsFile)
+	}
+
+	rate := config.MQTT.ConnectRate
+	if rate <= 0 {
+		rate = 50
+	}
+	log.Printf("Opening %d device connections at %.0f/s (ramp-up %s)", len(devices.publishers), rate,
+		time.Duration(float64(len(devices.publishers))/rate*float64(time.Second)).Round(time.Second))
+
+	devices.connector = &deviceConnector{stop: make(chan struct{}), done: make(chan struct{})}
+	go devices.connector.run(devices.publishers, rate, devices.connect)
+	return devices, nil
+}
+
+// create gives a vehicle its own unconnected client
+func (d *deviceClients) create(v *VehicleSimulator) (*MQTTPublisher, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cfg := deviceMQTTConfig(d.config.MQTT, v, d.topics, d.credentials)
+	if other, exists := d.clientIDs[cfg.ClientID]; exists {
+		return nil, fmt.Errorf("vehicles %d and %d share client ID %q", other, v.VehicleID, cfg.ClientID)
+	}
+	publisher, err := newMQTTPublisher(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("vehicle %d: %w", v.VehicleID, err)
+	}
+	publisher.inflight = d.inflight
+	d.clientIDs[cfg.ClientID] = v.VehicleID
+	d.publishers = append(d.publishers, publisher)
+	v.MQTT = publisher
+	return publisher, nil
+}
+
+// Add gives a vehicle added at runtime its own client and connects it right away
+func (d *deviceClients) Add(v *VehicleSimulator) error {
+	publisher, err := d.create(v)
+	if err != nil {
+		return err
+	}
+	publisher.Client.Connect()
+	return nil
+}
+
+// connect opens a client's connection unless its vehicle has been removed
+func (d *deviceClients) connect(publisher *MQTTPublisher) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.removed[publisher] {
+		publisher.Client.Connect()
+	}
+}
+
+// Remove disconnects the client of a removed vehicle. It disconnects in the
+// background, so the vehicle's offline event can still go out.
+func (d *deviceClients) Remove(v *VehicleSimulator) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := slices.Index(d.publishers, v.MQTT)
+	if i < 0 {
+		return
+	}
+	publisher := d.publishers[i]
+	// The connector may still range over the old slice
+	d.publishers = slices.Delete(slices.Clone(d.publishers), i, i+1)
+	for clientID, vehicleID := range d.clientIDs {
+		if vehicleID == v.VehicleID {
+			delete(d.clientIDs, clientID)
+		}
+	}
+	d.removed[publisher] = true
+	d.closing.Add(1)
+	go func() {
+		defer d.closing.Done()
+		publisher.Close()
+	}()
+}
+
+// Close stops opening connections and disconnects every client
+func (d *deviceClients) Close() {
+	d.connector.Close()
+	d.closing.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	closePublishers(d.publishers)
+}
+
+// deviceConnector opens device connections in the background
+type deviceConnector struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// run connects the publishers at rate per second until every one is connected or
+// the connector is closed
+func (c *deviceConnector) run(publishers []*MQTTPublisher, rate float64, connect func(*MQTTPublisher)) {
+	defer close(c.done)
+	pacer := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer pacer.Stop()
+	for i, publisher := range publishers {
+		if i > 0 {
+			select {
+			case <-c.stop:
+				log.Printf("Stopped opening device connections, %d of %d opened", i, len(publishers))
+				return
+			case <-pacer.C:
+			}
+		}
+		connect(publisher)
+	}
+	log.Printf("All %d device connections opened", len(publishers))
+}
+
+// Close stops opening connections and waits for the connector to return, so no
+// connection is opened after the publishers are closed
+func (c *deviceConnector) Close() {
+	close(c.stop)
+	<-c.done
+}
+
+// closePublishers disconnects every publisher
+func closePublishers(publishers []*MQTTPublisher) {
+	for _, publisher := range publishers {
+		publisher.Close()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// EnergyProfile describes how a vehicle type stores and uses energy. Units are liters
+// for fuel and kWh for batteries.
+type EnergyProfile struct {
+	Source           string     `yaml:"source"`             // "fuel" or "battery"
+	Capacity         float64    `yaml:"capacity"`           // tank size or battery capacity
+	ConsumptionPerKm float64    `yaml:"consumption_per_km"` // at moderate speeds
+	SpeedFactor      float64    `yaml:"speed_factor"`       // extra consumption at 120 km/h, e.g. 0.35 = +35%
+	IdlePerHour      float64    `yaml:"idle_per_hour"`      // consumption while stopped with the engine on
+	ChargePerHour    float64    `yaml:"charge_per_hour"`    // charging or refuelling rate while parked
+	ChargeBelow      float64    `yaml:"charge_below"`       // start charging when parked below this level (%)
+	InitialLevel     [2]float64 `yaml:"initial_level"`      // starting level range (%)
+}
+
+// defaultEnergyProfiles are the built-in profiles of the default vehicle types
+var defaultEnergyProfiles = map[string]EnergyProfile{
+	"car":   {Source: "fuel", Capacity: 50, ConsumptionPerKm: 0.07, SpeedFactor: 0.35, IdlePerHour: 0.8, ChargePerHour: 1500, ChargeBelow: 20, InitialLevel: [2]float64{40, 100}},
+	"truck": {Source: "fuel", Capacity: 400, ConsumptionPerKm: 0.32, SpeedFactor: 0.25, IdlePerHour: 2.5, ChargePerHour: 2400, ChargeBelow: 20, InitialLevel: [2]float64{50, 100}},
+	"bus":   {Source: "fuel", Capacity: 250, ConsumptionPerKm: 0.35, SpeedFactor: 0.2, IdlePerHour: 2.0, ChargePerHour: 2400, ChargeBelow: 25, InitialLevel: [2]float64{50, 100}},
+	"ev":    {Source: "battery", Capacity: 60, ConsumptionPerKm: 0.16, SpeedFactor: 0.5, IdlePerHour: 0.5, ChargePerHour: 11, ChargeBelow: 80, InitialLevel: [2]float64{50, 100}},
+	"bike":  {Source: "battery", Capacity: 0.5, ConsumptionPerKm: 0.01, SpeedFactor: 0.1, IdlePerHour: 0, ChargePerHour: 0.25, ChargeBelow: 50, InitialLevel: [2]float64{60, 100}},
+}
+
+// energyProfileFor resolves the energy profile of a vehicle type, filling unset fields
+// from the built-in profile of the same name or of the same energy source
+func energyProfileFor(typeName string, vt VehicleType) EnergyProfile {
+	base, ok := defaultEnergyProfiles[typeName]
+	if !ok {
+		base = defaultEnergyProfiles["car"]
+		if vt.Energy.Source == "battery" {
+			base = defaultEnergyProfiles["ev"]
+		}
+	}
+	return vt.Energy.withDefaults(base)
+}
+
+// withDefaults fills unset fields from base
+func (p EnergyProfile) withDefaults(base EnergyProfile) EnergyProfile {
+	if p.Source == "" {
+		p.Source = base.Source
+	}
+	if p.Capacity <= 0 {
+		p.Capacity = base.Capacity
+	}
+	if p.ConsumptionPerKm <= 0 {
+		p.ConsumptionPerKm = base.ConsumptionPerKm
+	}
+	if p.SpeedFactor <= 0 {
+		p.SpeedFactor = base.SpeedFactor
+	}
+	if p.IdlePerHour <= 0 {
+		p.IdlePerHour = base.IdlePerHour
+	}
+	if p.ChargePerHour <= 0 {
+		p.ChargePerHour = base.ChargePerHour
+	}
+	if p.ChargeBelow <= 0 {
+		p.ChargeBelow = base.ChargeBelow
+	}
+	if p.InitialLevel[1] <= 0 {
+		p.InitialLevel = base.InitialLevel
+	}
+	return p
+}
+
+// EnergyState is the persistent energy, odometer and engine-hour state of a vehicle
+type EnergyState struct {
+	Profile       EnergyProfile
+	Level         float64 // liters or kWh remaining
+	Odometer      float64 // km
+	EngineHours   float64 // hours with the engine on
+	DeviceBattery float64 // tracker battery (%) for fuel vehicles
+	charging      bool
+}
+
+// NewEnergyState creates an energy state with a random starting level, odometer and device battery
+func NewEnergyState(profile EnergyProfile, rng *rand.Rand, odometerRange, batteryRange [2]float64) *EnergyState {
+	levelPercent := profile.InitialLevel[0] + rng.Float64()*(profile.InitialLevel[1]-profile.InitialLevel[0])
+	return &EnergyState{
+		Profile:       profile,
+		Level:         profile.Capacity * levelPercent / 100,
+		Odometer:      odometerRange[0] + rng.Float64()*(odometerRange[1]-odometerRange[0]),
+		DeviceBattery: batteryRange[0] + rng.Float64()*(batteryRange[1]-batteryRange[0]),
+	}
+}
+
+// LevelPercent returns the remaining energy as a percentage of capacity
+func (e *EnergyState) LevelPercent() float64 {
+	if e.Profile.Capacity <= 0 {
+		return 0
+	}
+	return 100 * e.Level / e.Profile.Capacity
+}
+
+// Update accounts for dt seconds during which the vehicle covered distance meters
+// at the given speed (m/s). Moving vehicles consume energy depending on speed,
+// stopped vehicles with the engine on idle, and parked vehicles charge or refuel.
+func (e *EnergyState) Update(dt, distance, speed float64, parked bool) {
+	if dt <= 0 {
+		return
+	}
+	hours := dt / 3600
+
+	if parked {
+		if e.LevelPercent() < e.Profile.ChargeBelow {
+			e.charging = true
+		}
+		if e.charging {
+			e.Level = math.Min(e.Profile.Capacity, e.Level+e.Profile.ChargePerHour*hours)
+			if e.Level >= e.Profile.Capacity {
+				e.charging = false
+			}
+		}
+		return
+	}
+
+	e.charging = false
+	e.EngineHours += hours
+	e.Odometer += distance / 1000
+
+	// Consumption rises quadratically above 60 km/h with aerodynamic drag
+	kmh := speed * 3.6
+	drag := math.Max(0, (kmh-60)/60)
+	consumed := distance / 1000 * e.Profile.ConsumptionPerKm * (1 + e.Profile.SpeedFactor*drag*drag)
+	if speed < 0.5 {
+		consumed += e.Profile.IdlePerHour * hours
+	}
+	e.Level = math.Max(0, e.Level-consumed)
+}
+
+// Drain sets the traction battery, or the tracker battery of fuel vehicles, to the
+// given percentage
+func (e *EnergyState) Drain(percent float64) {
+	if e.Profile.Source == "battery" {
+		e.Level = e.Profile.Capacity * percent / 100
+		e.charging = false
+	} else {
+		e.DeviceBattery = percent
+	}
+}
+
+// Apply writes the energy state into a telemetry record
+func (e *EnergyState) Apply(t *Telemetry) {
+	t.Odometer = e.Odometer
+	t.EngineHours = e.EngineHours
+	if e.Profile.Source == "battery" {
+		t.Battery = e.LevelPercent()
+		t.Fuel = nil
+	} else {
+		fuel := e.LevelPercent()
+		t.Battery = e.DeviceBattery
+		t.Fuel = &fuel
+	}
+}
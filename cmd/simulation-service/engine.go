@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EngineConfig tunes the concurrent live-mode engine
+type EngineConfig struct {
+	Workers     int    `yaml:"workers"`      // shards stepped in parallel, default the number of CPUs
+	MaxInflight int    `yaml:"max_inflight"` // unacknowledged MQTT publishes, default 10000
+	Overflow    string `yaml:"overflow"`     // "block" (default) waits for a free slot, "drop" discards the message
+}
+
+// EngineStats counts how well the engine kept up with the tick rate and the broker
+type EngineStats struct {
+	Workers         int     `json:"workers"`
+	Ticks           int64   `json:"ticks"`
+	TicksOverrun    int64   `json:"ticks_overrun"` // ticks that took longer than the tick interval
+	TicksSkipped    int64   `json:"ticks_skipped"` // ticks not started because the previous one was still running
+	MaxTickMs       float64 `json:"max_tick_ms"`   // longest tick, wall-clock time
+	PeakInflight    int64   `json:"peak_inflight"` // most MQTT publishes awaiting acknowledgement at once
+	DroppedMessages int64   `json:"dropped_messages"`
+}
+
+// tickResult describes one finished tick
+type tickResult struct {
+	simulationTime time.Time
+	sent           int64
+	duration       time.Duration
+}
+
+// Engine steps the fleet on a fixed tick. Vehicles are split into shards that are
+// stepped on parallel goroutines, and telemetry is published asynchronously, so a
+// tick costs the CPU time of the fleet rather than one broker round trip per message.
+// A tick that is still running when the next one is due makes the engine skip that
+// tick; vehicles then cover the longer interval on the following one.
+type Engine struct {
+	config     *Config
+	clock      *VirtualClock
+	sink       *FanOutSink
+	report     *RunReport
+	inflight   *InflightLimiter
+	pool       *RoutePool // routes for reassignment, shared with vehicles added at runtime
+	routes     *RouteServiceClient
+	scenario   *ScenarioRunner // nil without a scenario
+	faults     *FaultLog       // nil without fault injection
+	departures *departurePlan  // nil without a departure schedule
+	interval   time.Duration   // simulation time between ticks
+	retick     chan struct{}   // the clock speed changed
+
+	// mu is held for a whole tick, so the control API sees vehicles between ticks
+	mu       sync.Mutex
+	vehicles []*VehicleSimulator // every vehicle, including removed ones
+	shards   [][]*VehicleSimulator
+	workers  int
+
+	stats EngineStats
+}
+
+// NewEngine splits the simulators into shards
+func NewEngine(config *Config, clock *VirtualClock, simulators []*VehicleSimulator, sink *FanOutSink,
+	report *RunReport, inflight *InflightLimiter) *Engine {
+	workers := config.Engine.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	workers = max(1, workers)
+	engine := &Engine{
+		config:   config,
+		clock:    clock,
+		sink:     sink,
+		report:   report,
+		inflight: inflight,
+		pool:     NewRoutePool(nil),
+		routes:   NewRouteServiceClient(config.RouteService),
+		interval: parseDuration(config.Simulation.UpdateInterval, 5*time.Second),
+		retick:   make(chan struct{}, 1),
+		vehicles: simulators,
+		workers:  workers,
+	}
+	if len(simulators) > 0 {
+		engine.pool = simulators[0].Pool
+	}
+	engine.reshard()
+	return engine
+}
+
+// reshard splits the vehicles still simulated into at most workers contiguous
+// shards, which keep each worker on its own part of the vehicle slice. The caller
+// holds mu.
+func (e *Engine) reshard() {
+	active := make([]*VehicleSimulator, 0, len(e.vehicles))
+	for _, vehicle := range e.vehicles {
+		if !vehicle.Removed {
+			active = append(active, vehicle)
+		}
+	}
+
+	e.shards = nil
+	if len(active) == 0 {
+		return
+	}
+	size := (len(active) + e.workers - 1) / e.workers
+	for start := 0; start < len(active); start += size {
+		e.shards = append(e.shards, active[start:min(start+size, len(active))])
+	}
+}
+
+// newInflightLimiter creates the limiter of asynchronous MQTT publishes
+func newInflightLimiter(cfg EngineConfig) *InflightLimiter {
+	maxInflight := cfg.MaxInflight
+	if maxInflight <= 0 {
+		maxInflight = 10000
+	}
+	if cfg.Overflow != "" && cfg.Overflow != "block" && cfg.Overflow != "drop" {
+		log.Printf("Warning: unknown engine overflow %q, using block", cfg.Overflow)
+	}
+	return NewInflightLimiter(maxInflight, cfg.Overflow == "drop")
+}
+
+// Run ticks until a signal arrives, then waits for the running tick to finish
+func (e *Engine) Run(signals <-chan os.Signal) {
+	wallInterval := e.clock.WallInterval(e.interval)
+	log.Printf("Starting simulation of %d vehicles on %d workers (speed: %.1fx, update interval: %s simulated / %s wall)",
+		len(e.Vehicles()), e.workers, e.clock.Speed(), e.interval, wallInterval)
+	ticker := time.NewTicker(wallInterval)
+	defer ticker.Stop()
+
+	var running chan tickResult // nil while no tick is running
+	for {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, shutting down", sig)
+			if running != nil {
+				e.finishTick(<-running, wallInterval)
+			}
+			return
+		case <-ticker.C:
+			if running != nil {
+				e.stats.TicksSkipped++
+				continue
+			}
+			running = make(chan tickResult, 1)
+			go func(done chan<- tickResult, simulationTime time.Time) {
+				done <- e.tick(simulationTime)
+			}(running, e.clock.Now())
+		case result := <-running:
+			running = nil
+			e.finishTick(result, wallInterval)
+		case <-e.retick:
+			wallInterval = e.clock.WallInterval(e.interval)
+			ticker.Reset(wallInterval)
+			log.Printf("Simulation speed is now %.1fx (update interval: %s wall)", e.clock.Speed(), wallInterval)
+		}
+	}
+}
+
+// tick applies the scenario actions that are due, then steps every shard on its own
+// goroutine and waits for all of them
+func (e *Engine) tick(simulationTime time.Time) tickResult {
+	start := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.scenario != nil {
+		e.scenario.Apply(e, simulationTime)
+	}
+	var sent atomic.Int64
+	var wg sync.WaitGroup
+	for _, shard := range e.shards {
+		wg.Add(1)
+		go func(shard []*VehicleSimulator) {
+			defer wg.Done()
+			count := 0
+			for _, simulator := range shard {
+				count += e.step(simulator, simulationTime)
+			}
+			sent.Add(int64(count))
+		}(shard)
+	}
+	wg.Wait()
+	return tickResult{simulationTime: simulationTime, sent: sent.Load(), duration: time.Since(start)}
+}
+
+// step advances one vehicle and hands its events and telemetry to the sinks. It
+// returns the number of telemetry records sent.
+func (e *Engine) step(simulator *VehicleSimulator, simulationTime time.Time) int {
+	telemetries := generateTelemetry(simulator, e.config, simulationTime)
+
+	// Send lifecycle events
+	for _, event := range simulator.TakeEvents() {
+		start := time.Now()
+		e.sink.SendEventAsync(simulator, &event, func(err error) {
+			e.published(simulator, start, "event", err)
+		})
+	}
+
+	// Send individual telemetry
+	for _, telemetry := range telemetries {
+		start := time.Now()
+		e.report.RecordTelemetry(simulator, &telemetry)
+		e.sink.SendTelemetryAsync(simulator, &telemetry, func(err error) {
+			e.published(simulator, start, "telemetry", err)
+		})
+	}
+	return len(telemetries)
+}
+
+// published records the outcome of a send. Dropped messages are not logged one by
+// one; the tick log and the run report count them.
+func (e *Engine) published(simulator *VehicleSimulator, start time.Time, kind string, err error) {
+	e.report.RecordPublish(simulator, time.Since(start), err)
+	if err != nil && !errors.Is(err, errPublishDropped) {
+		log.Printf("Failed to send %s: %v", kind, err)
+	}
+}
+
+// finishTick updates the counters and logs the tick
+func (e *Engine) finishTick(result tickResult, wallInterval time.Duration) {
+	e.stats.Ticks++
+	if result.duration > wallInterval {
+		e.stats.TicksOverrun++
+	}
+	e.stats.MaxTickMs = max(e.stats.MaxTickMs, float64(result.duration)/float64(time.Millisecond))
+
+	log.Printf("Sent %d telemetry updates at %s in %s (%d publishes in flight, %d dropped, %d ticks overrun, %d skipped)",
+		result.sent, result.simulationTime.Format("15:04:05"), result.duration.Round(time.Millisecond),
+		e.inflight.Inflight(), e.inflight.Dropped(), e.stats.TicksOverrun, e.stats.TicksSkipped)
+}
+
+// Vehicles returns every vehicle of the run, including removed ones
+func (e *Engine) Vehicles() []*VehicleSimulator {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*VehicleSimulator(nil), e.vehicles...)
+}
+
+// Stats returns the engine counters
+func (e *Engine) Stats() EngineStats {
+	stats := e.stats
+	stats.Workers = e.workers
+	stats.PeakInflight = e.inflight.Peak()
+	stats.DroppedMessages = e.inflight.Dropped()
+	return stats
+}
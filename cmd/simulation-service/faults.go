@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault kinds
+const (
+	FaultDuplicate  = "duplicate"        // the record is sent twice
+	FaultOutOfOrder = "out_of_order"     // the record is held back and sent after the next one
+	FaultFuture     = "future_timestamp" // timestamp 10 minutes to 2 days ahead
+	FaultStale      = "stale_timestamp"  // timestamp 1 hour to 7 days behind
+	FaultTeleport   = "teleport"         // position jumps 50-500 km for one record
+	FaultSpeed      = "impossible_speed" // 500-1500 km/h
+	FaultNaN        = "nan"              // one numeric field is NaN
+	FaultNull       = "null"             // one field is null, or missing in binary encodings
+	FaultTruncated  = "truncated"        // the encoded payload is cut short
+	FaultSwapped    = "swapped_latlon"
+	FaultZeroIsland = "zero_island" // a (0, 0) fix
+)
+
+// faultKinds is the order in which faults are drawn, which keeps runs reproducible
+var faultKinds = []string{
+	FaultFuture, FaultStale, FaultTeleport, FaultSpeed, FaultSwapped, FaultZeroIsland,
+	FaultNaN, FaultNull, FaultTruncated, FaultDuplicate, FaultOutOfOrder,
+}
+
+// faultFields are the telemetry fields the nan and null faults pick from
+var faultFields = []string{"lat", "lon", "spd", "hdg", "alt", "acc", "battery", "signal"}
+
+// FaultConfig configures fault injection. Rates are probabilities per telemetry record.
+type FaultConfig struct {
+	Rates    map[string]float64         `yaml:"rates"`    // every vehicle
+	Vehicles map[int]map[string]float64 `yaml:"vehicles"` // per vehicle, replacing the rates they name
+	Log      string                     `yaml:"log"`      // ground truth, default faults.jsonl
+}
+
+// Enabled reports whether any fault has a rate
+func (c FaultConfig) Enabled() bool {
+	return len(c.Rates) > 0 || len(c.Vehicles) > 0
+}
+
+// payloadFaultKinds are the faults applied when a record is encoded
+var payloadFaultKinds = []string{FaultNaN, FaultNull, FaultTruncated}
+
+// payloadFaultOutputs lists the payload faults each output applies. NMEA sentences and
+// tracker packets are encoded from the values alone, and a truncated feature would
+// break the whole GeoJSON collection.
+var payloadFaultOutputs = map[string][]string{
+	"mqtt":    payloadFaultKinds,
+	"http":    payloadFaultKinds,
+	"tcp":     payloadFaultKinds,
+	"udp":     payloadFaultKinds,
+	"stdout":  payloadFaultKinds,
+	"jsonl":   payloadFaultKinds,
+	"csv":     payloadFaultKinds,
+	"geojson": {FaultNaN, FaultNull},
+}
+
+// forOutputs returns the configuration without the payload faults that one of the
+// outputs would not apply, so the ground truth only lists faults that were sent
+func (c FaultConfig) forOutputs(outputs []string) FaultConfig {
+	drop := make(map[string]bool)
+	for _, kind := range payloadFaultKinds {
+		for _, output := range outputs {
+			if !slices.Contains(payloadFaultOutputs[output], kind) && !drop[kind] {
+				drop[kind] = true
+				log.Printf("Warning: %s faults are not injected because the %s output does not apply them", kind, output)
+			}
+		}
+	}
+	if len(drop) == 0 {
+		return c
+	}
+
+	without := func(rates map[string]float64) map[string]float64 {
+		kept := make(map[string]float64, len(rates))
+		for kind, rate := range rates {
+			if !drop[kind] {
+				kept[kind] = rate
+			}
+		}
+		return kept
+	}
+	c.Rates = without(c.Rates)
+	vehicles := make(map[int]map[string]float64, len(c.Vehicles))
+	for id, rates := range c.Vehicles {
+		vehicles[id] = without(rates)
+	}
+	c.Vehicles = vehicles
+	return c
+}
+
+// validate checks the fault kinds and rates
+func (c FaultConfig) validate() error {
+	check := func(rates map[string]float64) error {
+		for kind, rate := range rates {
+			known := false
+			for _, k := range faultKinds {
+				known = known || k == kind
+			}
+			if !known {
+				return fmt.Errorf("unknown fault %q: must be one of %s", kind, strings.Join(faultKinds, ", "))
+			}
+			if rate < 0 || rate > 1 {
+				return fmt.Errorf("fault %s rate %g must be between 0 and 1", kind, rate)
+			}
+		}
+		return nil
+	}
+	if err := check(c.Rates); err != nil {
+		return err
+	}
+	for id, rates := range c.Vehicles {
+		if err := check(rates); err != nil {
+			return fmt.Errorf("vehicle %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// payloadFault corrupts a record when it is encoded, because a Telemetry value cannot
+// hold a null or a truncated document. A record can have a field fault and be
+// truncated as well.
+type payloadFault struct {
+	kind  string  // nan or null; empty without a field fault
+	field string  // the field set to NaN or null
+	cut   float64 // fraction of the payload kept when truncated, otherwise 0
+}
+
+// applyFields sets the field to NaN or drops it in the binary encodings
+func (f *payloadFault) applyFields(fields []payloadField) []payloadField {
+	if f.field == "" {
+		return fields
+	}
+	out := fields[:0:0]
+	for _, field := range fields {
+		if field.key == f.field {
+			if f.kind == FaultNull {
+				continue
+			}
+			if f.kind == FaultNaN {
+				field.value = math.NaN()
+			}
+		}
+		out = append(out, field)
+	}
+	return out
+}
+
+// faultFieldPatterns match each fault field and its value in JSON text
+var faultFieldPatterns = func() map[string]*regexp.Regexp {
+	patterns := make(map[string]*regexp.Regexp, len(faultFields))
+	for _, field := range faultFields {
+		patterns[field] = regexp.MustCompile(`"` + field + `":[^,}]*`)
+	}
+	return patterns
+}()
+
+// applyJSON writes NaN or null over the field's value. NaN is not valid JSON, but
+// encoders in several languages produce it.
+func (f *payloadFault) applyJSON(data []byte) []byte {
+	value := "null"
+	if f.kind == FaultNaN {
+		value = "NaN"
+	}
+	return faultFieldPatterns[f.field].ReplaceAll(data, []byte(`"`+f.field+`":`+value))
+}
+
+// applyCSV writes NaN into the field's column, or leaves it empty for null
+func (f *payloadFault) applyCSV(row []string) []string {
+	for i, column := range csvHeader {
+		if column == f.field {
+			row[i] = ""
+			if f.kind == FaultNaN {
+				row[i] = "NaN"
+			}
+		}
+	}
+	return row
+}
+
+// truncate cuts an encoded payload short, keeping at least one byte
+func (f *payloadFault) truncate(data []byte) []byte {
+	n := int(float64(len(data)) * f.cut)
+	return data[:max(1, min(n, len(data)-1))]
+}
+
+// FaultRecord is one ground-truth entry. Vehicle ID and timestamp identify the
+// faulty record as it was sent.
+type FaultRecord struct {
+	Time      time.Time `json:"time"` // simulation time of the injection
+	VehicleID int       `json:"vehicle_id"`
+	Timestamp int64     `json:"timestamp"`
+	Fault     string    `json:"fault"`
+	Field     string    `json:"field,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// FaultLog is the ground-truth log of injected faults, one JSON line per fault
+type FaultLog struct {
+	path   string
+	config FaultConfig // the rates of the run, without faults the outputs do not apply
+	mu     sync.Mutex  // vehicles are stepped in parallel
+	file   *os.File
+	writer *bufio.Writer
+	counts map[string]int
+}
+
+// NewFaultLog validates the configuration and creates the ground-truth log
+func NewFaultLog(cfg FaultConfig) (*FaultLog, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	path := cfg.Log
+	if path == "" {
+		path = "faults.jsonl"
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fault log: %w", err)
+	}
+	return &FaultLog{path: path, config: cfg, file: file, writer: bufio.NewWriter(file), counts: make(map[string]int)}, nil
+}
+
+// NewInjector creates the injector of a vehicle with the run's fault rates, or nil
+// when the vehicle has none or fault injection is off
+func (l *FaultLog) NewInjector(vehicleID int, seed int64) *FaultInjector {
+	if l == nil {
+		return nil
+	}
+	return NewFaultInjector(l.config, vehicleID, seed, l)
+}
+
+// Record writes a ground-truth entry
+func (l *FaultLog) Record(record FaultRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to marshal fault record: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts[record.Fault]++
+	if _, err := l.writer.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write fault log: %v", err)
+	}
+}
+
+// Counts returns the number of injected faults by kind
+func (l *FaultLog) Counts() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := make(map[string]int, len(l.counts))
+	for kind, n := range l.counts {
+		counts[kind] = n
+	}
+	return counts
+}
+
+// Close flushes the log and prints a summary
+func (l *FaultLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := 0
+	kinds := make([]string, 0, len(l.counts))
+	for kind, n := range l.counts {
+		total += n
+		kinds = append(kinds, fmt.Sprintf("%s %d", kind, n))
+	}
+	sort.Strings(kinds)
+	log.Printf("Injected %d faults (%s), ground truth in %s", total, strings.Join(kinds, ", "), l.path)
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return fmt.Errorf("failed to write fault log: %w", err)
+	}
+	return l.file.Close()
+}
+
+// FaultInjector corrupts the telemetry of one vehicle after it has been validated,
+// so validators downstream see realistic bad data
+type FaultInjector struct {
+	VehicleID int
+	rates     map[string]float64
+	rng       *rand.Rand // separate from the vehicle's, so clean values do not change
+	log       *FaultLog
+	held      *Telemetry    // record held back by out_of_order
+	heldLog   []FaultRecord // its faults, logged once it is sent
+}
+
+// NewFaultInjector creates the injector of a vehicle, or nil if it has no fault rates
+func NewFaultInjector(cfg FaultConfig, vehicleID int, seed int64, faults *FaultLog) *FaultInjector {
+	rates := make(map[string]float64)
+	for kind, rate := range cfg.Rates {
+		rates[kind] = rate
+	}
+	for kind, rate := range cfg.Vehicles[vehicleID] {
+		rates[kind] = rate
+	}
+	for kind, rate := range rates {
+		if rate <= 0 {
+			delete(rates, kind)
+		}
+	}
+	if len(rates) == 0 || faults == nil {
+		return nil
+	}
+	return &FaultInjector{
+		VehicleID: vehicleID,
+		rates:     rates,
+		rng:       rand.New(rand.NewSource(vehicleSeed(seed, vehicleID) ^ 0x5eedfa17)),
+		log:       faults,
+	}
+}
+
+// Apply injects faults into the records a vehicle is about to send and returns the
+// records to send instead. Faults are logged as their records are returned, so a
+// record still held back by out_of_order when the vehicle stops is not in the log.
+func (f *FaultInjector) Apply(records []Telemetry, now time.Time) []Telemetry {
+	out := make([]Telemetry, 0, len(records)+1)
+	for _, record := range records {
+		t := record
+		var faults []FaultRecord
+		duplicate, hold := false, false
+		for _, kind := range faultKinds {
+			if f.rng.Float64() >= f.rates[kind] {
+				continue
+			}
+			switch kind {
+			case FaultDuplicate:
+				duplicate = true
+				faults = append(faults, f.newRecord(now, kind, "", "sent twice"))
+			case FaultOutOfOrder:
+				// One record is held back at a time
+				if f.held == nil {
+					hold = true
+					faults = append(faults, f.newRecord(now, kind, "", "sent after the next record"))
+				}
+			default:
+				if fault, ok := f.inject(now, &t, kind); ok {
+					faults = append(faults, fault)
+				}
+			}
+		}
+
+		if duplicate {
+			out = append(out, t)
+		}
+		if hold {
+			f.held, f.heldLog = &t, faults
+			continue
+		}
+		out = append(out, t)
+		f.record(&t, faults)
+		if f.held != nil {
+			out = append(out, *f.held)
+			f.record(f.held, f.heldLog)
+			f.held, f.heldLog = nil, nil
+		}
+	}
+	return out
+}
+
+// inject applies a fault that changes the record itself. It reports false when the
+// record already has a field fault, which a later nan or null would overwrite.
+func (f *FaultInjector) inject(now time.Time, t *Telemetry, kind string) (FaultRecord, bool) {
+	field, detail := "", ""
+	switch kind {
+	case FaultFuture:
+		shift := 10*time.Minute + time.Duration(f.rng.Int63n(int64(48*time.Hour-10*time.Minute)))
+		t.Timestamp += int64(shift / time.Second)
+		detail = fmt.Sprintf("timestamp +%s", shift.Round(time.Second))
+	case FaultStale:
+		shift := time.Hour + time.Duration(f.rng.Int63n(int64(7*24*time.Hour-time.Hour)))
+		t.Timestamp -= int64(shift / time.Second)
+		detail = fmt.Sprintf("timestamp -%s", shift.Round(time.Second))
+	case FaultTeleport:
+		distance := 50000 + f.rng.Float64()*450000
+		bearing := f.rng.Float64() * 2 * math.Pi
+		lat, lon := t.Lat, t.Lon
+		t.Lat = math.Max(-89.9, math.Min(89.9, lat+distance*math.Cos(bearing)/111320))
+		t.Lon = lon + distance*math.Sin(bearing)/(111320*math.Cos(lat*math.Pi/180))
+		t.Lon = math.Mod(t.Lon+540, 360) - 180
+		detail = fmt.Sprintf("jumped %.0f km from %.5f,%.5f", distance/1000, lat, lon)
+	case FaultSpeed:
+		speed := t.Speed
+		t.Speed = 500 + f.rng.Float64()*1000
+		detail = fmt.Sprintf("spd %.0f instead of %.1f km/h", t.Speed, speed)
+	case FaultSwapped:
+		t.Lat, t.Lon = t.Lon, t.Lat
+	case FaultZeroIsland:
+		detail = fmt.Sprintf("true position %.5f,%.5f", t.Lat, t.Lon)
+		t.Lat, t.Lon = 0, 0
+	case FaultNaN, FaultNull:
+		if t.fault != nil && t.fault.field != "" {
+			return FaultRecord{}, false
+		}
+		field = faultFields[f.rng.Intn(len(faultFields))]
+		t.fault = t.payloadFault()
+		t.fault.kind, t.fault.field = kind, field
+	case FaultTruncated:
+		cut := 0.2 + f.rng.Float64()*0.7
+		t.fault = t.payloadFault()
+		t.fault.cut = cut
+		detail = fmt.Sprintf("%.0f%% of the payload kept", cut*100)
+	}
+	return f.newRecord(now, kind, field, detail), true
+}
+
+// payloadFault returns the record's payload fault, adding one if it has none
+func (t *Telemetry) payloadFault() *payloadFault {
+	if t.fault == nil {
+		t.fault = &payloadFault{}
+	}
+	return t.fault
+}
+
+// newRecord creates the ground truth of a fault
+func (f *FaultInjector) newRecord(now time.Time, kind, field, detail string) FaultRecord {
+	return FaultRecord{Time: now, VehicleID: f.VehicleID, Fault: kind, Field: field, Detail: detail}
+}
+
+// record logs the faults of a record as it is sent
+func (f *FaultInjector) record(t *Telemetry, faults []FaultRecord) {
+	for _, fault := range faults {
+		fault.Timestamp = t.Timestamp
+		f.log.Record(fault)
+	}
+}
+
+// faultyRecords returns the telemetry of a message that carries payload faults
+func faultyRecords(message payloadMessage) []*Telemetry {
+	var faulty []*Telemetry
+	switch m := message.(type) {
+	case *Telemetry:
+		if m.fault != nil {
+			faulty = append(faulty, m)
+		}
+	case *BatchTelemetry:
+		for i := range m.Vehicles {
+			if m.Vehicles[i].fault != nil {
+				faulty = append(faulty, &m.Vehicles[i])
+			}
+		}
+	}
+	return faulty
+}
+
+// marshalFault encodes a telemetry record or a batch holding records with payload
+// faults. The binary encodings apply field faults through payloadFields; in JSON the
+// text of each faulty record is patched. A truncated record cuts the whole payload
+// short, so in a batch the records after the cut are lost with it.
+func (e PayloadEncoding) marshalFault(message payloadMessage, faulty []*Telemetry) ([]byte, error) {
+	data, err := e.marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	var truncated *payloadFault
+	for _, t := range faulty {
+		switch e {
+		case EncodingProtobuf, EncodingCBOR, EncodingMsgPack:
+		default:
+			if t.fault.field != "" {
+				// A record encodes to the same text alone and in a batch
+				clean, err := json.Marshal(t)
+				if err != nil {
+					return nil, err
+				}
+				data = bytes.Replace(data, clean, t.fault.applyJSON(clean), 1)
+			}
+		}
+		if t.fault.cut > 0 && (truncated == nil || t.fault.cut < truncated.cut) {
+			truncated = t.fault
+		}
+	}
+	if truncated != nil {
+		data = truncated.truncate(data)
+	}
+	return data, nil
+}
+
+// setupFaults creates the ground-truth log and an injector for every vehicle with
+// fault rates, leaving out payload faults the outputs do not apply. It returns nil
+// when fault injection is off.
+func setupFaults(config *Config, simulators []*VehicleSimulator, outputs []string) (*FaultLog, error) {
+	cfg := config.Simulation.Faults
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	faults, err := NewFaultLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+	faults.config = cfg.forOutputs(outputs)
+	injected := 0
+	for _, simulator := range simulators {
+		simulator.Faults = faults.NewInjector(simulator.VehicleID, config.Simulation.RandomSeed)
+		if simulator.Faults != nil {
+			injected++
+		}
+	}
+	log.Printf("Injecting faults into %d of %d vehicles, ground truth in %s", injected, len(simulators), faults.path)
+	return faults, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFaultInjector(t *testing.T) {
+	now := time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		rates      map[string]float64
+		timestamps []int64 // timestamps sent, as offsets from now; nil to skip the check
+		counts     map[string]int
+		check      func(t Telemetry) bool
+	}{
+		{"duplicate", map[string]float64{FaultDuplicate: 1},
+			[]int64{1, 1, 2, 2, 3, 3, 4, 4, 5, 5}, map[string]int{FaultDuplicate: 5}, nil},
+		// The fifth record is still held back, so its fault is not in the log
+		{"out of order", map[string]float64{FaultOutOfOrder: 1},
+			[]int64{2, 1, 4, 3}, map[string]int{FaultOutOfOrder: 2}, nil},
+		{"future timestamp", map[string]float64{FaultFuture: 1}, nil, map[string]int{FaultFuture: 5},
+			func(t Telemetry) bool { return t.Timestamp >= now.Unix()+600 && t.Timestamp <= now.Unix()+5+48*3600 }},
+		{"zero island", map[string]float64{FaultZeroIsland: 1}, nil, map[string]int{FaultZeroIsland: 5},
+			func(t Telemetry) bool { return t.Lat == 0 && t.Lon == 0 }},
+		// A record keeps its first field fault
+		{"nan before null", map[string]float64{FaultNaN: 1, FaultNull: 1}, nil, map[string]int{FaultNaN: 5},
+			func(t Telemetry) bool { return t.fault != nil && t.fault.kind == FaultNaN && t.fault.cut == 0 }},
+		{"null and truncated", map[string]float64{FaultNull: 1, FaultTruncated: 1}, nil,
+			map[string]int{FaultNull: 5, FaultTruncated: 5},
+			func(t Telemetry) bool {
+				return t.fault != nil && t.fault.kind == FaultNull && t.fault.cut >= 0.2 && t.fault.cut < 0.9
+			}},
+		{"never", map[string]float64{FaultTeleport: 0.0001}, []int64{1, 2, 3, 4, 5}, map[string]int{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "faults.jsonl")
+			faults, err := NewFaultLog(FaultConfig{Rates: tt.rates, Log: path})
+			if err != nil {
+				t.Fatalf("NewFaultLog: %v", err)
+			}
+			injector := faults.NewInjector(3, 42)
+
+			var records []Telemetry
+			for i := int64(1); i <= 5; i++ {
+				records = append(records, Telemetry{VehicleID: 3, Timestamp: now.Unix() + i, Lat: 35.7219, Lon: 51.3347, Speed: 40})
+			}
+			sent := injector.Apply(records, now)
+
+			if tt.timestamps != nil {
+				var got []int64
+				for _, record := range sent {
+					got = append(got, record.Timestamp-now.Unix())
+				}
+				if !slices.Equal(got, tt.timestamps) {
+					t.Errorf("sent timestamps %v, want %v", got, tt.timestamps)
+				}
+			}
+			for _, record := range sent {
+				if tt.check != nil && !tt.check(record) {
+					t.Errorf("record not faulted as expected: %+v", record)
+				}
+			}
+			if counts := faults.Counts(); !maps.Equal(counts, tt.counts) {
+				t.Errorf("counts %v, want %v", counts, tt.counts)
+			}
+
+			// Every logged fault names a record that was sent
+			if err := faults.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			lines := 0
+			for scanner := bufio.NewScanner(file); scanner.Scan(); lines++ {
+				var fault FaultRecord
+				if err := json.Unmarshal(scanner.Bytes(), &fault); err != nil {
+					t.Fatalf("fault log line %d: %v", lines+1, err)
+				}
+				found := false
+				for _, record := range sent {
+					found = found || record.Timestamp == fault.Timestamp
+				}
+				if fault.VehicleID != 3 || !found {
+					t.Errorf("logged fault %+v matches no sent record", fault)
+				}
+			}
+			total := 0
+			for _, n := range tt.counts {
+				total += n
+			}
+			if lines != total {
+				t.Errorf("fault log has %d lines, want %d", lines, total)
+			}
+		})
+	}
+}
+
+func TestNewFaultInjector(t *testing.T) {
+	faults := &FaultLog{}
+	tests := []struct {
+		name  string
+		cfg   FaultConfig
+		rates map[string]float64 // nil for no injector
+	}{
+		{"no rates", FaultConfig{}, nil},
+		{"zero rate", FaultConfig{Rates: map[string]float64{FaultNaN: 0}}, nil},
+		{"fleet rates", FaultConfig{Rates: map[string]float64{FaultNaN: 0.1}}, map[string]float64{FaultNaN: 0.1}},
+		{"vehicle replaces fleet rate",
+			FaultConfig{Rates: map[string]float64{FaultNaN: 0.1, FaultNull: 0.2}, Vehicles: map[int]map[string]float64{3: {FaultNaN: 0.5}}},
+			map[string]float64{FaultNaN: 0.5, FaultNull: 0.2}},
+		{"vehicle opts out",
+			FaultConfig{Rates: map[string]float64{FaultNaN: 0.1}, Vehicles: map[int]map[string]float64{3: {FaultNaN: 0}}}, nil},
+		{"other vehicle",
+			FaultConfig{Vehicles: map[int]map[string]float64{4: {FaultNaN: 0.5}}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			injector := NewFaultInjector(tt.cfg, 3, 42, faults)
+			if tt.rates == nil {
+				if injector != nil {
+					t.Errorf("injector created with rates %v", injector.rates)
+				}
+				return
+			}
+			if injector == nil || !maps.Equal(injector.rates, tt.rates) {
+				t.Errorf("injector %+v, want rates %v", injector, tt.rates)
+			}
+		})
+	}
+}
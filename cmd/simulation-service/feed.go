@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	feedBuffer       = 1024             // messages queued per client before updates are dropped
+	feedWriteTimeout = 10 * time.Second // a client that cannot take a write for this long is dropped
+	feedPingInterval = 30 * time.Second
+)
+
+// FeedFilter selects the telemetry a feed client receives. Empty fields match everything.
+type FeedFilter struct {
+	Vehicles []int     `json:"vehicles,omitempty"`
+	BBox     []float64 `json:"bbox,omitempty"` // min lon, min lat, max lon, max lat
+}
+
+// parseFeedFilter reads the vehicles and bbox query parameters, e.g.
+// ?vehicles=1,2,3&bbox=51.3,35.6,51.5,35.8
+func parseFeedFilter(query map[string][]string) (FeedFilter, error) {
+	var filter FeedFilter
+	if value := firstValue(query, "vehicles"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return filter, fmt.Errorf("invalid vehicle ID %q", field)
+			}
+			filter.Vehicles = append(filter.Vehicles, id)
+		}
+	}
+	if value := firstValue(query, "bbox"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			coordinate, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid bbox coordinate %q", field)
+			}
+			filter.BBox = append(filter.BBox, coordinate)
+		}
+	}
+	return filter, filter.validate()
+}
+
+// firstValue returns the first value of a query parameter
+func firstValue(query map[string][]string, key string) string {
+	if values := query[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// validate checks the bounding box
+func (f FeedFilter) validate() error {
+	if len(f.BBox) != 0 && len(f.BBox) != 4 {
+		return fmt.Errorf("bbox needs 4 coordinates: min lon, min lat, max lon, max lat")
+	}
+	return nil
+}
+
+// matches reports whether the filter selects the telemetry
+func (f FeedFilter) matches(t *Telemetry) bool {
+	if len(f.Vehicles) > 0 {
+		found := false
+		for _, id := range f.Vehicles {
+			if id == t.VehicleID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.BBox) == 4 {
+		return t.Lon >= f.BBox[0] && t.Lat >= f.BBox[1] && t.Lon <= f.BBox[2] && t.Lat <= f.BBox[3]
+	}
+	return true
+}
+
+// feedClient is one WebSocket connection of the position feed
+type feedClient struct {
+	conn    *websocket.Conn
+	send    chan []byte
+	mu      sync.Mutex // guards filter
+	filter  FeedFilter
+	dropped int // updates not delivered because the client fell behind
+}
+
+// PositionFeed is a sink that streams every telemetry update as JSON to WebSocket
+// clients. Slow clients lose updates instead of slowing the simulation down.
+type PositionFeed struct {
+	upgrader websocket.Upgrader
+	mu       sync.Mutex
+	clients  map[*feedClient]struct{}
+}
+
+// NewPositionFeed creates a feed without clients
+func NewPositionFeed() *PositionFeed {
+	return &PositionFeed{
+		// The feed is read-only, so any origin may subscribe
+		upgrader: websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+		clients:  make(map[*feedClient]struct{}),
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket and streams telemetry until the client
+// disconnects. Clients can replace their filter by sending it as a JSON message.
+func (f *PositionFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFeedFilter(r.URL.Query())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	conn, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has responded
+	}
+
+	client := &feedClient{conn: conn, send: make(chan []byte, feedBuffer), filter: filter}
+	f.mu.Lock()
+	f.clients[client] = struct{}{}
+	f.mu.Unlock()
+	log.Printf("Feed client %s connected", conn.RemoteAddr())
+
+	go f.write(client)
+	f.read(client)
+}
+
+// read applies filter updates until the connection closes, then removes the client
+func (f *PositionFeed) read(client *feedClient) {
+	defer f.remove(client)
+	client.conn.SetReadLimit(64 * 1024)
+	for {
+		_, message, err := client.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var filter FeedFilter
+		if err := json.Unmarshal(message, &filter); err != nil || filter.validate() != nil {
+			continue // keep the previous filter
+		}
+		client.mu.Lock()
+		client.filter = filter
+		client.mu.Unlock()
+	}
+}
+
+// write sends queued updates and keep-alive pings until the send channel is closed
+func (f *PositionFeed) write(client *feedClient) {
+	ping := time.NewTicker(feedPingInterval)
+	defer ping.Stop()
+	defer client.conn.Close()
+	for {
+		select {
+		case message, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+			if !ok {
+				client.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "simulation stopped"))
+				return
+			}
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ping.C:
+			client.conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// remove unregisters a client and stops its writer
+func (f *PositionFeed) remove(client *feedClient) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.clients[client]; !ok {
+		return
+	}
+	delete(f.clients, client)
+	close(client.send)
+	log.Printf("Feed client %s disconnected (%d updates dropped)", client.conn.RemoteAddr(), client.dropped)
+}
+
+// SendTelemetry queues the telemetry for every client whose filter matches
+func (f *PositionFeed) SendTelemetry(v *VehicleSimulator, telemetry *Telemetry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.clients) == 0 {
+		return nil
+	}
+
+	var data []byte
+	for client := range f.clients {
+		client.mu.Lock()
+		matches := client.filter.matches(telemetry)
+		client.mu.Unlock()
+		if !matches {
+			continue
+		}
+		if data == nil {
+			var err error
+			if data, err = json.Marshal(telemetry); err != nil {
+				return fmt.Errorf("failed to marshal telemetry: %w", err)
+			}
+		}
+		select {
+		case client.send <- data:
+		default:
+			client.dropped++
+		}
+	}
+	return nil
+}
+
+// SendEvent ignores lifecycle events; the feed carries positions only
+func (f *PositionFeed) SendEvent(v *VehicleSimulator, event *VehicleEvent) error {
+	return nil
+}
+
+// Close disconnects every client
+func (f *PositionFeed) Close() error {
+	f.mu.Lock()
+	clients := make([]*feedClient, 0, len(f.clients))
+	for client := range f.clients {
+		clients = append(clients, client)
+	}
+	f.mu.Unlock()
+	for _, client := range clients {
+		f.remove(client)
+	}
+	return nil
+}
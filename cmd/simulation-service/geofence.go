@@ -0,0 +1,35 @@
+package main
+
+// Area is a named region given either as a polygon of [lat, lon] points or as a
+// circle around a center point
+type Area struct {
+	Name    string       `yaml:"name"`
+	Polygon [][2]float64 `yaml:"polygon"` // [lat, lon] vertices
+	Center  [2]float64   `yaml:"center"`  // [lat, lon]
+	Radius  float64      `yaml:"radius"`  // meters
+}
+
+// Contains reports whether the point lies inside the area
+func (a *Area) Contains(lat, lon float64) bool {
+	if len(a.Polygon) >= 3 {
+		return pointInPolygon(lat, lon, a.Polygon)
+	}
+	if a.Radius > 0 {
+		return calculateDistance(lat, lon, a.Center[0], a.Center[1]) <= a.Radius
+	}
+	return false
+}
+
+// pointInPolygon uses ray casting to test whether a point lies inside a polygon
+func pointInPolygon(lat, lon float64, polygon [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		latI, lonI := polygon[i][0], polygon[i][1]
+		latJ, lonJ := polygon[j][0], polygon[j][1]
+		if (lonI > lon) != (lonJ > lon) &&
+			lat < (latJ-latI)*(lon-lonI)/(lonJ-lonI)+latI {
+			inside = !inside
+		}
+	}
+	return inside
+}
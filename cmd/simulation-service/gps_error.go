@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// metersPerDegree is the length of one degree of latitude
+const metersPerDegree = 111320.0
+
+// GPSConfig selects and tunes the GPS error model
+type GPSConfig struct {
+	Model                string        `yaml:"model"`                 // "none" (default) or "realistic"
+	NoiseSigma           float64       `yaml:"noise_sigma"`           // white noise per axis, meters
+	DriftSigma           float64       `yaml:"drift_sigma"`           // steady-state drift per axis, meters
+	DriftTimeConstant    string        `yaml:"drift_time_constant"`   // correlation time of the drift
+	MultipathProbability float64       `yaml:"multipath_probability"` // chance of a multipath jump per fix
+	MultipathMagnitude   float64       `yaml:"multipath_magnitude"`   // typical multipath jump, meters
+	MinAccuracy          float64       `yaml:"min_accuracy"`          // floor for the reported accuracy, meters
+	UrbanCanyons         []UrbanCanyon `yaml:"urban_canyons"`
+}
+
+// UrbanCanyon is an area where fixes degrade, e.g. between tall buildings
+type UrbanCanyon struct {
+	Area        `yaml:",inline"`
+	Degradation float64 `yaml:"degradation"` // multiplier for noise, drift and multipath probability
+}
+
+// GPSErrorModel turns a vehicle's true position into a reported GPS fix
+type GPSErrorModel interface {
+	// Apply perturbs the position in t and sets t.Accuracy to match the injected error
+	Apply(t *Telemetry)
+}
+
+// NewGPSErrorModel creates a per-vehicle GPS error model; it returns nil for "none",
+// which keeps exact positions and accuracy_range values
+func NewGPSErrorModel(cfg GPSConfig, rng *rand.Rand) (GPSErrorModel, error) {
+	switch cfg.Model {
+	case "", "none":
+		return nil, nil
+	case "realistic":
+		return newRealisticGPS(cfg, rng), nil
+	default:
+		return nil, fmt.Errorf("unknown GPS error model: %s", cfg.Model)
+	}
+}
+
+// realisticGPS combines white noise, first-order Gauss-Markov drift, occasional
+// multipath jumps and degraded fixes inside urban canyons
+type realisticGPS struct {
+	cfg           GPSConfig
+	rng           *rand.Rand
+	tau           float64    // drift correlation time in seconds
+	drift         [2]float64 // current drift, meters north/east
+	lastTimestamp int64
+}
+
+func newRealisticGPS(cfg GPSConfig, rng *rand.Rand) *realisticGPS {
+	if cfg.NoiseSigma <= 0 {
+		cfg.NoiseSigma = 3.0
+	}
+	if cfg.DriftSigma <= 0 {
+		cfg.DriftSigma = 2.0
+	}
+	if cfg.MultipathMagnitude <= 0 {
+		cfg.MultipathMagnitude = 25.0
+	}
+	if cfg.MinAccuracy <= 0 {
+		cfg.MinAccuracy = 2.0
+	}
+	return &realisticGPS{
+		cfg: cfg,
+		rng: rng,
+		tau: parseDuration(cfg.DriftTimeConstant, 60*time.Second).Seconds(),
+	}
+}
+
+// degradation returns the error multiplier at a position
+func (g *realisticGPS) degradation(lat, lon float64) float64 {
+	factor := 1.0
+	for i := range g.cfg.UrbanCanyons {
+		canyon := &g.cfg.UrbanCanyons[i]
+		if canyon.Degradation > factor && canyon.Contains(lat, lon) {
+			factor = canyon.Degradation
+		}
+	}
+	return factor
+}
+
+// Apply perturbs the position in t and reports the resulting horizontal error as accuracy
+func (g *realisticGPS) Apply(t *Telemetry) {
+	factor := g.degradation(t.Lat, t.Lon)
+
+	// Advance the correlated drift by the time since the previous fix
+	dt := 1.0
+	if g.lastTimestamp != 0 {
+		dt = math.Max(0, float64(t.Timestamp-g.lastTimestamp))
+	}
+	g.lastTimestamp = t.Timestamp
+	decay := math.Exp(-dt / g.tau)
+	driftSigma := g.cfg.DriftSigma * factor
+	innovation := driftSigma * math.Sqrt(1-decay*decay)
+	for axis := range g.drift {
+		g.drift[axis] = g.drift[axis]*decay + innovation*g.rng.NormFloat64()
+	}
+
+	noiseSigma := g.cfg.NoiseSigma * factor
+	north := g.drift[0] + noiseSigma*g.rng.NormFloat64()
+	east := g.drift[1] + noiseSigma*g.rng.NormFloat64()
+
+	// Multipath: a reflected signal pulls the fix away for a single epoch
+	if g.rng.Float64() < math.Min(1, g.cfg.MultipathProbability*factor) {
+		magnitude := g.cfg.MultipathMagnitude * (0.5 + g.rng.ExpFloat64())
+		bearing := g.rng.Float64() * 2 * math.Pi
+		north += magnitude * math.Cos(bearing)
+		east += magnitude * math.Sin(bearing)
+	}
+
+	t.Lat += north / metersPerDegree
+	t.Lon += east / (metersPerDegree * math.Cos(t.Lat*math.Pi/180))
+
+	// The reported accuracy is never smaller than the real error, nor than the
+	// receiver's 1-sigma estimate for the current conditions
+	actual := math.Hypot(north, east)
+	expected := math.Hypot(noiseSigma, driftSigma)
+	t.Accuracy = math.Max(g.cfg.MinAccuracy, math.Max(actual, expected))
+}
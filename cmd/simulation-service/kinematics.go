@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// kinematicStep is the integration step for the kinematic model in seconds
+const kinematicStep = 0.5
+
+// VehicleType holds the physical limits of a class of vehicles
+type VehicleType struct {
+	MaxAcceleration float64       `yaml:"max_acceleration"` // m/s²
+	MaxDeceleration float64       `yaml:"max_deceleration"` // m/s², positive
+	MaxSpeed        float64       `yaml:"max_speed"`        // m/s
+	TurnSpeed       float64       `yaml:"turn_speed"`       // m/s through turn maneuvers and sharp bends
+	SharpTurnAngle  float64       `yaml:"sharp_turn_angle"` // heading change in degrees that counts as a sharp bend
+	Energy          EnergyProfile `yaml:"energy"`
+}
+
+// defaultVehicleTypes are used when the configuration does not override them
+var defaultVehicleTypes = map[string]VehicleType{
+	"car":   {MaxAcceleration: 2.5, MaxDeceleration: 3.5, MaxSpeed: 36, TurnSpeed: 6, SharpTurnAngle: 35},
+	"truck": {MaxAcceleration: 1.0, MaxDeceleration: 2.0, MaxSpeed: 25, TurnSpeed: 4, SharpTurnAngle: 30},
+	"bus":   {MaxAcceleration: 1.2, MaxDeceleration: 2.5, MaxSpeed: 25, TurnSpeed: 4.5, SharpTurnAngle: 30},
+	"ev":    {MaxAcceleration: 3.0, MaxDeceleration: 3.5, MaxSpeed: 36, TurnSpeed: 6, SharpTurnAngle: 35},
+	"bike":  {MaxAcceleration: 1.0, MaxDeceleration: 2.0, MaxSpeed: 8, TurnSpeed: 3, SharpTurnAngle: 45},
+}
+
+// turnManeuvers are the OSRM maneuver types that require slowing down
+var turnManeuvers = map[string]bool{
+	"turn":            true,
+	"end of road":     true,
+	"fork":            true,
+	"on ramp":         true,
+	"off ramp":        true,
+	"roundabout":      true,
+	"rotary":          true,
+	"roundabout turn": true,
+	"exit roundabout": true,
+	"exit rotary":     true,
+}
+
+// resolveVehicleType picks the vehicle type for a route profile, falling back to the
+// configured default type and then to the built-in car
+func resolveVehicleType(config *Config, profile string) (string, VehicleType) {
+	for _, name := range []string{profile, config.Simulation.VehicleType, "car"} {
+		if name == "" {
+			continue
+		}
+		if vt, ok := config.Simulation.VehicleTypes[name]; ok {
+			return name, vt.withDefaults(defaultVehicleTypes["car"])
+		}
+		if vt, ok := defaultVehicleTypes[name]; ok {
+			return name, vt
+		}
+	}
+	return "car", defaultVehicleTypes["car"]
+}
+
+// withDefaults fills unset limits from base
+func (vt VehicleType) withDefaults(base VehicleType) VehicleType {
+	if vt.MaxAcceleration <= 0 {
+		vt.MaxAcceleration = base.MaxAcceleration
+	}
+	if vt.MaxDeceleration <= 0 {
+		vt.MaxDeceleration = base.MaxDeceleration
+	}
+	if vt.MaxSpeed <= 0 {
+		vt.MaxSpeed = base.MaxSpeed
+	}
+	if vt.TurnSpeed <= 0 {
+		vt.TurnSpeed = base.TurnSpeed
+	}
+	if vt.SharpTurnAngle <= 0 {
+		vt.SharpTurnAngle = base.SharpTurnAngle
+	}
+	return vt
+}
+
+// SpeedConstraint caps the speed at a point along the route
+type SpeedConstraint struct {
+	Distance float64 // meters along the route
+	MaxSpeed float64 // m/s
+}
+
+// KinematicState is the physical state of a vehicle under the kinematic model
+type KinematicState struct {
+	TypeName    string
+	Type        VehicleType
+	Speed       float64 // instantaneous speed in m/s
+	Constraints []SpeedConstraint
+	next        int // index of the first constraint not yet passed
+}
+
+// NewKinematicState creates a stationary vehicle of the given type
+func NewKinematicState(typeName string, vt VehicleType) *KinematicState {
+	return &KinematicState{TypeName: typeName, Type: vt}
+}
+
+// headingChange returns the absolute difference between two headings in degrees (0-180)
+func headingChange(h1, h2 float64) float64 {
+	diff := math.Abs(h1 - h2)
+	if diff > 180 {
+		diff = 360 - diff
+	}
+	return diff
+}
+
+// buildSpeedConstraints finds the points along the route where the vehicle must slow
+// down: sharp bends in the geometry, turn maneuvers in the route steps, and the end
+// of the route where it comes to a full stop
+func buildSpeedConstraints(ri *RouteIterator, route *Route, vt VehicleType) []SpeedConstraint {
+	var constraints []SpeedConstraint
+
+	// Sharp bends: compare the heading of consecutive segments, ignoring tiny
+	// segments whose heading is dominated by polyline rounding
+	const minSegment = 2.0
+	prevHeading := -1.0
+	for i := 0; i < len(ri.SegmentLengths); i++ {
+		if ri.SegmentLengths[i] < minSegment {
+			continue
+		}
+		p1, p2 := ri.Points[i], ri.Points[i+1]
+		heading := calculateHeading(p1[0], p1[1], p2[0], p2[1])
+		if prevHeading >= 0 {
+			if angle := headingChange(prevHeading, heading); angle >= vt.SharpTurnAngle {
+				// The sharper the bend, the slower; a U-turn goes down to 30% of turn speed
+				factor := (180 - angle) / (180 - vt.SharpTurnAngle)
+				constraints = append(constraints, SpeedConstraint{
+					Distance: ri.SegmentStarts[i],
+					MaxSpeed: vt.TurnSpeed * math.Max(0.3, math.Min(1, factor)),
+				})
+			}
+		}
+		prevHeading = heading
+	}
+
+	// Turn maneuvers at step boundaries; step distances are scaled onto the geometry.
+	// Maneuvers only describe the forward direction, so reversed routes rely on bends.
+	stepTotal := 0.0
+	for _, leg := range route.Route.Legs {
+		for _, step := range leg.Steps {
+			stepTotal += step.Distance
+		}
+	}
+	if stepTotal > 0 && !ri.Reversed {
+		scale := ri.TotalLength / stepTotal
+		accumulated := 0.0
+		for _, leg := range route.Route.Legs {
+			for _, step := range leg.Steps {
+				if step.Maneuver != nil && turnManeuvers[step.Maneuver.Type] && step.Maneuver.Modifier != "straight" {
+					constraints = append(constraints, SpeedConstraint{
+						Distance: accumulated * scale,
+						MaxSpeed: vt.TurnSpeed,
+					})
+				}
+				accumulated += step.Distance
+			}
+		}
+	}
+
+	// Full stop at the end of the route
+	constraints = append(constraints, SpeedConstraint{Distance: ri.TotalLength, MaxSpeed: 0})
+
+	sort.Slice(constraints, func(i, j int) bool {
+		return constraints[i].Distance < constraints[j].Distance
+	})
+	return constraints
+}
+
+// brakingLimit returns the highest speed to reach by the end of the next step from
+// which every constraint ahead can still be met at the vehicle's maximum deceleration.
+// The limit applies where the step ends rather than at position, otherwise the vehicle
+// trails the braking curve and enters turns too fast.
+func (k *KinematicState) brakingLimit(position float64) float64 {
+	for k.next < len(k.Constraints) && k.Constraints[k.next].Distance < position {
+		k.next++
+	}
+
+	// Constraints beyond the braking distance from top speed can never bind
+	decel := k.Type.MaxDeceleration
+	lookahead := k.Type.MaxSpeed*k.Type.MaxSpeed/(2*decel) + k.Type.MaxSpeed*kinematicStep
+	limit := math.Inf(1)
+	for i := k.next; i < len(k.Constraints); i++ {
+		c := k.Constraints[i]
+		gap := c.Distance - position
+		if gap > lookahead {
+			break
+		}
+		// Solves v² ≤ c² + 2a(gap - (speed+v)/2·step) for v, the braking curve at
+		// the position the trapezoidal step ends at
+		reach := math.Max(0, c.MaxSpeed*c.MaxSpeed+2*decel*gap-decel*k.Speed*kinematicStep)
+		limit = math.Min(limit, (math.Sqrt(decel*decel*kinematicStep*kinematicStep+4*reach)-decel*kinematicStep)/2)
+	}
+	return limit
+}
+
+// Advance integrates the vehicle's motion for dt seconds starting at position and
+// returns the distance covered. cruise returns the desired speed at a position,
+// before the vehicle's physical limits are applied.
+func (k *KinematicState) Advance(position, dt, totalLength float64, cruise func(position float64) float64) float64 {
+	start := position
+	for remaining := dt; remaining > 1e-9 && position < totalLength; {
+		step := math.Min(kinematicStep, remaining)
+		remaining -= step
+
+		target := math.Min(cruise(position), k.Type.MaxSpeed)
+		target = math.Min(target, k.brakingLimit(position))
+
+		speed := k.Speed
+		if target > speed {
+			speed = math.Min(target, speed+k.Type.MaxAcceleration*step)
+		} else {
+			speed = math.Max(target, speed-k.Type.MaxDeceleration*step)
+		}
+
+		// Trapezoidal integration of position
+		position += (k.Speed + speed) / 2 * step
+		k.Speed = speed
+
+		// Creep forward when the braking curve would stall just short of a stop
+		if k.Speed == 0 && position < totalLength {
+			position = math.Min(totalLength, position+minProfileSpeed*step)
+		}
+	}
+
+	if position >= totalLength {
+		position = totalLength
+		k.Speed = 0
+	}
+	return position - start
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestKinematicBraking(t *testing.T) {
+	tests := []struct {
+		name        string
+		vehicleType string
+		length      float64
+		constraints []SpeedConstraint // the full stop at the end is added
+		cruise      float64
+	}{
+		{"car straight", "car", 2000, nil, 50},
+		{"car turn", "car", 2000, []SpeedConstraint{{Distance: 1000, MaxSpeed: 6}}, 50},
+		{"truck turns close together", "truck", 1500,
+			[]SpeedConstraint{{Distance: 400, MaxSpeed: 4}, {Distance: 450, MaxSpeed: 2}, {Distance: 1200, MaxSpeed: 4}}, 30},
+		{"bus stop after start", "bus", 800, []SpeedConstraint{{Distance: 20, MaxSpeed: 0}}, 15},
+		{"bike short route", "bike", 30, nil, 8},
+		{"slow cruise", "car", 500, []SpeedConstraint{{Distance: 250, MaxSpeed: 20}}, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vt := defaultVehicleTypes[tt.vehicleType]
+			k := NewKinematicState(tt.vehicleType, vt)
+			k.Constraints = append(append([]SpeedConstraint{}, tt.constraints...), SpeedConstraint{Distance: tt.length, MaxSpeed: 0})
+			cruise := func(float64) float64 { return tt.cruise }
+			// Discrete steps may pass a constraint by up to one step's change in speed
+			tolerance := vt.MaxDeceleration * kinematicStep
+
+			position := 0.0
+			for steps := 0; position < tt.length; steps++ {
+				if steps > 100000 {
+					t.Fatalf("stuck at %.1f m of %.0f m", position, tt.length)
+				}
+				speed := k.Speed
+				moved := k.Advance(position, kinematicStep, tt.length, cruise)
+				if moved < 0 {
+					t.Fatalf("moved backwards by %.2f m at %.1f m", -moved, position)
+				}
+
+				if position < tt.length && position+moved < tt.length {
+					change := (k.Speed - speed) / kinematicStep
+					if change > vt.MaxAcceleration+1e-9 || change < -vt.MaxDeceleration-1e-9 {
+						t.Errorf("speed changed at %.2f m/s² at %.1f m", change, position)
+					}
+				}
+				if k.Speed > math.Min(vt.MaxSpeed, tt.cruise)+1e-9 {
+					t.Errorf("speed %.2f m/s above the limit at %.1f m", k.Speed, position)
+				}
+				for _, c := range tt.constraints {
+					if position <= c.Distance && c.Distance < position+moved &&
+						math.Min(speed, k.Speed) > c.MaxSpeed+tolerance {
+						t.Errorf("passed the %.0f m/s constraint at %.0f m at %.2f-%.2f m/s",
+							c.MaxSpeed, c.Distance, speed, k.Speed)
+					}
+				}
+				position += moved
+			}
+
+			if position != tt.length || k.Speed != 0 {
+				t.Errorf("ended at %.2f m at %.2f m/s, want a stop at %.0f m", position, k.Speed, tt.length)
+			}
+		})
+	}
+}
+
+func TestBrakingLimit(t *testing.T) {
+	vt := defaultVehicleTypes["car"]
+	turn, stop := SpeedConstraint{Distance: 1000, MaxSpeed: 6}, SpeedConstraint{Distance: 1200, MaxSpeed: 0}
+	tests := []struct {
+		name     string
+		position float64
+		speed    float64
+		binding  *SpeedConstraint // nil when no constraint is in reach
+	}{
+		{"beyond the lookahead", 0, 36, nil},
+		{"approaching the turn", 900, 30, &turn},
+		{"close to the turn", 990, 10, &turn},
+		{"at the turn", 1000, 6, &turn},
+		{"past the turn", 1100, 25, &stop},
+		{"at the stop", 1200, 0, &stop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewKinematicState("car", vt)
+			k.Speed = tt.speed
+			k.Constraints = []SpeedConstraint{turn, stop}
+			limit := k.brakingLimit(tt.position)
+			if tt.binding == nil {
+				if !math.IsInf(limit, 1) {
+					t.Errorf("brakingLimit(%.0f) = %g, want no limit", tt.position, limit)
+				}
+				return
+			}
+			// A step ending at the limit ends on the braking curve of the constraint
+			end := tt.position + (tt.speed+limit)/2*kinematicStep
+			curve := tt.binding.MaxSpeed*tt.binding.MaxSpeed + 2*vt.MaxDeceleration*(tt.binding.Distance-end)
+			if limit > 0 && math.Abs(limit*limit-curve) > 1e-6 {
+				t.Errorf("brakingLimit(%.0f) = %g ends %.2f m before the constraint, where the curve allows %g",
+					tt.position, limit, tt.binding.Distance-end, math.Sqrt(math.Max(0, curve)))
+			}
+			if limit > tt.speed+1e-9 && tt.speed > tt.binding.MaxSpeed {
+				t.Errorf("brakingLimit(%.0f) = %g lets the vehicle speed up towards the constraint", tt.position, limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Arrival actions
+const (
+	ArrivalLoop     = "loop"     // drive the same route again from its start
+	ArrivalReverse  = "reverse"  // drive the route back to its start
+	ArrivalReassign = "reassign" // continue on another route from the loaded set
+	ArrivalPark     = "park"     // stay at the destination reporting speed 0
+	ArrivalRetire   = "retire"   // stop publishing
+)
+
+// Vehicle event types
+const (
+	EventDeparture = "departure"
+	EventArrival   = "arrival"
+	EventOffline   = "offline" // the vehicle was stopped or the simulator is shutting down
+	EventOnline    = "online"  // a stopped vehicle was resumed
+	EventAlarm     = "alarm"   // raised by a scenario, e.g. a panic button
+)
+
+// ArrivalPolicy decides what a vehicle does when it reaches the end of its route
+type ArrivalPolicy struct {
+	Action         string  `yaml:"action"`          // loop, reverse, reassign, park or retire
+	DwellTime      string  `yaml:"dwell_time"`      // parked time before loop/reverse/reassign departs
+	Reassign       string  `yaml:"reassign"`        // "random" or "nearest"
+	ReassignRadius float64 `yaml:"reassign_radius"` // meters; "nearest" falls back to random beyond it
+}
+
+// VehicleEvent is emitted when a vehicle departs or arrives
+type VehicleEvent struct {
+	VehicleID int     `json:"vehicle_id"`
+	Timestamp int64   `json:"timestamp"`
+	Type      string  `json:"type"`
+	RouteID   int     `json:"route_id"`
+	Trip      int     `json:"trip"`
+	Lat       float64 `json:"lat"`
+	Lon       float64 `json:"lon"`
+	Reversed  bool    `json:"reversed,omitempty"`
+	Alarm     string  `json:"alarm,omitempty"` // alarm events: the alarm raised
+}
+
+// RoutePool is the set of routes vehicles can be reassigned to
+type RoutePool struct {
+	Routes []*Route
+	starts [][2]float64 // first geometry point of each route
+}
+
+// NewRoutePool indexes the start point of every route
+func NewRoutePool(routes []*Route) *RoutePool {
+	pool := &RoutePool{
+		Routes: make([]*Route, 0, len(routes)),
+		starts: make([][2]float64, 0, len(routes)),
+	}
+	for _, route := range routes {
+		if !route.Metadata.Success {
+			continue
+		}
+		points := decodePolyline(route.Route.Geometry)
+		if len(points) < 2 {
+			continue
+		}
+		pool.Routes = append(pool.Routes, route)
+		pool.starts = append(pool.starts, points[0])
+	}
+	return pool
+}
+
+// Pick chooses the next route for a vehicle at (lat, lon). The "nearest" strategy
+// picks the route starting closest to the vehicle within radius, and falls back to
+// a random route when none is close enough.
+func (p *RoutePool) Pick(rng *rand.Rand, strategy string, lat, lon, radius float64, currentID int) *Route {
+	if len(p.Routes) == 0 {
+		return nil
+	}
+
+	if strategy == "nearest" {
+		best := -1
+		bestDistance := math.Inf(1)
+		for i, start := range p.starts {
+			if p.Routes[i].Metadata.ID == currentID && len(p.Routes) > 1 {
+				continue
+			}
+			distance := calculateDistance(lat, lon, start[0], start[1])
+			if distance < bestDistance {
+				best, bestDistance = i, distance
+			}
+		}
+		if best >= 0 && (radius <= 0 || bestDistance <= radius) {
+			return p.Routes[best]
+		}
+	}
+
+	index := rng.Intn(len(p.Routes))
+	if p.Routes[index].Metadata.ID == currentID && len(p.Routes) > 1 {
+		index = (index + 1) % len(p.Routes)
+	}
+	return p.Routes[index]
+}
+
+// Step advances the vehicle through its lifecycle: driving, arriving, dwelling at the
+// destination and departing again according to its arrival policy. It returns nil
+// once the vehicle has retired, and while it is stopped.
+func (v *VehicleSimulator) Step(currentTime time.Time) *Telemetry {
+	if v.Retired || v.Removed {
+		return nil
+	}
+	if v.Stopped {
+		// A stopped vehicle stays where it is and resumes without a jump
+		v.LastUpdateTime = currentTime
+		return nil
+	}
+
+	if v.Waiting {
+		if v.Paused || !v.Departures.Due(currentTime) {
+			return v.wait(currentTime)
+		}
+		v.Waiting = false
+	}
+
+	elapsed := currentTime.Sub(v.LastUpdateTime).Seconds()
+
+	departing := false
+	if v.Trip == 0 {
+		v.Trip = 1
+		departing = true
+	} else if v.Parked && !v.Paused && (v.Arrival.Action != ArrivalPark || v.Departures.Scheduled()) &&
+		!currentTime.Before(v.ParkedUntil) && v.Departures.Due(currentTime) {
+		v.startNextTrip(currentTime)
+		departing = true
+	}
+	if departing {
+		v.Departures.Departed(currentTime)
+	}
+
+	wasParked := v.Parked
+	distanceBefore := v.DistanceTraveled
+	telemetry := v.UpdateWithRouteIterator(currentTime)
+	if telemetry == nil {
+		return nil
+	}
+
+	if departing {
+		v.emitEvent(EventDeparture, telemetry)
+	}
+
+	if !v.Parked && v.Arrived() {
+		// Hold the vehicle exactly at the destination
+		v.DistanceTraveled = v.RouteIterator.TotalLength
+		v.TripsCompleted++
+		v.emitEvent(EventArrival, telemetry)
+
+		if v.Arrival.Action == ArrivalRetire {
+			v.Retired = true
+		} else {
+			v.Parked = true
+			v.ParkedUntil = currentTime.Add(parseDuration(v.Arrival.DwellTime, 0))
+		}
+	}
+
+	v.TotalDistance += v.DistanceTraveled - distanceBefore
+	if v.Energy != nil {
+		v.Energy.Update(elapsed, v.DistanceTraveled-distanceBefore, v.CurrentSpeed, wasParked)
+		v.Energy.Apply(telemetry)
+	}
+
+	return telemetry
+}
+
+// wait reports the vehicle standing at the start of its route before its first
+// departure, parked or idling, or nothing at all
+func (v *VehicleSimulator) wait(currentTime time.Time) *Telemetry {
+	elapsed := currentTime.Sub(v.LastUpdateTime).Seconds()
+	if v.Departures.Before == WaitNone {
+		v.LastUpdateTime = currentTime
+		return nil
+	}
+	telemetry := v.UpdateWithRouteIterator(currentTime)
+	if v.Energy != nil {
+		v.Energy.Update(elapsed, 0, 0, !v.EngineOn())
+		v.Energy.Apply(telemetry)
+	}
+	return telemetry
+}
+
+// EngineOn reports whether the engine is running: not while parked, nor while
+// waiting parked for the first departure
+func (v *VehicleSimulator) EngineOn() bool {
+	if v.Waiting {
+		return v.Departures.Before == WaitIdle
+	}
+	return !v.Parked
+}
+
+// startNextTrip puts the vehicle back on the road after dwelling at the destination.
+// A parked vehicle with a departure schedule drives its route again from the start.
+func (v *VehicleSimulator) startNextTrip(currentTime time.Time) {
+	switch v.Arrival.Action {
+	case ArrivalReverse:
+		v.RouteIterator.reverse()
+	case ArrivalReassign:
+		end := v.RouteIterator.Points[len(v.RouteIterator.Points)-1]
+		if v.Pool != nil {
+			if route := v.Pool.Pick(v.Rand, v.Arrival.Reassign, end[0], end[1],
+				v.Arrival.ReassignRadius, v.Route.Metadata.ID); route != nil {
+				v.Route = route
+				v.RouteIterator = NewRouteIterator(route)
+			}
+		}
+	}
+
+	v.DistanceTraveled = 0
+	v.LastUpdateTime = currentTime
+	v.Parked = false
+	v.Trip++
+	if v.Kinematics != nil {
+		v.Kinematics.Speed = 0
+		v.Kinematics.Constraints = nil
+		v.Kinematics.next = 0
+	}
+}
+
+// Status describes what the vehicle is doing: "driving", "parked" (dwelling at the
+// destination), "waiting" (for its first departure), "paused", "stopped", "retired"
+// or "removed"
+func (v *VehicleSimulator) Status() string {
+	switch {
+	case v.Removed:
+		return "removed"
+	case v.Retired:
+		return "retired"
+	case v.Stopped:
+		return "stopped"
+	case v.Paused:
+		return "paused"
+	case v.Waiting:
+		return "waiting"
+	case v.Parked:
+		return "parked"
+	default:
+		return "driving"
+	}
+}
+
+// position returns the vehicle's true position and heading on its route
+func (v *VehicleSimulator) position() (lat, lon, heading float64) {
+	if v.RouteIterator == nil {
+		v.RouteIterator = NewRouteIterator(v.Route)
+	}
+	return v.RouteIterator.CalculatePosition(v.DistanceTraveled)
+}
+
+// speedFactor returns the multiplier applied to the vehicle's speed
+func (v *VehicleSimulator) speedFactor() float64 {
+	if v.SpeedFactor <= 0 {
+		return 1
+	}
+	return v.SpeedFactor
+}
+
+// emitEvent queues a lifecycle event at the telemetry's position
+func (v *VehicleSimulator) emitEvent(eventType string, telemetry *Telemetry) {
+	v.events = append(v.events, VehicleEvent{
+		VehicleID: v.VehicleID,
+		Timestamp: telemetry.Timestamp,
+		Type:      eventType,
+		RouteID:   v.Route.Metadata.ID,
+		Trip:      v.Trip,
+		Lat:       telemetry.Lat,
+		Lon:       telemetry.Lon,
+		Reversed:  v.RouteIterator.Reversed,
+	})
+}
+
+// TakeEvents returns and clears the vehicle's pending events
+func (v *VehicleSimulator) TakeEvents() []VehicleEvent {
+	events := v.events
+	v.events = nil
+	return events
+}
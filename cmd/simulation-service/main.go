@@ -1,16 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"gopkg.in/yaml.v3"
 )
 
@@ -35,7 +35,16 @@ type Route struct {
 				Distance float64 `json:"distance"`
 				Duration float64 `json:"duration"`
 				Geometry string  `json:"geometry"`
+				Maneuver *struct {
+					Type     string `json:"type"`
+					Modifier string `json:"modifier"`
+				} `json:"maneuver"`
 			} `json:"steps"`
+			Annotation *struct {
+				Duration []float64 `json:"duration"`
+				Distance []float64 `json:"distance"`
+				Speed    []float64 `json:"speed"`
+			} `json:"annotation"`
 		} `json:"legs"`
 	} `json:"route"`
 }
@@ -52,6 +61,12 @@ type Telemetry struct {
 	Accuracy  float64 `json:"acc"`
 	Battery   float64 `json:"battery"`
 	Signal    float64 `json:"signal"`
+	Fuel      *float64 `json:"fuel,omitempty"` // fuel level (%) for fuel vehicles
+	Odometer  float64 `json:"odometer"`        // km
+	EngineHours float64 `json:"engine_hours"`
+	Replayed  bool    `json:"replayed,omitempty"` // uploaded late from the device buffer
+
+	fault *payloadFault // injected fault applied when the record is encoded
 }
 
 // validate ensures all telemetry values are valid numbers
@@ -80,6 +95,15 @@ func (t *Telemetry) validate() {
 	if math.IsNaN(t.Signal) || math.IsInf(t.Signal, 0) {
 		t.Signal = 85.0
 	}
+	if t.Fuel != nil && (math.IsNaN(*t.Fuel) || math.IsInf(*t.Fuel, 0)) {
+		t.Fuel = nil
+	}
+	if math.IsNaN(t.Odometer) || math.IsInf(t.Odometer, 0) {
+		t.Odometer = 0.0
+	}
+	if math.IsNaN(t.EngineHours) || math.IsInf(t.EngineHours, 0) {
+		t.EngineHours = 0.0
+	}
 }
 
 // VehicleSimulator simulates a vehicle moving along a route
@@ -92,30 +116,72 @@ type VehicleSimulator struct {
 	CurrentSpeed   float64    // current speed in m/s
 	DistanceTraveled float64  // cumulative distance traveled in meters
 	LastUpdateTime time.Time  // time of last update
+	Rand           *rand.Rand // per-vehicle random source
+	UseSpeedProfile bool      // follow annotated per-segment speeds when available
+	SpeedJitter    float64    // ±fraction applied to annotated speeds
+	TypeName       string          // vehicle type, e.g. "car" or "truck"
+	Kinematics     *KinematicState // physical model; nil uses the simple speed models
+	Arrival        ArrivalPolicy   // what to do at the end of the route
+	Pool           *RoutePool      // routes available for reassignment
+	Trip           int             // current trip number, starting at 1
+	TripsCompleted int             // arrivals at the end of a route
+	TotalDistance  float64         // meters driven over all trips
+	Parked         bool            // dwelling at the destination
+	ParkedUntil    time.Time       // when a dwelling vehicle departs again
+	Departures     *DepartureSchedule // scheduled departures; nil departs at once and after dwelling
+	Waiting        bool            // at the start of its route before the first departure
+	Retired        bool            // no longer publishing
+	Paused         bool            // held in place through the control API, still reporting
+	Stopped        bool            // switched off through the control API, not reporting
+	Removed        bool            // removed through the control API
+	SpeedFactor    float64         // multiplier on the vehicle's speed; 0 means 1
+	Energy         *EnergyState    // battery/fuel, odometer and engine hours
+	GPS            GPSErrorModel   // position error model; nil reports exact positions
+	Connectivity   *ConnectivityState // coverage and store-and-forward buffer; nil is always online
+	Faults         *FaultInjector     // injected bad data; nil sends clean telemetry
+	MQTT           *MQTTPublisher  // the device's own connection; nil publishes via the shared client
+	events         []VehicleEvent  // pending lifecycle events
 }
 
 // Config holds simulation configuration
 type Config struct {
-	MQTT struct {
-		Broker   string `yaml:"broker"`
-		Topic    string `yaml:"topic"`
-		ClientID string `yaml:"client_id"`
-		QoS      int    `yaml:"qos"`
-		Retain   bool   `yaml:"retain"`
-	} `yaml:"mqtt"`
+	MQTT MQTTConfig `yaml:"mqtt"`
 
 	Simulation struct {
 		UpdateInterval  string  `yaml:"update_interval"`
 		SimulationSpeed float64 `yaml:"simulation_speed"`
 		RoutesPath      string  `yaml:"routes_path"`
+		RouteIDs        []int   `yaml:"route_ids"`  // optional subset of routes to simulate
+		MaxRoutes       int     `yaml:"max_routes"` // optional cap on the number of routes
 		SpeedVariation  float64 `yaml:"speed_variation"`
+		SpeedProfile    string  `yaml:"speed_profile"` // "annotations" (default) or "random"
+		SpeedJitter     float64 `yaml:"speed_jitter"`  // ±fraction applied to annotated speeds
+		VehicleModel    string  `yaml:"vehicle_model"` // "kinematic" (default) or "simple"
+		VehicleType     string  `yaml:"vehicle_type"`  // default type when the route profile has none
+		VehicleTypes    map[string]VehicleType `yaml:"vehicle_types"`
+		EndOfRoute      ArrivalPolicy          `yaml:"end_of_route"`
+		GPS             GPSConfig              `yaml:"gps"`
+		Connectivity    ConnectivityConfig     `yaml:"connectivity"`
+		Faults          FaultConfig            `yaml:"faults"`
+		Departures      DepartureConfig        `yaml:"departures"`
+		RandomSeed      int64   `yaml:"random_seed"`
+		StartTime       string  `yaml:"start_time"` // RFC3339, defaults to now
+		Scenario        string  `yaml:"scenario"`   // optional scenario file, live mode only
 
 		AltitudeRange [2]float64 `yaml:"altitude_range"`
 		AccuracyRange [2]float64 `yaml:"accuracy_range"`
-		BatteryRange  [2]float64 `yaml:"battery_range"`
+		BatteryRange  [2]float64 `yaml:"battery_range"`  // initial tracker battery of fuel vehicles
+		OdometerRange [2]float64 `yaml:"odometer_range"` // initial odometer in km
 		SignalRange   [2]float64 `yaml:"signal_range"`
 	} `yaml:"simulation"`
 
+	Output OutputConfig `yaml:"output"`
+	Sinks  []SinkConfig `yaml:"sinks"` // live-mode destinations; defaults to MQTT only
+	Engine EngineConfig `yaml:"engine"`
+
+	Control      ControlConfig      `yaml:"control"`
+	RouteService RouteServiceConfig `yaml:"route_service"`
+
 	Logging struct {
 		Level  string `yaml:"level"`
 		Format string `yaml:"format"`
@@ -130,138 +196,372 @@ func parseDuration(durStr string, defaultDur time.Duration) time.Duration {
 	return defaultDur
 }
 
+// vehicleSeed derives a per-vehicle seed from the global seed and vehicle ID,
+// so each vehicle's random stream is independent of fleet size and ordering
+func vehicleSeed(globalSeed int64, vehicleID int) int64 {
+	// splitmix64 finalizer
+	z := uint64(globalSeed) + uint64(vehicleID)*0x9E3779B97F4A7C15
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return int64(z ^ (z >> 31))
+}
+
 func main() {
 	// Parse command line arguments
 	configPath := flag.String("config", "config.yaml", "Path to configuration file")
+	modeFlag := flag.String("mode", "", "Output mode: mqtt or file (overrides output.mode)")
+	trackerStub := flag.String("tracker-stub", "", "Run a Teltonika/GT06 test server on this address instead of simulating")
+	trackerStubAckLoss := flag.Float64("tracker-stub-ack-loss", 0, "Fraction of ACKs the tracker test server withholds")
+	decodePath := flag.String("decode", "", "Print a telemetry payload file (- for stdin) as JSON instead of simulating")
+	decodeEncoding := flag.String("decode-encoding", "", "Payload encoding for -decode: json, protobuf, cbor or msgpack (default: from the file extension)")
+	decodeType := flag.String("decode-type", "telemetry", "Message type for -decode: telemetry, batch or event")
+	scenarioPath := flag.String("scenario", "", "Scenario file of scripted vehicle actions (overrides simulation.scenario)")
 	flag.Parse()
 
+	if *decodePath != "" {
+		if err := runDecode(*decodePath, *decodeEncoding, *decodeType); err != nil {
+			log.Fatalf("Failed to decode payload: %v", err)
+		}
+		return
+	}
+
+	if *trackerStub != "" {
+		log.Fatal(runTrackerStub(*trackerStub, *trackerStubAckLoss))
+	}
+
 	// Load configuration
 	config, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if *scenarioPath != "" {
+		config.Simulation.Scenario = *scenarioPath
+	}
 
 	// Load routes
-	routes, err := loadRoutes(config.Simulation.RoutesPath)
+	routes, err := loadRoutes(config.Simulation.RoutesPath, RouteSelection{
+		RouteIDs:  config.Simulation.RouteIDs,
+		MaxRoutes: config.Simulation.MaxRoutes,
+	})
 	if err != nil {
 		log.Fatalf("Failed to load routes: %v", err)
 	}
 	log.Printf("Loaded %d routes from %s", len(routes), config.Simulation.RoutesPath)
 
-	// Connect to MQTT broker
-	client := connectMQTT(config.MQTT.Broker, config.MQTT.ClientID)
-	defer client.Disconnect(250)
+	// Offline mode writes telemetry to files and needs no broker
+	mode := config.Output.Mode
+	if *modeFlag != "" {
+		mode = *modeFlag
+	}
+	if mode == "file" {
+		if config.Simulation.Scenario != "" {
+			log.Printf("Warning: scenarios run in live mode only; ignoring %s", config.Simulation.Scenario)
+		}
+		if err := runOffline(config, routes); err != nil {
+			log.Fatalf("Offline simulation failed: %v", err)
+		}
+		return
+	}
 
-	// Create vehicle simulators
+	runLive(config, routes)
+}
+
+// simulationStart returns the configured simulation start time, or now if unset
+func simulationStart(config *Config) time.Time {
+	if config.Simulation.StartTime == "" {
+		return time.Now()
+	}
+	start, err := time.Parse(time.RFC3339, config.Simulation.StartTime)
+	if err != nil {
+		log.Printf("Warning: Invalid start_time %q, using current time: %v", config.Simulation.StartTime, err)
+		return time.Now()
+	}
+	return start
+}
+
+// createSimulators creates a vehicle simulator for every successful route
+func createSimulators(routes []*Route, config *Config, clock Clock) []*VehicleSimulator {
+	pool := NewRoutePool(routes)
 	simulators := make([]*VehicleSimulator, 0, len(routes))
 	for _, route := range routes {
 		if !route.Metadata.Success {
 			continue
 		}
-
-		simulator := &VehicleSimulator{
-			VehicleID:      route.Metadata.ID,
-			Route:          route,
-			StartTime:      time.Now(),
-			LastUpdateTime: time.Now(),
+		simulator, err := newSimulator(route.Metadata.ID, route, config, clock, pool)
+		if err != nil {
+			log.Fatalf("Invalid GPS configuration: %v", err)
 		}
+		simulators = append(simulators, simulator)
+	}
+	return simulators
+}
 
-		// Calculate speed range based on route distance and duration
-		avgSpeed := 0.0
-		if route.Metadata.Duration > 0 {
-			avgSpeed = route.Metadata.Distance / route.Metadata.Duration // m/s
-		} else {
-			avgSpeed = 20.0 // Default average speed if duration is 0
-		}
+// newSimulator creates the simulator of one vehicle driving route
+func newSimulator(vehicleID int, route *Route, config *Config, clock Clock, pool *RoutePool) (*VehicleSimulator, error) {
+	arrival := config.Simulation.EndOfRoute
+	if arrival.Action == "" {
+		arrival.Action = ArrivalPark
+	}
 
-		// Ensure avgSpeed is a valid number
-		if math.IsNaN(avgSpeed) || math.IsInf(avgSpeed, 0) || avgSpeed <= 0 {
-			avgSpeed = 20.0 // Default average speed
-		}
+	simulator := &VehicleSimulator{
+		VehicleID:      vehicleID,
+		Route:          route,
+		StartTime:      clock.Now(),
+		LastUpdateTime: clock.Now(),
+		Rand:           rand.New(rand.NewSource(vehicleSeed(config.Simulation.RandomSeed, vehicleID))),
+		UseSpeedProfile: config.Simulation.SpeedProfile != "random",
+		SpeedJitter:    config.Simulation.SpeedJitter,
+		Arrival:        arrival,
+		Pool:           pool,
+	}
+	typeName, vehicleType := resolveVehicleType(config, route.Metadata.Profile)
+	simulator.TypeName = typeName
+	if config.Simulation.VehicleModel != "simple" {
+		simulator.Kinematics = NewKinematicState(typeName, vehicleType)
+	}
+	simulator.Energy = NewEnergyState(energyProfileFor(typeName, vehicleType), simulator.Rand,
+		config.Simulation.OdometerRange, config.Simulation.BatteryRange)
+	gps, err := NewGPSErrorModel(config.Simulation.GPS, simulator.Rand)
+	if err != nil {
+		return nil, err
+	}
+	simulator.GPS = gps
+	if config.Simulation.Connectivity.Enabled() {
+		simulator.Connectivity = NewConnectivityState(config.Simulation.Connectivity, simulator.Rand)
+	}
+
+	// Calculate speed range based on route distance and duration
+	avgSpeed := 0.0
+	if route.Metadata.Duration > 0 {
+		avgSpeed = route.Metadata.Distance / route.Metadata.Duration // m/s
+	} else {
+		avgSpeed = 20.0 // Default average speed if duration is 0
+	}
 
-		variation := config.Simulation.SpeedVariation
-		simulator.SpeedRange = [2]float64{
-			avgSpeed * (1 - variation), // min speed
-			avgSpeed * (1 + variation), // max speed
+	// Ensure avgSpeed is a valid number
+	if math.IsNaN(avgSpeed) || math.IsInf(avgSpeed, 0) || avgSpeed <= 0 {
+		avgSpeed = 20.0 // Default average speed
+	}
+
+	variation := config.Simulation.SpeedVariation
+	simulator.SpeedRange = [2]float64{
+		avgSpeed * (1 - variation), // min speed
+		avgSpeed * (1 + variation), // max speed
+	}
+
+	log.Printf("Created simulator for vehicle %d (distance: %.0fm, duration: %.0fs, avg speed: %.1f m/s, range: %.1f-%.1f m/s)",
+		simulator.VehicleID, route.Metadata.Distance, route.Metadata.Duration, avgSpeed,
+		simulator.SpeedRange[0], simulator.SpeedRange[1])
+	return simulator, nil
+}
+
+// generateTelemetry advances a simulator to currentTime, fills in the configured telemetry
+// ranges and returns the points the device uploads at this time
+func generateTelemetry(simulator *VehicleSimulator, config *Config, currentTime time.Time) []Telemetry {
+	telemetry := simulator.Step(currentTime)
+	if telemetry == nil {
+		return nil
+	}
+
+	// Apply configuration ranges
+	telemetry.Altitude = config.Simulation.AltitudeRange[0] +
+		simulator.Rand.Float64()*(config.Simulation.AltitudeRange[1]-config.Simulation.AltitudeRange[0])
+	telemetry.Accuracy = config.Simulation.AccuracyRange[0] +
+		simulator.Rand.Float64()*(config.Simulation.AccuracyRange[1]-config.Simulation.AccuracyRange[0])
+	telemetry.Signal = config.Simulation.SignalRange[0] +
+		simulator.Rand.Float64()*(config.Simulation.SignalRange[1]-config.Simulation.SignalRange[0])
+
+	// Turn the true position into a GPS fix; the model sets a matching accuracy
+	if simulator.GPS != nil {
+		simulator.GPS.Apply(telemetry)
+	}
+
+	// Validate all values are valid numbers
+	telemetry.validate()
+
+	// Without coverage the device stores the point and uploads it later
+	telemetries := []Telemetry{*telemetry}
+	if simulator.Connectivity != nil {
+		telemetries = simulator.Connectivity.Process(telemetry, currentTime)
+		// A retiring device uploads its backlog, which would otherwise be lost
+		if simulator.Retired {
+			telemetries = append(telemetries, simulator.Connectivity.Flush()...)
 		}
+	}
 
-		simulators = append(simulators, simulator)
-		log.Printf("Created simulator for vehicle %d (distance: %.0fm, duration: %.0fs, avg speed: %.1f m/s, range: %.1f-%.1f m/s)",
-			simulator.VehicleID, route.Metadata.Distance, route.Metadata.Duration, avgSpeed,
-			simulator.SpeedRange[0], simulator.SpeedRange[1])
-	}
-
-	// Create batch sender
-	batchSender := NewTelemetryBatchSender(10, 30*time.Second)
-
-	// Start simulation
-	log.Printf("Starting simulation of %d vehicles", len(simulators))
-	updateInterval := parseDuration(config.Simulation.UpdateInterval, 5*time.Second)
-	ticker := time.NewTicker(updateInterval)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		simulationTime := time.Now()
-		var telemetries []Telemetry
-
-		for _, simulator := range simulators {
-			telemetry := simulator.UpdateWithRouteIterator(simulationTime)
-			if telemetry != nil {
-				// Apply configuration ranges
-				telemetry.Altitude = config.Simulation.AltitudeRange[0] +
-					rand.Float64()*(config.Simulation.AltitudeRange[1]-config.Simulation.AltitudeRange[0])
-				telemetry.Accuracy = config.Simulation.AccuracyRange[0] +
-					rand.Float64()*(config.Simulation.AccuracyRange[1]-config.Simulation.AccuracyRange[0])
-				telemetry.Battery = config.Simulation.BatteryRange[0] +
-					rand.Float64()*(config.Simulation.BatteryRange[1]-config.Simulation.BatteryRange[0])
-				telemetry.Signal = config.Simulation.SignalRange[0] +
-					rand.Float64()*(config.Simulation.SignalRange[1]-config.Simulation.SignalRange[0])
-
-				// Validate all values are valid numbers
-				telemetry.validate()
-
-				telemetries = append(telemetries, *telemetry)
-			}
+	// Faults are injected after validation, into what the device actually sends
+	if simulator.Faults != nil {
+		telemetries = simulator.Faults.Apply(telemetries, currentTime)
+	}
+	return telemetries
+}
+
+// flushBuffered returns the points a vehicle still holds from an outage, flagged as
+// replayed and with faults injected, for a vehicle that is removed or shut down
+func flushBuffered(simulator *VehicleSimulator, now time.Time) []Telemetry {
+	if simulator.Connectivity == nil || simulator.Connectivity.Pending() == 0 {
+		return nil
+	}
+	telemetries := simulator.Connectivity.Flush()
+	if simulator.Faults != nil {
+		telemetries = simulator.Faults.Apply(telemetries, now)
+	}
+	return telemetries
+}
+
+// runLive runs the simulation in real (or warped) time and publishes telemetry via MQTT
+func runLive(config *Config, routes []*Route) {
+	// Create the simulation clock; simulation_speed warps simulated time
+	clock := NewVirtualClock(simulationStart(config), config.Simulation.SimulationSpeed)
+
+	// Create vehicle simulators
+	simulators := createSimulators(routes, config, clock)
+
+	// Load the scenario before connecting, so a broken file fails fast
+	var scenario *Scenario
+	if config.Simulation.Scenario != "" {
+		var err error
+		if scenario, err = LoadScenario(config.Simulation.Scenario); err != nil {
+			log.Fatalf("Failed to load scenario %s: %v", config.Simulation.Scenario, err)
 		}
+	}
 
-		// Send individual telemetry
-		for _, telemetry := range telemetries {
-			sendTelemetry(client, config.MQTT.Topic, &telemetry)
+	// Vehicles wait at the start of their route until they are due to depart
+	departures, err := setupDepartures(config, simulators, clock.Now())
+	if err != nil {
+		log.Fatalf("Invalid departure schedule: %v", err)
+	}
 
-			// Also add to batch
-			if ready, batch := batchSender.AddTelemetry(config.MQTT.Topic+"_batch", telemetry); ready {
-				SendBatchTelemetry(client, config.MQTT.Topic+"_batch", batch)
-			}
+	// Faults are injected on purpose to test validators downstream
+	faults, err := setupFaults(config, simulators, sinkTypes(config))
+	if err != nil {
+		log.Fatalf("Failed to set up fault injection: %v", err)
+	}
+
+	// Connect the telemetry sinks; MQTT publishes are bounded by the in-flight limiter
+	inflight := newInflightLimiter(config.Engine)
+	sink, err := newSinks(config, simulators, clock, inflight)
+	if err != nil {
+		log.Fatalf("Failed to create telemetry sinks: %v", err)
+	}
+	report := NewRunReport(simulators, clock.Now())
+
+	// Stop on SIGINT/SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	// Start simulation; update_interval is measured in simulation time
+	engine := NewEngine(config, clock, simulators, sink, report, inflight)
+	engine.faults = faults
+	engine.departures = departures
+	if scenario != nil {
+		engine.scenario = NewScenarioRunner(scenario, clock.Now())
+	}
+
+	// The control API changes the simulation while it runs and streams positions
+	// to the map viewer
+	var control *ControlServer
+	if config.Control.Listen != "" {
+		feed := NewPositionFeed()
+		sink.Sinks = append(sink.Sinks, feed)
+		sink.Names = append(sink.Names, "feed")
+		control = NewControlServer(config.Control, engine, feed)
+		if err := control.Start(); err != nil {
+			log.Fatalf("Failed to start control API: %v", err)
 		}
+	}
 
-		log.Printf("Sent %d telemetry updates at %s", len(telemetries), simulationTime.Format("15:04:05"))
+	engine.Run(signals)
+
+	if control != nil {
+		if err := control.Close(); err != nil {
+			log.Printf("Failed to stop control API: %v", err)
+		}
+	}
+	shutdown(engine.Vehicles(), sink, report, clock.Now())
+	report.Engine = engine.Stats()
+	if faults != nil {
+		if err := faults.Close(); err != nil {
+			log.Printf("Failed to close fault log: %v", err)
+		}
+		report.Faults = faults.Counts()
 	}
+	writeReport(config, report)
 }
 
-func loadRoutes(path string) ([]*Route, error) {
-	files, err := filepath.Glob(filepath.Join(path, "route_*.json"))
-	if err != nil {
-		return nil, err
+// shutdown uploads the points devices still buffer, announces every vehicle still on
+// the road as offline, flushes pending batches, disconnects the sinks and finishes the
+// run report
+func shutdown(simulators []*VehicleSimulator, sink TelemetrySink, report *RunReport, now time.Time) {
+	replayed := 0
+	for _, simulator := range simulators {
+		for _, telemetry := range flushBuffered(simulator, now) {
+			start := time.Now()
+			report.RecordTelemetry(simulator, &telemetry)
+			err := sink.SendTelemetry(simulator, &telemetry)
+			report.RecordPublish(simulator, time.Since(start), err)
+			if err != nil {
+				log.Printf("Failed to send buffered telemetry: %v", err)
+				continue
+			}
+			replayed++
+		}
+	}
+	if replayed > 0 {
+		log.Printf("Sent %d buffered telemetry points", replayed)
 	}
 
-	routes := make([]*Route, 0, len(files))
-	for _, file := range files {
-		data, err := os.ReadFile(file)
-		if err != nil {
-			log.Printf("Warning: Failed to read %s: %v", file, err)
+	offline := 0
+	for _, simulator := range simulators {
+		last := report.LastTelemetry(simulator)
+		if simulator.Retired || simulator.Removed || simulator.Stopped || last == nil {
 			continue
 		}
-
-		var route Route
-		if err := json.Unmarshal(data, &route); err != nil {
-			log.Printf("Warning: Failed to parse %s: %v", file, err)
+		event := VehicleEvent{
+			VehicleID: simulator.VehicleID,
+			Timestamp: now.Unix(),
+			Type:      EventOffline,
+			RouteID:   simulator.Route.Metadata.ID,
+			Trip:      simulator.Trip,
+			Lat:       last.Lat,
+			Lon:       last.Lon,
+			Reversed:  simulator.RouteIterator.Reversed,
+		}
+		start := time.Now()
+		err := sink.SendEvent(simulator, &event)
+		report.RecordPublish(simulator, time.Since(start), err)
+		if err != nil {
+			log.Printf("Failed to send offline event: %v", err)
 			continue
 		}
+		offline++
+	}
+	log.Printf("Sent offline events for %d vehicles", offline)
 
-		routes = append(routes, &route)
+	// Closing the sinks flushes batches and disconnects cleanly
+	if err := sink.Close(); err != nil {
+		log.Printf("Failed to close telemetry sinks: %v", err)
 	}
 
-	return routes, nil
+	report.Finish(simulators, now)
+}
+
+// writeReport saves the run report to the configured path
+func writeReport(config *Config, report *RunReport) {
+	path := config.Output.Report
+	if path == "" {
+		path = "run_report.json"
+	}
+	if err := report.Write(path); err != nil {
+		log.Printf("Failed to write run report: %v", err)
+		return
+	}
+	log.Printf("Run report written to %s: %d vehicles drove %.1f km, %d messages sent, %d publish failures, p99 latency %.1f ms",
+		path, report.VehicleCount, report.DistanceKm, report.MessagesSent, report.PublishFailures, report.PublishLatency.P99)
+	log.Printf("Engine: %d ticks, %d overrun, %d skipped, longest %.0f ms, peak %d publishes in flight, %d messages dropped",
+		report.Engine.Ticks, report.Engine.TicksOverrun, report.Engine.TicksSkipped, report.Engine.MaxTickMs,
+		report.Engine.PeakInflight, report.Engine.DroppedMessages)
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -278,34 +578,26 @@ func loadConfig(path string) (*Config, error) {
 	return &config, nil
 }
 
-func connectMQTT(broker, clientID string) mqtt.Client {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID(clientID)
-	opts.SetCleanSession(true)
-
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", token.Error())
-	}
-	log.Printf("Connected to MQTT broker at %s", broker)
-	return client
-}
-
 func (v *VehicleSimulator) update(currentTime time.Time) *Telemetry {
 	return v.UpdateWithRouteIterator(currentTime)
 }
 
-func sendTelemetry(client mqtt.Client, topic string, telemetry *Telemetry) {
-	data, err := json.Marshal(telemetry)
+// sendTelemetry publishes one telemetry record and reports the result to done
+func sendTelemetry(client *MQTTPublisher, topic string, qos byte, retain bool, encoding PayloadEncoding, telemetry *Telemetry, done func(error)) {
+	data, err := encoding.Marshal(telemetry)
 	if err != nil {
-		log.Printf("Failed to marshal telemetry: %v", err)
+		done(fmt.Errorf("failed to marshal telemetry: %w", err))
 		return
 	}
+	client.PublishAsync(topic, qos, retain, data, done)
+}
 
-	token := client.Publish(topic, 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("Failed to publish telemetry: %v", token.Error())
+// sendEvent publishes one lifecycle event and reports the result to done
+func sendEvent(client *MQTTPublisher, topic string, qos byte, encoding PayloadEncoding, event *VehicleEvent, done func(error)) {
+	data, err := encoding.Marshal(event)
+	if err != nil {
+		done(fmt.Errorf("failed to marshal event: %w", err))
+		return
 	}
+	client.PublishAsync(topic, qos, false, data, done)
 }
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTConfig holds the broker connection and publishing settings
+type MQTTConfig struct {
+	Broker   string `yaml:"broker"`
+	Topic    string `yaml:"topic"`
+	ClientID string `yaml:"client_id"`
+	QoS      int    `yaml:"qos"`
+	Retain   bool   `yaml:"retain"` // retain each vehicle's last live telemetry
+
+	Fleet              string `yaml:"fleet"`                // value of {fleet} in topic templates
+	TopicTemplate      string `yaml:"topic_template"`       // per-vehicle telemetry topic, defaults to topic
+	EventTopicTemplate string `yaml:"event_topic_template"` // defaults to topic + "_events"
+	BatchTopicTemplate string `yaml:"batch_topic_template"` // defaults to topic + "_batch"
+
+	PayloadEncoding     string `yaml:"payload_encoding"`      // "json" (default), "protobuf", "cbor" or "msgpack"
+	EncodingTopicSuffix *bool  `yaml:"encoding_topic_suffix"` // append "/<encoding>" to binary topics, default true
+
+	Batch BatchConfig `yaml:"batch"`
+
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	TLS      MQTTTLSConfig `yaml:"tls"`
+
+	ConnectTimeout       string `yaml:"connect_timeout"`        // per connection attempt, default 10s
+	ConnectRetryInterval string `yaml:"connect_retry_interval"` // between initial connection attempts, default 5s
+	MaxReconnectInterval string `yaml:"max_reconnect_interval"` // cap of the reconnect backoff, default 2m
+
+	OfflineQueue OfflineQueueConfig `yaml:"offline_queue"`
+	Will         WillConfig         `yaml:"will"`
+
+	ConnectionMode   string  `yaml:"connection_mode"`    // "shared" (default) or "per_device"
+	ClientIDTemplate string  `yaml:"client_id_template"` // per-device client ID, default "vehicle_{vehicle_id}"
+	ConnectRate      float64 `yaml:"connect_rate"`       // per-device connections opened per second, default 50
+	CredentialsFile  string  `yaml:"credentials_file"`   // per-device credentials CSV
+
+	Quiet bool `yaml:"-"` // log only connection failures, for per-device clients
+}
+
+// MQTTTLSConfig configures TLS and client-certificate authentication
+type MQTTTLSConfig struct {
+	CAFile             string `yaml:"ca_file"`   // broker CA bundle (PEM)
+	CertFile           string `yaml:"cert_file"` // client certificate for mutual TLS (PEM)
+	KeyFile            string `yaml:"key_file"`  // client private key (PEM)
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Enabled reports whether any TLS setting is configured
+func (c MQTTTLSConfig) Enabled() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.ServerName != "" || c.InsecureSkipVerify
+}
+
+// OfflineQueueConfig configures where messages wait while the broker is unreachable
+type OfflineQueueConfig struct {
+	Type        string `yaml:"type"`         // "memory" (default) or "file"
+	Path        string `yaml:"path"`         // queue file for type "file"
+	MaxMessages int    `yaml:"max_messages"` // oldest messages are dropped beyond this, default 10000
+}
+
+// WillConfig configures the last-will message announcing that the simulator went offline
+type WillConfig struct {
+	Topic          string `yaml:"topic"` // status topic, may contain {client_id}; no will when empty
+	OfflinePayload string `yaml:"offline_payload"`
+	OnlinePayload  string `yaml:"online_payload"` // published retained on every (re)connect
+	QoS            int    `yaml:"qos"`
+	Retain         *bool  `yaml:"retain"` // default true
+}
+
+// loadTLSConfig builds the TLS configuration from CA and client certificate files
+func loadTLSConfig(cfg MQTTTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// queuedMessage is a publish waiting for the broker connection
+type queuedMessage struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload []byte `json:"payload"`
+}
+
+// OfflineQueue holds messages published while disconnected. A file-backed queue
+// appends every message to disk, so a restarted simulator still delivers them.
+type OfflineQueue struct {
+	mu       sync.Mutex
+	max      int
+	path     string
+	file     *os.File
+	messages []queuedMessage
+	Dropped  int
+}
+
+// NewOfflineQueue creates the queue and loads messages left in the queue file
+func NewOfflineQueue(cfg OfflineQueueConfig) (*OfflineQueue, error) {
+	q := &OfflineQueue{max: cfg.MaxMessages}
+	if q.max <= 0 {
+		q.max = 10000
+	}
+
+	switch cfg.Type {
+	case "", "memory":
+		return q, nil
+	case "file":
+	default:
+		return nil, fmt.Errorf("unsupported offline queue type: %s", cfg.Type)
+	}
+
+	q.path = cfg.Path
+	if q.path == "" {
+		q.path = "mqtt_queue.jsonl"
+	}
+	if file, err := os.Open(q.path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var msg queuedMessage
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				log.Printf("Warning: Skipping corrupt entry in %s: %v", q.path, err)
+				continue
+			}
+			q.messages = append(q.messages, msg)
+		}
+		file.Close()
+		if len(q.messages) > q.max {
+			q.Dropped += len(q.messages) - q.max
+			q.messages = q.messages[len(q.messages)-q.max:]
+		}
+		if len(q.messages) > 0 {
+			log.Printf("Loaded %d queued MQTT messages from %s", len(q.messages), q.path)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open offline queue: %w", err)
+	}
+
+	if err := q.rewrite(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// rewrite replaces the queue file with the messages still queued
+func (q *OfflineQueue) rewrite() error {
+	if q.path == "" {
+		return nil
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+
+	file, err := os.Create(q.path)
+	if err != nil {
+		return fmt.Errorf("failed to create offline queue: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	for _, msg := range q.messages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write offline queue: %w", err)
+	}
+	q.file = file
+	return nil
+}
+
+// Push queues a message, dropping the oldest one when the queue is full
+func (q *OfflineQueue) Push(msg queuedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) >= q.max {
+		q.messages = q.messages[1:]
+		q.Dropped++
+	}
+	q.messages = append(q.messages, msg)
+
+	if q.file != nil {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := q.file.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("failed to append to offline queue: %w", err)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of queued messages
+func (q *OfflineQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// Drain publishes queued messages in order until the queue is empty or publishing
+// fails, and returns the number of messages sent
+func (q *OfflineQueue) Drain(publish func(msg queuedMessage) error) (int, error) {
+	sent := 0
+	var err error
+	for {
+		q.mu.Lock()
+		if len(q.messages) == 0 {
+			q.mu.Unlock()
+			break
+		}
+		msg := q.messages[0]
+		q.mu.Unlock()
+
+		if err = publish(msg); err != nil {
+			break
+		}
+
+		q.mu.Lock()
+		q.messages = q.messages[1:]
+		q.mu.Unlock()
+		sent++
+	}
+
+	if sent > 0 {
+		q.mu.Lock()
+		if rewriteErr := q.rewrite(); rewriteErr != nil && err == nil {
+			err = rewriteErr
+		}
+		q.mu.Unlock()
+	}
+	return sent, err
+}
+
+// Close closes the queue file; queued messages stay in it for the next run
+func (q *OfflineQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+// MQTTPublisher publishes through a paho client and queues messages while the
+// connection is down, replaying them in order after paho reconnects, or from the next
+// publish when messages are still queued on an open connection
+type MQTTPublisher struct {
+	Client mqtt.Client
+	Queue  *OfflineQueue
+	will   WillConfig
+	drain  sync.Mutex // held while the offline queue is replayed
+	// after a failed replay, publishes retry it from this time on; guarded by drain
+	nextDrain time.Time
+
+	connectTimeout time.Duration
+	inflight       *InflightLimiter // bounds asynchronous publishes; nil publishes synchronously
+}
+
+// drainRetryInterval is how long publishes wait before replaying the offline queue
+// again after a replay failed on an open connection
+const drainRetryInterval = time.Second
+
+// errPublishDropped is reported for messages discarded because too many were in flight
+var errPublishDropped = errors.New("too many publishes in flight, message dropped")
+
+// InflightLimiter bounds the number of unacknowledged MQTT publishes across all
+// connections and waits for their acknowledgements in the background
+type InflightLimiter struct {
+	slots chan struct{}
+	drop  bool // discard messages when full instead of waiting for a slot
+
+	peak    atomic.Int64 // most publishes in flight at once
+	dropped atomic.Int64
+}
+
+// NewInflightLimiter allows max unacknowledged publishes. With drop, a publish that
+// finds every slot taken is discarded; otherwise it waits for a slot.
+func NewInflightLimiter(max int, drop bool) *InflightLimiter {
+	return &InflightLimiter{slots: make(chan struct{}, max), drop: drop}
+}
+
+// acquire takes a slot, or reports false when the message must be dropped
+func (l *InflightLimiter) acquire() bool {
+	if l.drop {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			l.dropped.Add(1)
+			return false
+		}
+	} else {
+		l.slots <- struct{}{}
+	}
+	inflight := int64(len(l.slots))
+	for peak := l.peak.Load(); inflight > peak && !l.peak.CompareAndSwap(peak, inflight); peak = l.peak.Load() {
+	}
+	return true
+}
+
+// release frees a slot
+func (l *InflightLimiter) release() {
+	<-l.slots
+}
+
+// Inflight returns the number of publishes waiting for an acknowledgement
+func (l *InflightLimiter) Inflight() int {
+	return len(l.slots)
+}
+
+// Peak returns the most publishes that were in flight at once
+func (l *InflightLimiter) Peak() int64 {
+	return l.peak.Load()
+}
+
+// Dropped returns the number of messages discarded because every slot was taken or,
+// for HTTP sinks, the request queue was full
+func (l *InflightLimiter) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// Wait blocks until no publish is in flight or the timeout has passed
+func (l *InflightLimiter) Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for len(l.slots) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Publish sends a message, or queues it while disconnected. Messages are also queued
+// while a backlog is draining, so they never overtake older ones.
+func (p *MQTTPublisher) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	msg := queuedMessage{Topic: topic, QoS: qos, Retain: retain, Payload: payload}
+	if !p.Client.IsConnectionOpen() || p.Queue.Len() > 0 {
+		err := p.Queue.Push(msg)
+		p.retryDrain()
+		return err
+	}
+
+	if err := p.send(msg); err != nil {
+		if !p.Client.IsConnectionOpen() {
+			return p.Queue.Push(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// PublishAsync sends a message without waiting for the broker and calls done with the
+// result once it is acknowledged, queued or dropped. Without an in-flight limiter it
+// behaves like Publish.
+func (p *MQTTPublisher) PublishAsync(topic string, qos byte, retain bool, payload []byte, done func(error)) {
+	if p.inflight == nil {
+		done(p.Publish(topic, qos, retain, payload))
+		return
+	}
+
+	msg := queuedMessage{Topic: topic, QoS: qos, Retain: retain, Payload: payload}
+	if !p.Client.IsConnectionOpen() || p.Queue.Len() > 0 {
+		err := p.Queue.Push(msg)
+		p.retryDrain()
+		done(err)
+		return
+	}
+	if !p.inflight.acquire() {
+		done(errPublishDropped)
+		return
+	}
+
+	token := p.Client.Publish(topic, qos, retain, payload)
+	go func() {
+		<-token.Done()
+		p.inflight.release()
+		err := token.Error()
+		if err != nil && !p.Client.IsConnectionOpen() {
+			err = p.Queue.Push(msg)
+		}
+		done(err)
+	}()
+}
+
+// send publishes a message and waits for the broker acknowledgement required by its QoS
+func (p *MQTTPublisher) send(msg queuedMessage) error {
+	token := p.Client.Publish(msg.Topic, msg.QoS, msg.Retain, msg.Payload)
+	token.Wait()
+	return token.Error()
+}
+
+// onConnect announces the simulator and replays the offline queue
+func (p *MQTTPublisher) onConnect(client mqtt.Client) {
+	if p.will.Topic != "" && p.will.OnlinePayload != "" {
+		token := client.Publish(p.will.Topic, byte(p.will.QoS), *p.will.Retain, p.will.OnlinePayload)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Failed to publish online status: %v", token.Error())
+		}
+	}
+
+	p.drain.Lock()
+	defer p.drain.Unlock()
+	p.drainQueue()
+}
+
+// retryDrain replays the offline queue in the background when messages are still
+// queued on an open connection, e.g. after a replay failed or a message was queued
+// while the connection came back. At most one replay runs at a time.
+func (p *MQTTPublisher) retryDrain() {
+	if !p.Client.IsConnectionOpen() || !p.drain.TryLock() {
+		return
+	}
+	if p.Queue.Len() == 0 || time.Now().Before(p.nextDrain) {
+		p.drain.Unlock()
+		return
+	}
+	go func() {
+		defer p.drain.Unlock()
+		p.drainQueue()
+	}()
+}
+
+// drainQueue replays the offline queue in order. The caller holds drain.
+func (p *MQTTPublisher) drainQueue() {
+	if p.Queue.Len() == 0 {
+		return
+	}
+	sent, err := p.Queue.Drain(p.send)
+	if err != nil {
+		p.nextDrain = time.Now().Add(drainRetryInterval)
+		log.Printf("Replayed %d queued MQTT messages before failing: %v", sent, err)
+		return
+	}
+	p.nextDrain = time.Time{}
+	log.Printf("Replayed %d queued MQTT messages", sent)
+}
+
+// Close announces a clean shutdown, disconnects and closes the queue
+func (p *MQTTPublisher) Close() {
+	if p.Client.IsConnectionOpen() && p.will.Topic != "" {
+		token := p.Client.Publish(p.will.Topic, byte(p.will.QoS), *p.will.Retain, p.will.OfflinePayload)
+		token.WaitTimeout(time.Second)
+	}
+	p.Client.Disconnect(250)
+	if pending := p.Queue.Len(); pending > 0 {
+		log.Printf("Warning: %d MQTT messages still queued at shutdown", pending)
+	}
+	if err := p.Queue.Close(); err != nil {
+		log.Printf("Failed to close offline queue: %v", err)
+	}
+}
+
+// connectMQTT creates a publisher for the broker and waits up to connect_timeout for
+// the first connection. Connection failures are not fatal: paho keeps retrying in the
+// background, reconnects with exponential backoff after the connection drops, and
+// messages are queued until it succeeds.
+func connectMQTT(cfg MQTTConfig) (*MQTTPublisher, error) {
+	publisher, err := newMQTTPublisher(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	token := publisher.Client.Connect()
+	if !token.WaitTimeout(publisher.connectTimeout) {
+		log.Printf("Warning: MQTT broker at %s not reachable yet, queueing messages while retrying", cfg.Broker)
+	} else if token.Error() != nil {
+		publisher.Queue.Close()
+		return nil, token.Error()
+	}
+	return publisher, nil
+}
+
+// newMQTTPublisher creates a publisher whose client is configured but not yet connected;
+// messages published before Client.Connect is called are queued
+func newMQTTPublisher(cfg MQTTConfig) (*MQTTPublisher, error) {
+	queue, err := NewOfflineQueue(cfg.OfflineQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	will := cfg.Will
+	will.Topic = strings.ReplaceAll(will.Topic, "{client_id}", cfg.ClientID)
+	will.OnlinePayload = strings.ReplaceAll(will.OnlinePayload, "{client_id}", cfg.ClientID)
+	will.OfflinePayload = strings.ReplaceAll(will.OfflinePayload, "{client_id}", cfg.ClientID)
+	if will.Retain == nil {
+		retain := true
+		will.Retain = &retain
+	}
+	if will.OfflinePayload == "" {
+		will.OfflinePayload = fmt.Sprintf(`{"client_id":%q,"status":"offline"}`, cfg.ClientID)
+	}
+	if will.OnlinePayload == "" {
+		will.OnlinePayload = fmt.Sprintf(`{"client_id":%q,"status":"online"}`, cfg.ClientID)
+	}
+	if will.QoS < 0 || will.QoS > 2 {
+		return nil, fmt.Errorf("invalid will QoS %d: must be 0, 1 or 2", will.QoS)
+	}
+	publisher := &MQTTPublisher{Queue: queue, will: will}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(cfg.Broker)
+	opts.SetClientID(cfg.ClientID)
+	opts.SetCleanSession(true)
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	if cfg.TLS.Enabled() {
+		if !strings.HasPrefix(cfg.Broker, "ssl://") && !strings.HasPrefix(cfg.Broker, "tls://") &&
+			!strings.HasPrefix(cfg.Broker, "mqtts://") && !strings.HasPrefix(cfg.Broker, "wss://") {
+			log.Printf("Warning: TLS is configured but broker %s does not use ssl://, tls://, mqtts:// or wss://", cfg.Broker)
+		}
+		tlsConfig, err := loadTLSConfig(cfg.TLS)
+		if err != nil {
+			queue.Close()
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if will.Topic != "" {
+		opts.SetWill(will.Topic, will.OfflinePayload, byte(will.QoS), *will.Retain)
+	}
+
+	connectTimeout := parseDuration(cfg.ConnectTimeout, 10*time.Second)
+	opts.SetConnectTimeout(connectTimeout)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(parseDuration(cfg.ConnectRetryInterval, 5*time.Second))
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(parseDuration(cfg.MaxReconnectInterval, 2*time.Minute))
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if !cfg.Quiet {
+			log.Printf("Connected to MQTT broker at %s", cfg.Broker)
+		}
+		publisher.onConnect(client)
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		log.Printf("%s lost connection to MQTT broker: %v (queueing messages while reconnecting)", cfg.ClientID, err)
+	})
+	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		if !cfg.Quiet {
+			log.Printf("Reconnecting to MQTT broker at %s", cfg.Broker)
+		}
+	})
+
+	publisher.Client = mqtt.NewClient(opts)
+	publisher.connectTimeout = connectTimeout
+	return publisher, nil
+}
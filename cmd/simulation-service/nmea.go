@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// kmhPerKnot converts telemetry speeds, which are km/h, to knots
+	kmhPerKnot = 1.852
+	// nmeaUERE is the assumed user equivalent range error in meters, relating the
+	// reported accuracy to HDOP
+	nmeaUERE = 5.0
+)
+
+// nmeaChecksum returns the XOR of all characters between '$' and '*'
+func nmeaChecksum(body string) byte {
+	var checksum byte
+	for i := 0; i < len(body); i++ {
+		checksum ^= body[i]
+	}
+	return checksum
+}
+
+// nmeaSentence wraps a sentence body in '$' and its checksum
+func nmeaSentence(body string) string {
+	return fmt.Sprintf("$%s*%02X", body, nmeaChecksum(body))
+}
+
+// nmeaCoordinate formats a coordinate as (d)ddmm.mmmm with its hemisphere
+func nmeaCoordinate(value float64, degreeDigits int, positive, negative string) string {
+	hemisphere := positive
+	if value < 0 {
+		hemisphere = negative
+		value = -value
+	}
+	degrees := math.Floor(value)
+	minutes := (value - degrees) * 60
+	// Carry rounding overflow (59.99995 minutes) into the degrees
+	if minutes >= 59.99995 {
+		degrees++
+		minutes = 0
+	}
+	return fmt.Sprintf("%0*d%07.4f,%s", degreeDigits, int(degrees), minutes, hemisphere)
+}
+
+// nmeaHDOP derives the horizontal dilution of precision from the reported accuracy
+func nmeaHDOP(accuracy float64) float64 {
+	if accuracy <= 0 {
+		return 1.0
+	}
+	return math.Max(0.5, math.Min(99.9, accuracy/nmeaUERE))
+}
+
+// nmeaSatellites estimates the number of satellites in use from HDOP
+func nmeaSatellites(hdop float64) int {
+	return int(math.Max(4, math.Min(12, math.Round(13-2*hdop))))
+}
+
+// EncodeNMEA turns a telemetry record into $GPRMC, $GPGGA and $GPVTG sentences
+// without line terminators
+func EncodeNMEA(t *Telemetry) []string {
+	timestamp := time.Unix(t.Timestamp, 0).UTC()
+	utc := timestamp.Format("150405.00")
+	date := timestamp.Format("020106")
+	lat := nmeaCoordinate(t.Lat, 2, "N", "S")
+	lon := nmeaCoordinate(t.Lon, 3, "E", "W")
+	kmh := t.Speed
+	knots := kmh / kmhPerKnot
+	course := math.Mod(t.Heading+360, 360)
+	hdop := nmeaHDOP(t.Accuracy)
+
+	return []string{
+		nmeaSentence(fmt.Sprintf("GPRMC,%s,A,%s,%s,%.1f,%.1f,%s,,,A",
+			utc, lat, lon, knots, course, date)),
+		nmeaSentence(fmt.Sprintf("GPGGA,%s,%s,%s,1,%02d,%.1f,%.1f,M,0.0,M,,",
+			utc, lat, lon, nmeaSatellites(hdop), hdop, t.Altitude)),
+		nmeaSentence(fmt.Sprintf("GPVTG,%.1f,T,,M,%.1f,N,%.1f,K,A",
+			course, knots, kmh)),
+	}
+}
+
+// nmeaTagBlock returns an NMEA 4.10 tag block naming the vehicle as the source, so
+// multiplexed streams stay attributable
+func nmeaTagBlock(vehicleID int) string {
+	body := fmt.Sprintf("s:vehicle_%d", vehicleID)
+	return fmt.Sprintf("\\%s*%02X\\", body, nmeaChecksum(body))
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestEncodeNMEA(t *testing.T) {
+	record := &Telemetry{
+		Timestamp: 1700000000, // 2023-11-14 22:13:20 UTC
+		Lat:       52.5,
+		Lon:       -13.25,
+		Speed:     55.56, // km/h, 30 knots
+		Heading:   90,
+		Altitude:  34,
+		Accuracy:  5,
+	}
+	want := []string{
+		"$GPRMC,221320.00,A,5230.0000,N,01315.0000,W,30.0,90.0,141123,,,A*40",
+		"$GPGGA,221320.00,5230.0000,N,01315.0000,W,1,11,1.0,34.0,M,0.0,M,,*7A",
+		"$GPVTG,90.0,T,,M,30.0,N,55.6,K,A*31",
+	}
+
+	got := EncodeNMEA(record)
+	if len(got) != len(want) {
+		t.Fatalf("EncodeNMEA returned %d sentences, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("sentence %d:\n got %s\nwant %s", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// runOffline runs every vehicle from departure to arrival as fast as possible
+// on a stepped clock and writes the telemetry to files instead of MQTT
+func runOffline(config *Config, routes []*Route) error {
+	writer, err := NewFileTelemetryWriter(config.Output)
+	if err != nil {
+		return err
+	}
+
+	start := simulationStart(config)
+	clock := NewSteppedClock(start)
+	simulators := createSimulators(routes, config, clock)
+	if _, err := setupDepartures(config, simulators, start); err != nil {
+		writer.Close()
+		return fmt.Errorf("invalid departure schedule: %w", err)
+	}
+	faults, err := setupFaults(config, simulators, []string{writer.Format})
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	updateInterval := parseDuration(config.Simulation.UpdateInterval, 5*time.Second)
+	maxDuration := parseDuration(config.Output.MaxDuration, 0)
+
+	// Without a time cap, only retiring at arrival lets the run finish
+	if maxDuration == 0 {
+		for _, simulator := range simulators {
+			if simulator.Arrival.Action != ArrivalRetire {
+				log.Printf("end_of_route action %q needs output.max_duration in file mode; retiring vehicles at arrival",
+					simulator.Arrival.Action)
+				break
+			}
+		}
+		for _, simulator := range simulators {
+			simulator.Arrival.Action = ArrivalRetire
+			// A vehicle without a departure would never finish
+			if simulator.Waiting && simulator.Departures.Next.IsZero() {
+				simulator.Retired = true
+			}
+		}
+	}
+
+	log.Printf("Running offline simulation of %d vehicles (update interval: %s, format: %s, split: %s, directory: %s)",
+		len(simulators), updateInterval, writer.Format, writer.Split, writer.Directory)
+	wallStart := time.Now()
+
+	active := 0
+	for _, simulator := range simulators {
+		if !simulator.Retired {
+			active++
+		}
+	}
+	simulationTime := clock.Now()
+	for active > 0 {
+		if maxDuration > 0 && simulationTime.Sub(start) > maxDuration {
+			log.Printf("Reached max_duration %s with %d vehicles still active", maxDuration, active)
+			break
+		}
+
+		for _, simulator := range simulators {
+			if simulator.Retired {
+				continue
+			}
+
+			for _, telemetry := range generateTelemetry(simulator, config, simulationTime) {
+				if err := writer.Write(&telemetry); err != nil {
+					writer.Close()
+					return err
+				}
+			}
+			for _, event := range simulator.TakeEvents() {
+				if err := writer.WriteEvent(&event); err != nil {
+					writer.Close()
+					return err
+				}
+			}
+
+			if simulator.Retired {
+				active--
+			}
+		}
+
+		simulationTime = clock.Advance(updateInterval)
+	}
+
+	// Vehicles cut off by max_duration upload what they still buffer
+	for _, simulator := range simulators {
+		for _, telemetry := range flushBuffered(simulator, simulationTime) {
+			if err := writer.Write(&telemetry); err != nil {
+				writer.Close()
+				return err
+			}
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close output: %w", err)
+	}
+	if faults != nil {
+		if err := faults.Close(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Offline simulation complete: %d records in %d files, %s simulated in %s",
+		writer.recordsTotal, writer.filesWritten, simulationTime.Sub(start).Round(time.Second),
+		time.Since(wallStart).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// PayloadEncoding is the serialization of telemetry, batch and event payloads
+type PayloadEncoding string
+
+// Supported payload encodings. Protobuf follows telemetry.proto; CBOR and MessagePack
+// encode maps with the JSON keys.
+const (
+	EncodingJSON     PayloadEncoding = "json"
+	EncodingProtobuf PayloadEncoding = "protobuf"
+	EncodingCBOR     PayloadEncoding = "cbor"
+	EncodingMsgPack  PayloadEncoding = "msgpack"
+)
+
+// parsePayloadEncoding validates an encoding name; empty means JSON
+func parsePayloadEncoding(name string) (PayloadEncoding, error) {
+	switch encoding := PayloadEncoding(name); encoding {
+	case "":
+		return EncodingJSON, nil
+	case EncodingJSON, EncodingProtobuf, EncodingCBOR, EncodingMsgPack:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("unknown payload encoding %q: must be json, protobuf, cbor or msgpack", name)
+	}
+}
+
+// ContentType returns the MIME type of the encoding
+func (e PayloadEncoding) ContentType() string {
+	switch e {
+	case EncodingProtobuf:
+		return "application/x-protobuf"
+	case EncodingCBOR:
+		return "application/cbor"
+	case EncodingMsgPack:
+		return "application/msgpack"
+	default:
+		return "application/json"
+	}
+}
+
+// TopicSuffix is appended to MQTT topics so subscribers can tell the encodings apart.
+// MQTT 3.1.1 has no user properties to carry a content type; JSON topics keep their names.
+func (e PayloadEncoding) TopicSuffix() string {
+	if e == EncodingJSON || e == "" {
+		return ""
+	}
+	return "/" + string(e)
+}
+
+// Marshal encodes a Telemetry, BatchTelemetry or VehicleEvent
+func (e PayloadEncoding) Marshal(message payloadMessage) ([]byte, error) {
+	// Injected payload faults corrupt their records, sent alone or in a batch
+	if faulty := faultyRecords(message); len(faulty) > 0 {
+		return e.marshalFault(message, faulty)
+	}
+	return e.marshal(message)
+}
+
+// marshal encodes a message without patching payload faults into JSON
+func (e PayloadEncoding) marshal(message payloadMessage) ([]byte, error) {
+	switch e {
+	case EncodingProtobuf:
+		return appendProtobuf(nil, message.payloadFields()), nil
+	case EncodingCBOR:
+		return appendCBOR(nil, message.payloadFields()), nil
+	case EncodingMsgPack:
+		return appendMsgPack(nil, message.payloadFields()), nil
+	default:
+		return json.Marshal(message)
+	}
+}
+
+// payloadMessage is a payload the binary encodings can serialize
+type payloadMessage interface {
+	payloadFields() []payloadField
+}
+
+// payloadField is one field of a payload in JSON key order. Fields JSON omits when
+// empty are left out; protobuf additionally skips zero values unless presence is set.
+type payloadField struct {
+	number   int         // protobuf field number in telemetry.proto
+	key      string      // JSON, CBOR and MessagePack key
+	value    interface{} // int64, float64, string, bool or []payloadMessage
+	presence bool        // proto3 optional field
+}
+
+// payloadFields lists the telemetry fields
+func (t *Telemetry) payloadFields() []payloadField {
+	fields := []payloadField{
+		{number: 1, key: "vehicle_id", value: int64(t.VehicleID)},
+		{number: 2, key: "timestamp", value: t.Timestamp},
+		{number: 3, key: "lat", value: t.Lat},
+		{number: 4, key: "lon", value: t.Lon},
+		{number: 5, key: "spd", value: t.Speed},
+		{number: 6, key: "hdg", value: t.Heading},
+		{number: 7, key: "alt", value: t.Altitude},
+		{number: 8, key: "acc", value: t.Accuracy},
+		{number: 9, key: "battery", value: t.Battery},
+		{number: 10, key: "signal", value: t.Signal},
+	}
+	if t.Fuel != nil {
+		fields = append(fields, payloadField{number: 11, key: "fuel", value: *t.Fuel, presence: true})
+	}
+	fields = append(fields,
+		payloadField{number: 12, key: "odometer", value: t.Odometer},
+		payloadField{number: 13, key: "engine_hours", value: t.EngineHours})
+	if t.Replayed {
+		fields = append(fields, payloadField{number: 14, key: "replayed", value: true})
+	}
+	if t.fault != nil {
+		fields = t.fault.applyFields(fields)
+	}
+	return fields
+}
+
+// payloadFields lists the batch fields with the telemetry as nested messages
+func (b *BatchTelemetry) payloadFields() []payloadField {
+	vehicles := make([]payloadMessage, len(b.Vehicles))
+	for i := range b.Vehicles {
+		vehicles[i] = &b.Vehicles[i]
+	}
+	return []payloadField{
+		{number: 1, key: "batch_id", value: b.BatchID},
+		{number: 2, key: "timestamp", value: b.Timestamp},
+		{number: 3, key: "vehicles", value: vehicles},
+		{number: 4, key: "batch_size", value: int64(b.BatchSize)},
+	}
+}
+
+// payloadFields lists the event fields
+func (e *VehicleEvent) payloadFields() []payloadField {
+	fields := []payloadField{
+		{number: 1, key: "vehicle_id", value: int64(e.VehicleID)},
+		{number: 2, key: "timestamp", value: e.Timestamp},
+		{number: 3, key: "type", value: e.Type},
+		{number: 4, key: "route_id", value: int64(e.RouteID)},
+		{number: 5, key: "trip", value: int64(e.Trip)},
+		{number: 6, key: "lat", value: e.Lat},
+		{number: 7, key: "lon", value: e.Lon},
+	}
+	if e.Reversed {
+		fields = append(fields, payloadField{number: 8, key: "reversed", value: true})
+	}
+	if e.Alarm != "" {
+		fields = append(fields, payloadField{number: 9, key: "alarm", value: e.Alarm})
+	}
+	return fields
+}
+
+// appendProtobuf encodes fields in the protobuf wire format
+func appendProtobuf(buf []byte, fields []payloadField) []byte {
+	tag := func(buf []byte, number int, wireType uint64) []byte {
+		return binary.AppendUvarint(buf, uint64(number)<<3|wireType)
+	}
+	for _, field := range fields {
+		switch value := field.value.(type) {
+		case int64:
+			if value != 0 || field.presence {
+				buf = binary.AppendUvarint(tag(buf, field.number, 0), uint64(value))
+			}
+		case float64:
+			if value != 0 || field.presence {
+				buf = binary.LittleEndian.AppendUint64(tag(buf, field.number, 1), math.Float64bits(value))
+			}
+		case string:
+			if value != "" || field.presence {
+				buf = binary.AppendUvarint(tag(buf, field.number, 2), uint64(len(value)))
+				buf = append(buf, value...)
+			}
+		case bool:
+			if value || field.presence {
+				buf = append(tag(buf, field.number, 0), 1)
+			}
+		case []payloadMessage:
+			for _, message := range value {
+				nested := appendProtobuf(nil, message.payloadFields())
+				buf = binary.AppendUvarint(tag(buf, field.number, 2), uint64(len(nested)))
+				buf = append(buf, nested...)
+			}
+		}
+	}
+	return buf
+}
+
+// appendCBORHead appends a CBOR data item head with the shortest argument encoding
+func appendCBORHead(buf []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(buf, major<<5|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major<<5|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major<<5|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major<<5|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major<<5|27), n)
+	}
+}
+
+// appendCBOR encodes fields as a CBOR map. Floats that fit a float32 exactly are
+// stored in 4 bytes.
+func appendCBOR(buf []byte, fields []payloadField) []byte {
+	buf = appendCBORHead(buf, 5, uint64(len(fields)))
+	for _, field := range fields {
+		buf = appendCBORHead(buf, 3, uint64(len(field.key)))
+		buf = append(buf, field.key...)
+
+		switch value := field.value.(type) {
+		case int64:
+			if value >= 0 {
+				buf = appendCBORHead(buf, 0, uint64(value))
+			} else {
+				buf = appendCBORHead(buf, 1, uint64(-1-value))
+			}
+		case float64:
+			if float64(float32(value)) == value {
+				buf = binary.BigEndian.AppendUint32(append(buf, 0xFA), math.Float32bits(float32(value)))
+			} else {
+				buf = binary.BigEndian.AppendUint64(append(buf, 0xFB), math.Float64bits(value))
+			}
+		case string:
+			buf = appendCBORHead(buf, 3, uint64(len(value)))
+			buf = append(buf, value...)
+		case bool:
+			if value {
+				buf = append(buf, 0xF5)
+			} else {
+				buf = append(buf, 0xF4)
+			}
+		case []payloadMessage:
+			buf = appendCBORHead(buf, 4, uint64(len(value)))
+			for _, message := range value {
+				buf = appendCBOR(buf, message.payloadFields())
+			}
+		}
+	}
+	return buf
+}
+
+// appendMsgPackHead appends a MessagePack string, array or map header using the fix
+// format when n fits
+func appendMsgPackHead(buf []byte, fix byte, fixMax int, formats [3]byte, n int) []byte {
+	switch {
+	case n <= fixMax:
+		return append(buf, fix|byte(n))
+	case n <= math.MaxUint8 && formats[0] != 0:
+		return append(buf, formats[0], byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, formats[1]), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, formats[2]), uint32(n))
+	}
+}
+
+// appendMsgPackString appends a str value
+func appendMsgPackString(buf []byte, s string) []byte {
+	buf = appendMsgPackHead(buf, 0xA0, 31, [3]byte{0xD9, 0xDA, 0xDB}, len(s))
+	return append(buf, s...)
+}
+
+// appendMsgPackInt appends an integer in the smallest format
+func appendMsgPackInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= math.MaxInt8:
+		return append(buf, byte(n))
+	case n >= -32 && n < 0:
+		return append(buf, byte(int8(n)))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(buf, 0xCC, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xCD), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xCE), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(buf, 0xCF), uint64(n))
+	case n >= math.MinInt8:
+		return append(buf, 0xD0, byte(int8(n)))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xD1), uint16(int16(n)))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xD2), uint32(int32(n)))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xD3), uint64(n))
+	}
+}
+
+// appendMsgPack encodes fields as a MessagePack map. Floats that fit a float32 exactly
+// are stored in 4 bytes.
+func appendMsgPack(buf []byte, fields []payloadField) []byte {
+	buf = appendMsgPackHead(buf, 0x80, 15, [3]byte{0, 0xDE, 0xDF}, len(fields))
+	for _, field := range fields {
+		buf = appendMsgPackString(buf, field.key)
+
+		switch value := field.value.(type) {
+		case int64:
+			buf = appendMsgPackInt(buf, value)
+		case float64:
+			if float64(float32(value)) == value {
+				buf = binary.BigEndian.AppendUint32(append(buf, 0xCA), math.Float32bits(float32(value)))
+			} else {
+				buf = binary.BigEndian.AppendUint64(append(buf, 0xCB), math.Float64bits(value))
+			}
+		case string:
+			buf = appendMsgPackString(buf, value)
+		case bool:
+			if value {
+				buf = append(buf, 0xC3)
+			} else {
+				buf = append(buf, 0xC2)
+			}
+		case []payloadMessage:
+			buf = appendMsgPackHead(buf, 0x90, 15, [3]byte{0, 0xDC, 0xDD}, len(value))
+			for _, message := range value {
+				buf = appendMsgPack(buf, message.payloadFields())
+			}
+		}
+	}
+	return buf
+}
+
+// payloadTypes returns an empty message of a decode tool type and a sample with every
+// field present, which describes the protobuf schema
+func payloadTypes(name string) (interface{}, payloadMessage, error) {
+	fuel := 0.0
+	switch name {
+	case "", "telemetry":
+		return &Telemetry{}, &Telemetry{Fuel: &fuel, Replayed: true}, nil
+	case "batch":
+		return &BatchTelemetry{}, &BatchTelemetry{Vehicles: []Telemetry{{Fuel: &fuel, Replayed: true}}}, nil
+	case "event":
+		return &VehicleEvent{}, &VehicleEvent{Reversed: true, Alarm: "panic"}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown message type %q: must be telemetry, batch or event", name)
+	}
+}
+
+// DecodePayload decodes a payload into a Telemetry, BatchTelemetry or VehicleEvent.
+// Binary payloads are decoded generically and then converted through JSON, so
+// unexpected keys and mistyped values are reported.
+func DecodePayload(encoding PayloadEncoding, messageType string, data []byte) (interface{}, error) {
+	message, sample, err := payloadTypes(messageType)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	switch encoding {
+	case EncodingProtobuf:
+		generic, err = decodeProtobuf(data, sample)
+	case EncodingCBOR:
+		generic, err = decodeComplete(data, decodeCBOR)
+	case EncodingMsgPack:
+		generic, err = decodeComplete(data, decodeMsgPack)
+	default:
+		generic, err = decodeComplete(data, func(data []byte) (interface{}, []byte, error) {
+			return json.RawMessage(data), nil, nil
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s payload: %w", encoding, err)
+	}
+
+	intermediate, err := json.Marshal(generic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s payload: %w", encoding, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(intermediate))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(message); err != nil {
+		return nil, fmt.Errorf("payload is not a valid %s message: %w", messageType, err)
+	}
+	return message, nil
+}
+
+// decodeComplete decodes one item and rejects trailing bytes
+func decodeComplete(data []byte, decode func([]byte) (interface{}, []byte, error)) (interface{}, error) {
+	value, rest, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(rest))
+	}
+	return value, nil
+}
+
+// decodeProtobuf decodes a message using the field numbers and types of a sample.
+// Unknown fields are skipped, as protobuf readers do.
+func decodeProtobuf(data []byte, sample payloadMessage) (map[string]interface{}, error) {
+	fields := make(map[int]payloadField)
+	for _, field := range sample.payloadFields() {
+		fields[field.number] = field
+	}
+
+	result := make(map[string]interface{})
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid field tag")
+		}
+		data = data[n:]
+		field, known := fields[int(tag>>3)]
+
+		switch wireType := tag & 7; wireType {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid varint in field %d", tag>>3)
+			}
+			data = data[n:]
+			if _, isBool := field.value.(bool); isBool {
+				result[field.key] = value != 0
+			} else if known {
+				result[field.key] = int64(value)
+			}
+		case 1:
+			if len(data) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if known {
+				result[field.key] = math.Float64frombits(binary.LittleEndian.Uint64(data))
+			}
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, fmt.Errorf("invalid length of field %d", tag>>3)
+			}
+			chunk := data[n : n+int(length)]
+			data = data[n+int(length):]
+			switch value := field.value.(type) {
+			case string:
+				result[field.key] = string(chunk)
+			case []payloadMessage:
+				nested, err := decodeProtobuf(chunk, value[0])
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", field.key, err)
+				}
+				list, _ := result[field.key].([]interface{})
+				result[field.key] = append(list, nested)
+			}
+		case 5:
+			if len(data) < 4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			data = data[4:]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d in field %d", wireType, tag>>3)
+		}
+	}
+	return result, nil
+}
+
+// decodeCBOR decodes one definite-length CBOR item and returns the remaining bytes
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	major, info := data[0]>>5, data[0]&0x1F
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		case 25:
+			if len(data) < 2 {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			return float16ToFloat64(binary.BigEndian.Uint16(data)), data[2:], nil
+		case 26:
+			if len(data) < 4 {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+		case 27:
+			if len(data) < 8 {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+		default:
+			return nil, nil, fmt.Errorf("unsupported simple value %d", info)
+		}
+	}
+
+	// Argument of the other major types
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("unsupported additional information %d (indefinite lengths are not supported)", info)
+	}
+
+	switch major {
+	case 0:
+		return n, data, nil
+	case 1:
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if uint64(len(data)) < n {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		if major == 2 {
+			return data[:n], data[n:], nil
+		}
+		return string(data[:n]), data[n:], nil
+	case 4:
+		list := make([]interface{}, 0, min(n, uint64(len(data))))
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			var err error
+			if item, data, err = decodeCBOR(data); err != nil {
+				return nil, nil, err
+			}
+			list = append(list, item)
+		}
+		return list, data, nil
+	case 5:
+		result := make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			var key, value interface{}
+			var err error
+			if key, data, err = decodeCBOR(data); err != nil {
+				return nil, nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("map key %v is not a string", key)
+			}
+			if value, data, err = decodeCBOR(data); err != nil {
+				return nil, nil, err
+			}
+			result[name] = value
+		}
+		return result, data, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported major type %d", major)
+	}
+}
+
+// float16ToFloat64 converts an IEEE 754 half-precision value
+func float16ToFloat64(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exponent, fraction := int(h>>10&0x1F), float64(h&0x3FF)
+	switch exponent {
+	case 0:
+		return sign * math.Ldexp(fraction, -24)
+	case 0x1F:
+		if fraction == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	default:
+		return sign * math.Ldexp(fraction+1024, exponent-25)
+	}
+}
+
+// decodeMsgPack decodes one MessagePack item and returns the remaining bytes
+func decodeMsgPack(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	format := data[0]
+	data = data[1:]
+
+	// read returns the next size bytes as a big-endian integer
+	read := func(size int) (uint64, error) {
+		if len(data) < size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		var n uint64
+		for _, b := range data[:size] {
+			n = n<<8 | uint64(b)
+		}
+		data = data[size:]
+		return n, nil
+	}
+	// container decodes n items of an array or n key/value pairs of a map
+	container := func(n uint64, isMap bool) (interface{}, []byte, error) {
+		list := make([]interface{}, 0)
+		result := make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			var err error
+			if item, data, err = decodeMsgPack(data); err != nil {
+				return nil, nil, err
+			}
+			if !isMap {
+				list = append(list, item)
+				continue
+			}
+			name, ok := item.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("map key %v is not a string", item)
+			}
+			if item, data, err = decodeMsgPack(data); err != nil {
+				return nil, nil, err
+			}
+			result[name] = item
+		}
+		if isMap {
+			return result, data, nil
+		}
+		return list, data, nil
+	}
+	// bytesOf returns the next n bytes
+	bytesOf := func(n uint64) ([]byte, error) {
+		if uint64(len(data)) < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+		value := data[:n]
+		data = data[n:]
+		return value, nil
+	}
+
+	var n uint64
+	var err error
+	switch {
+	case format <= 0x7F:
+		return int64(format), data, nil
+	case format >= 0xE0:
+		return int64(int8(format)), data, nil
+	case format&0xF0 == 0x80:
+		return container(uint64(format&0x0F), true)
+	case format&0xF0 == 0x90:
+		return container(uint64(format&0x0F), false)
+	case format&0xE0 == 0xA0:
+		value, err := bytesOf(uint64(format & 0x1F))
+		return string(value), data, err
+	}
+
+	switch format {
+	case 0xC0:
+		return nil, data, nil
+	case 0xC2:
+		return false, data, nil
+	case 0xC3:
+		return true, data, nil
+	case 0xC4, 0xC5, 0xC6: // bin 8/16/32
+		if n, err = read(1 << (format - 0xC4)); err != nil {
+			return nil, nil, err
+		}
+		value, err := bytesOf(n)
+		return value, data, err
+	case 0xCA:
+		n, err = read(4)
+		return float64(math.Float32frombits(uint32(n))), data, err
+	case 0xCB:
+		n, err = read(8)
+		return math.Float64frombits(n), data, err
+	case 0xCC, 0xCD, 0xCE, 0xCF: // uint 8/16/32/64
+		n, err = read(1 << (format - 0xCC))
+		return n, data, err
+	case 0xD0, 0xD1, 0xD2, 0xD3: // int 8/16/32/64
+		size := 1 << (format - 0xD0)
+		n, err = read(size)
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, data, err
+	case 0xD9, 0xDA, 0xDB: // str 8/16/32
+		if n, err = read(1 << (format - 0xD9)); err != nil {
+			return nil, nil, err
+		}
+		value, err := bytesOf(n)
+		return string(value), data, err
+	case 0xDC, 0xDD: // array 16/32
+		if n, err = read(2 << (format - 0xDC)); err != nil {
+			return nil, nil, err
+		}
+		return container(n, false)
+	case 0xDE, 0xDF: // map 16/32
+		if n, err = read(2 << (format - 0xDE)); err != nil {
+			return nil, nil, err
+		}
+		return container(n, true)
+	default:
+		return nil, nil, fmt.Errorf("unsupported format 0x%02X", format)
+	}
+}
+
+// runDecode prints a payload file ("-" for stdin) as indented JSON. The encoding is
+// taken from the file extension when not given.
+func runDecode(path, encodingName, messageType string) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read payload: %w", err)
+	}
+
+	if encodingName == "" {
+		switch filepath.Ext(path) {
+		case ".pb", ".protobuf":
+			encodingName = string(EncodingProtobuf)
+		case ".cbor":
+			encodingName = string(EncodingCBOR)
+		case ".msgpack", ".mp":
+			encodingName = string(EncodingMsgPack)
+		}
+	}
+	encoding, err := parsePayloadEncoding(encodingName)
+	if err != nil {
+		return err
+	}
+
+	message, err := DecodePayload(encoding, messageType, data)
+	if err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(message, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", output)
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+var payloadEncodings = []PayloadEncoding{EncodingJSON, EncodingProtobuf, EncodingCBOR, EncodingMsgPack}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	fuel, emptyTank := 62.5, 0.0
+	tests := []struct {
+		name        string
+		messageType string
+		message     payloadMessage
+	}{
+		{"telemetry", "telemetry", &Telemetry{
+			VehicleID: 42, Timestamp: 1767254400, Lat: 35.7219, Lon: 51.3347, Speed: 48.25, Heading: 271.5,
+			Altitude: 1190.5, Accuracy: 6.5, Battery: 87.25, Signal: 74.5, Fuel: &fuel, Odometer: 12.345,
+			EngineHours: 0.4321, Replayed: true,
+		}},
+		{"zero values", "telemetry", &Telemetry{VehicleID: 1, Timestamp: 1767254400, Lat: -33.5, Lon: -70.25}},
+		{"empty tank", "telemetry", &Telemetry{VehicleID: 7, Timestamp: 1767254400, Fuel: &emptyTank}},
+		{"large ids", "telemetry", &Telemetry{VehicleID: 1 << 40, Timestamp: -1, Speed: 1e-9, Heading: -0.5}},
+		{"batch", "batch", &BatchTelemetry{
+			BatchID:   "batch_1767254400000000000_3",
+			Timestamp: 1767254400,
+			Vehicles: []Telemetry{
+				{VehicleID: 1, Timestamp: 1767254395, Lat: 35.7, Lon: 51.4, Speed: 30},
+				{VehicleID: 2, Timestamp: 1767254396, Lat: 35.8, Lon: 51.5, Fuel: &fuel, Replayed: true},
+			},
+			BatchSize: 2,
+		}},
+		{"event", "event", &VehicleEvent{
+			VehicleID: 3, Timestamp: 1767254400, Type: EventArrival, RouteID: 12, Trip: 2,
+			Lat: 35.719, Lon: 51.4285, Reversed: true,
+		}},
+		{"alarm", "event", &VehicleEvent{VehicleID: 4, Timestamp: 1767254400, Type: "alarm", Alarm: "panic"}},
+	}
+
+	for _, tt := range tests {
+		for _, encoding := range payloadEncodings {
+			t.Run(tt.name+"/"+string(encoding), func(t *testing.T) {
+				data, err := encoding.Marshal(tt.message)
+				if err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				decoded, err := DecodePayload(encoding, tt.messageType, data)
+				if err != nil {
+					t.Fatalf("DecodePayload: %v", err)
+				}
+				if !reflect.DeepEqual(decoded, tt.message) {
+					t.Errorf("round trip changed the message:\n got %+v\nwant %+v", decoded, tt.message)
+				}
+			})
+		}
+	}
+}
+
+// decodeFields decodes a binary telemetry payload into its fields without converting
+// them through JSON, which cannot hold NaN
+func decodeFields(encoding PayloadEncoding, data []byte) (map[string]interface{}, error) {
+	var value interface{}
+	var err error
+	switch encoding {
+	case EncodingProtobuf:
+		_, sample, _ := payloadTypes("telemetry")
+		return decodeProtobuf(data, sample)
+	case EncodingCBOR:
+		value, err = decodeComplete(data, decodeCBOR)
+	default:
+		value, err = decodeComplete(data, decodeMsgPack)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value.(map[string]interface{}), nil
+}
+
+func TestPayloadFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault payloadFault
+		check func(fields map[string]interface{}) bool
+	}{
+		{"nan", payloadFault{kind: FaultNaN, field: "spd"}, func(fields map[string]interface{}) bool {
+			speed, ok := fields["spd"].(float64)
+			return ok && math.IsNaN(speed)
+		}},
+		{"null", payloadFault{kind: FaultNull, field: "alt"}, func(fields map[string]interface{}) bool {
+			_, present := fields["alt"]
+			return !present && fields["spd"] == 40.0
+		}},
+	}
+
+	for _, tt := range tests {
+		// JSON payloads are patched as text; see TestPayloadFaultsJSON
+		for _, encoding := range payloadEncodings[1:] {
+			t.Run(tt.name+"/"+string(encoding), func(t *testing.T) {
+				fault := tt.fault
+				record := &Telemetry{VehicleID: 5, Timestamp: 1767254400, Lat: 35.7, Speed: 40, Altitude: 1200, fault: &fault}
+				data, err := encoding.Marshal(record)
+				if err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				fields, err := decodeFields(encoding, data)
+				if err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				if !tt.check(fields) {
+					t.Errorf("fault not applied: %v", fields)
+				}
+			})
+		}
+	}
+}
+
+func TestPayloadFaultsJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault payloadFault
+		want  string
+	}{
+		{"nan", payloadFault{kind: FaultNaN, field: "spd"},
+			`{"vehicle_id":5,"timestamp":1767254400,"lat":35.7,"lon":0,"spd":NaN,"hdg":0,"alt":1200,"acc":0,"battery":0,"signal":0,"odometer":0,"engine_hours":0}`},
+		{"null", payloadFault{kind: FaultNull, field: "alt"},
+			`{"vehicle_id":5,"timestamp":1767254400,"lat":35.7,"lon":0,"spd":40,"hdg":0,"alt":null,"acc":0,"battery":0,"signal":0,"odometer":0,"engine_hours":0}`},
+		{"truncated", payloadFault{cut: 0.25},
+			`{"vehicle_id":5,"timestamp":17672544`},
+		{"null and truncated", payloadFault{kind: FaultNull, field: "lat", cut: 0.5},
+			`{"vehicle_id":5,"timestamp":1767254400,"lat":null,"lon":0,"spd":40,"hdg":`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fault := tt.fault
+			record := &Telemetry{VehicleID: 5, Timestamp: 1767254400, Lat: 35.7, Speed: 40, Altitude: 1200, fault: &fault}
+			data, err := EncodingJSON.Marshal(record)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got  %s\nwant %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestPayloadTruncated(t *testing.T) {
+	// Protobuf has no framing, so only the self-delimiting encodings reject a cut payload
+	for _, encoding := range []PayloadEncoding{EncodingJSON, EncodingCBOR, EncodingMsgPack} {
+		for _, cut := range []float64{0.2, 0.5, 0.9} {
+			t.Run(fmt.Sprintf("%s/%.0f%%", encoding, cut*100), func(t *testing.T) {
+				record := &Telemetry{VehicleID: 5, Timestamp: 1767254400, Lat: 35.7, Speed: 40, fault: &payloadFault{cut: cut}}
+				data, err := encoding.Marshal(record)
+				if err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				if decoded, err := DecodePayload(encoding, "telemetry", data); err == nil {
+					t.Errorf("truncated payload decoded as %+v", decoded)
+				}
+			})
+		}
+	}
+}
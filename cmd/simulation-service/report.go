@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyGrowth is the ratio between latency histogram buckets, which bounds the
+// error of reported percentiles to 5%
+const latencyGrowth = 1.05
+
+// latencyHistogram records latencies in logarithmic microsecond buckets, so memory
+// stays constant however long the simulation runs
+type latencyHistogram struct {
+	buckets map[int]int
+	count   int
+	max     time.Duration
+}
+
+// add records one latency
+func (h *latencyHistogram) add(latency time.Duration) {
+	if h.buckets == nil {
+		h.buckets = make(map[int]int)
+	}
+	bucket := 0
+	if us := float64(latency) / float64(time.Microsecond); us > 1 {
+		bucket = int(math.Ceil(math.Log(us) / math.Log(latencyGrowth)))
+	}
+	h.buckets[bucket]++
+	h.count++
+	h.max = max(h.max, latency)
+}
+
+// percentile returns the upper bound of the bucket holding the p-th percentile, in ms
+func (h *latencyHistogram) percentile(p float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	buckets := make([]int, 0, len(h.buckets))
+	for bucket := range h.buckets {
+		buckets = append(buckets, bucket)
+	}
+	sort.Ints(buckets)
+
+	rank := int(math.Ceil(p / 100 * float64(h.count)))
+	seen := 0
+	for _, bucket := range buckets {
+		seen += h.buckets[bucket]
+		if seen >= rank {
+			ms := math.Pow(latencyGrowth, float64(bucket)) / 1000
+			return math.Min(ms, float64(h.max)/float64(time.Millisecond))
+		}
+	}
+	return float64(h.max) / float64(time.Millisecond)
+}
+
+// LatencyPercentiles summarizes publish latencies in milliseconds
+type LatencyPercentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// VehicleReport summarizes one vehicle's run
+type VehicleReport struct {
+	VehicleID       int     `json:"vehicle_id"`
+	VehicleType     string  `json:"vehicle_type"`
+	RouteID         int     `json:"route_id"`
+	DistanceKm      float64 `json:"distance_km"`
+	Trip            int     `json:"trip"`
+	TripsCompleted  int     `json:"trips_completed"`
+	RouteProgress   float64 `json:"route_progress"` // fraction of the current route driven
+	Status          string  `json:"status"`         // see VehicleSimulator.Status
+	MessagesSent    int     `json:"messages_sent"`
+	PublishFailures int     `json:"publish_failures"`
+	AvgLatencyMs    float64 `json:"avg_publish_latency_ms"`
+
+	// Connectivity loss: points stored on the device, uploaded late, lost to buffer
+	// overflow, and still on the device when the report was finished
+	PointsBuffered int `json:"points_buffered,omitempty"`
+	PointsReplayed int `json:"points_replayed,omitempty"`
+	PointsDropped  int `json:"points_dropped,omitempty"`
+	PointsPending  int `json:"points_pending,omitempty"`
+
+	latencyTotal time.Duration
+	last         *Telemetry // last telemetry sent, for the offline event position
+}
+
+// RunReport summarizes a live run: what every vehicle did and how publishing went
+type RunReport struct {
+	Started         time.Time          `json:"started"`
+	Finished        time.Time          `json:"finished"`
+	SimulationStart time.Time          `json:"simulation_start"`
+	SimulationEnd   time.Time          `json:"simulation_end"`
+	VehicleCount    int                `json:"vehicle_count"`
+	DistanceKm      float64            `json:"distance_km"`
+	TripsCompleted  int                `json:"trips_completed"`
+	MessagesSent    int                `json:"messages_sent"`
+	PublishFailures int                `json:"publish_failures"`
+	PublishLatency  LatencyPercentiles `json:"publish_latency_ms"`
+	PointsBuffered  int                `json:"points_buffered,omitempty"` // totals of the vehicle counters
+	PointsReplayed  int                `json:"points_replayed,omitempty"`
+	PointsDropped   int                `json:"points_dropped,omitempty"`
+	PointsPending   int                `json:"points_pending,omitempty"`
+	Engine          EngineStats        `json:"engine"`
+	Faults          map[string]int     `json:"faults,omitempty"` // injected faults by kind
+	Vehicles        []*VehicleReport   `json:"vehicles"`
+
+	mu      sync.Mutex // publishes complete on the sinks' goroutines
+	byID    map[int]*VehicleReport
+	latency latencyHistogram
+}
+
+// NewRunReport starts a report for the simulators
+func NewRunReport(simulators []*VehicleSimulator, simulationStart time.Time) *RunReport {
+	report := &RunReport{
+		Started:         time.Now(),
+		SimulationStart: simulationStart,
+		byID:            make(map[int]*VehicleReport),
+	}
+	for _, simulator := range simulators {
+		report.AddVehicle(simulator)
+	}
+	return report
+}
+
+// AddVehicle starts the report entry of a vehicle
+func (r *RunReport) AddVehicle(v *VehicleSimulator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vehicle := &VehicleReport{VehicleID: v.VehicleID, VehicleType: v.TypeName}
+	r.Vehicles = append(r.Vehicles, vehicle)
+	r.byID[v.VehicleID] = vehicle
+	r.VehicleCount = len(r.Vehicles)
+}
+
+// RecordPublish counts one telemetry record or event handed to the sinks
+func (r *RunReport) RecordPublish(v *VehicleSimulator, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vehicle := r.byID[v.VehicleID]
+	if err != nil {
+		vehicle.PublishFailures++
+		r.PublishFailures++
+		return
+	}
+	vehicle.MessagesSent++
+	vehicle.latencyTotal += latency
+	r.MessagesSent++
+	r.latency.add(latency)
+}
+
+// RecordTelemetry remembers the vehicle's last live position
+func (r *RunReport) RecordTelemetry(v *VehicleSimulator, telemetry *Telemetry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !telemetry.Replayed {
+		r.byID[v.VehicleID].last = telemetry
+	}
+}
+
+// LastTelemetry returns the last telemetry sent for a vehicle, or nil
+func (r *RunReport) LastTelemetry(v *VehicleSimulator) *Telemetry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.byID[v.VehicleID].last
+}
+
+// Finish fills in the vehicles' final state and the latency percentiles
+func (r *RunReport) Finish(simulators []*VehicleSimulator, simulationEnd time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = time.Now()
+	r.SimulationEnd = simulationEnd
+	r.DistanceKm, r.TripsCompleted = 0, 0
+	r.PointsBuffered, r.PointsReplayed, r.PointsDropped, r.PointsPending = 0, 0, 0, 0
+
+	for _, simulator := range simulators {
+		vehicle := r.byID[simulator.VehicleID]
+		vehicle.RouteID = simulator.Route.Metadata.ID
+		vehicle.DistanceKm = simulator.TotalDistance / 1000
+		vehicle.Trip = simulator.Trip
+		vehicle.TripsCompleted = simulator.TripsCompleted
+		if simulator.RouteIterator != nil && simulator.RouteIterator.TotalLength > 0 {
+			vehicle.RouteProgress = math.Min(1, simulator.DistanceTraveled/simulator.RouteIterator.TotalLength)
+		}
+		vehicle.Status = simulator.Status()
+		if vehicle.MessagesSent > 0 {
+			vehicle.AvgLatencyMs = float64(vehicle.latencyTotal) / float64(vehicle.MessagesSent) / float64(time.Millisecond)
+		}
+		if c := simulator.Connectivity; c != nil {
+			vehicle.PointsBuffered, vehicle.PointsReplayed = c.Buffered, c.Replayed
+			vehicle.PointsDropped, vehicle.PointsPending = c.Dropped, c.Pending()
+		}
+		r.DistanceKm += vehicle.DistanceKm
+		r.TripsCompleted += vehicle.TripsCompleted
+		r.PointsBuffered += vehicle.PointsBuffered
+		r.PointsReplayed += vehicle.PointsReplayed
+		r.PointsDropped += vehicle.PointsDropped
+		r.PointsPending += vehicle.PointsPending
+	}
+
+	r.PublishLatency = LatencyPercentiles{
+		Count: r.latency.count,
+		P50:   r.latency.percentile(50),
+		P90:   r.latency.percentile(90),
+		P95:   r.latency.percentile(95),
+		P99:   r.latency.percentile(99),
+		Max:   float64(r.latency.max) / float64(time.Millisecond),
+	}
+}
+
+// Write saves the report as indented JSON
+func (r *RunReport) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal run report: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"math"
-	"math/rand"
 	"time"
 )
 
@@ -14,15 +13,28 @@ type RouteIterator struct {
 	TotalLength   float64
 	CurrentIndex  int
 	CurrentPos    float64 // position along current segment (0-1)
+	SegmentStarts []float64 // cumulative distance at the start of each segment
+	SegmentSpeeds []float64 // annotated speed per segment in m/s (nil without annotations)
+	Reversed      bool      // driving the route from its end to its start
 }
 
 // NewRouteIterator creates a new iterator for a route
 func NewRouteIterator(route *Route) *RouteIterator {
+	return newRouteIterator(route, false)
+}
+
+// NewReversedRouteIterator creates an iterator that drives the route from its end to its start
+func NewReversedRouteIterator(route *Route) *RouteIterator {
+	return newRouteIterator(route, true)
+}
+
+func newRouteIterator(route *Route, reversed bool) *RouteIterator {
 	// Decode the polyline geometry
 	points := decodePolyline(route.Route.Geometry)
 	
 	// Calculate segment lengths
 	segmentLengths := make([]float64, len(points)-1)
+	segmentStarts := make([]float64, len(points)-1)
 	totalLength := 0.0
 	
 	for i := 0; i < len(points)-1; i++ {
@@ -31,17 +43,46 @@ func NewRouteIterator(route *Route) *RouteIterator {
 			points[i+1][0], points[i+1][1],
 		)
 		segmentLengths[i] = dist
+		segmentStarts[i] = totalLength
 		totalLength += dist
 	}
 	
-	return &RouteIterator{
+	ri := &RouteIterator{
 		Route:         route,
 		Points:        points,
 		SegmentLengths: segmentLengths,
 		TotalLength:   totalLength,
 		CurrentIndex:  0,
 		CurrentPos:    0,
+		SegmentStarts: segmentStarts,
+	}
+	// Annotations follow the forward geometry, so map them before reversing
+	ri.SegmentSpeeds = buildSegmentSpeeds(ri, route)
+	
+	if reversed {
+		ri.reverse()
+	}
+	
+	return ri
+}
+
+// reverse flips the iterator so it runs from the route's end to its start
+func (ri *RouteIterator) reverse() {
+	for i, j := 0, len(ri.Points)-1; i < j; i, j = i+1, j-1 {
+		ri.Points[i], ri.Points[j] = ri.Points[j], ri.Points[i]
+	}
+	for i, j := 0, len(ri.SegmentLengths)-1; i < j; i, j = i+1, j-1 {
+		ri.SegmentLengths[i], ri.SegmentLengths[j] = ri.SegmentLengths[j], ri.SegmentLengths[i]
+		if ri.SegmentSpeeds != nil {
+			ri.SegmentSpeeds[i], ri.SegmentSpeeds[j] = ri.SegmentSpeeds[j], ri.SegmentSpeeds[i]
+		}
 	}
+	start := 0.0
+	for i, length := range ri.SegmentLengths {
+		ri.SegmentStarts[i] = start
+		start += length
+	}
+	ri.Reversed = !ri.Reversed
 }
 
 // CalculatePosition calculates position along route based on distance traveled
@@ -85,31 +126,72 @@ func (v *VehicleSimulator) UpdateWithRouteIterator(currentTime time.Time) *Telem
 	// Calculate time since last update
 	timeSinceLastUpdate := currentTime.Sub(v.LastUpdateTime).Seconds()
 	
-	// Update current speed (can vary within range)
-	v.CurrentSpeed = v.SpeedRange[0] + rand.Float64()*(v.SpeedRange[1]-v.SpeedRange[0])
-	
-	// Calculate distance traveled since last update
-	distanceSinceLastUpdate := v.CurrentSpeed * timeSinceLastUpdate
-	
-	// Update cumulative distance traveled
-	v.DistanceTraveled += distanceSinceLastUpdate
-	
-	// Update last update time
-	v.LastUpdateTime = currentTime
-	
 	// Create iterator if not exists
 	if v.RouteIterator == nil {
 		v.RouteIterator = NewRouteIterator(v.Route)
 	}
 	
+	factor := v.speedFactor()
+	if v.Parked || v.Paused || v.Waiting {
+		// Parked, paused and waiting vehicles hold their position
+		v.CurrentSpeed = 0
+		if v.Kinematics != nil {
+			v.Kinematics.Speed = 0
+		}
+	} else if v.Kinematics != nil {
+		// Accelerate and brake towards the cruise speed within the vehicle's limits;
+		// the reported speed is the real derivative of position over the tick
+		if v.Kinematics.Constraints == nil {
+			v.Kinematics.Constraints = buildSpeedConstraints(v.RouteIterator, v.Route, v.Kinematics.Type)
+		}
+		jitter := 1 + v.SpeedJitter*(2*v.Rand.Float64()-1)
+		randomCruise := (v.SpeedRange[0] + v.Rand.Float64()*(v.SpeedRange[1]-v.SpeedRange[0])) * factor
+		cruise := func(position float64) float64 {
+			if speed, ok := v.RouteIterator.SpeedAt(position); ok && v.UseSpeedProfile {
+				return speed * jitter * factor
+			}
+			return randomCruise
+		}
+		distanceSinceLastUpdate := v.Kinematics.Advance(v.DistanceTraveled, timeSinceLastUpdate, v.RouteIterator.TotalLength, cruise)
+		v.DistanceTraveled += distanceSinceLastUpdate
+		if timeSinceLastUpdate > 0 {
+			v.CurrentSpeed = distanceSinceLastUpdate / timeSinceLastUpdate
+		} else {
+			v.CurrentSpeed = v.Kinematics.Speed
+		}
+	} else if v.UseSpeedProfile && v.RouteIterator.SegmentSpeeds != nil {
+		// Follow the annotated speeds, with jitter drawn once per tick
+		jitter := (1 + v.SpeedJitter*(2*v.Rand.Float64()-1)) * factor
+		distanceSinceLastUpdate := v.RouteIterator.AdvanceAlongProfile(v.DistanceTraveled, timeSinceLastUpdate, jitter)
+		v.DistanceTraveled += distanceSinceLastUpdate
+		if timeSinceLastUpdate > 0 {
+			v.CurrentSpeed = distanceSinceLastUpdate / timeSinceLastUpdate
+		} else {
+			v.CurrentSpeed, _ = v.RouteIterator.SpeedAt(v.DistanceTraveled)
+			v.CurrentSpeed *= jitter
+		}
+	} else {
+		// Update current speed (can vary within range)
+		v.CurrentSpeed = (v.SpeedRange[0] + v.Rand.Float64()*(v.SpeedRange[1]-v.SpeedRange[0])) * factor
+		
+		// Calculate distance traveled since last update
+		distanceSinceLastUpdate := v.CurrentSpeed * timeSinceLastUpdate
+		
+		// Update cumulative distance traveled
+		v.DistanceTraveled += distanceSinceLastUpdate
+	}
+	
+	// Update last update time
+	v.LastUpdateTime = currentTime
+	
 	// Calculate position along route
 	lat, lng, heading := v.RouteIterator.CalculatePosition(v.DistanceTraveled)
 	
 	// Generate random values with validation
-	altitude := 100 + rand.Float64()*50
-	accuracy := 5 + rand.Float64()*10
-	battery := 80 + rand.Float64()*20
-	signal := 70 + rand.Float64()*30
+	altitude := 100 + v.Rand.Float64()*50
+	accuracy := 5 + v.Rand.Float64()*10
+	battery := 80 + v.Rand.Float64()*20
+	signal := 70 + v.Rand.Float64()*30
 	
 	// Validate all values to ensure they're valid numbers
 	if math.IsNaN(v.CurrentSpeed) || math.IsInf(v.CurrentSpeed, 0) {
@@ -145,4 +227,9 @@ func (v *VehicleSimulator) UpdateWithRouteIterator(currentTime time.Time) *Telem
 	}
 	
 	return telemetry
-}
\ No newline at end of file
+}
+
+// Arrived reports whether the vehicle has reached the end of its route
+func (v *VehicleSimulator) Arrived() bool {
+	return v.RouteIterator != nil && v.DistanceTraveled >= v.RouteIterator.TotalLength
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// routeFilePattern matches route files written by the route generator, compressed or not
+var routeFilePattern = regexp.MustCompile(`^route_(\d+)\.json(\.gz)?$`)
+
+// generatorFilePattern matches the other files the route generator writes next to routes
+var generatorFilePattern = regexp.MustCompile(`^(metadata|summary)\.json(\.gz)?$`)
+
+// RouteSelection restricts which routes are loaded
+type RouteSelection struct {
+	RouteIDs  []int // only load these route IDs (empty = all)
+	MaxRoutes int   // stop after this many routes (0 = no limit)
+}
+
+// indexEntry is the subset of the generator's metadata.json entries needed to pick routes
+type indexEntry struct {
+	ID      int  `json:"id"`
+	Success bool `json:"success"`
+}
+
+// LoadSummary records what the loader read and what it skipped
+type LoadSummary struct {
+	Loaded  int
+	Skipped map[string][]string // reason -> files
+}
+
+// skip records a skipped file under a reason
+func (s *LoadSummary) skip(reason, file string) {
+	s.Skipped[reason] = append(s.Skipped[reason], file)
+}
+
+// Log prints the skipped files grouped by reason
+func (s *LoadSummary) Log() {
+	if len(s.Skipped) == 0 {
+		return
+	}
+
+	reasons := make([]string, 0, len(s.Skipped))
+	total := 0
+	for reason, files := range s.Skipped {
+		reasons = append(reasons, reason)
+		total += len(files)
+	}
+	sort.Strings(reasons)
+
+	log.Printf("Skipped %d route files:", total)
+	for _, reason := range reasons {
+		files := s.Skipped[reason]
+		examples := files
+		if len(examples) > 3 {
+			examples = examples[:3]
+		}
+		suffix := ""
+		if len(files) > len(examples) {
+			suffix = fmt.Sprintf(", ... (%d more)", len(files)-len(examples))
+		}
+		log.Printf("  %-32s %5d  (%s%s)", reason+":", len(files), strings.Join(examples, ", "), suffix)
+	}
+}
+
+// openMaybeGzip opens a file, transparently decompressing it if it ends in .gz
+func openMaybeGzip(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("invalid gzip data: %w", err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gzipReader, closerFunc(func() error {
+		gzipReader.Close()
+		return file.Close()
+	})}, nil
+}
+
+// closerFunc adapts a function to io.Closer
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// readJSONFile decodes a (possibly gzip-compressed) JSON file into v
+func readJSONFile(path string, v interface{}) error {
+	reader, err := openMaybeGzip(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return json.NewDecoder(reader).Decode(v)
+}
+
+// loadMetadataIndex reads metadata.json or metadata.json.gz from dir, if present
+func loadMetadataIndex(dir string) (map[int]indexEntry, error) {
+	for _, name := range []string{"metadata.json", "metadata.json.gz"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		var entries []indexEntry
+		if err := readJSONFile(path, &entries); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		index := make(map[int]indexEntry, len(entries))
+		for _, entry := range entries {
+			index[entry.ID] = entry
+		}
+		return index, nil
+	}
+	return nil, nil
+}
+
+// loadRoutes loads every route file the generator can produce below path:
+// plain and gzip-compressed files, in nested directories. When a directory has a
+// metadata index, failed and unselected routes are skipped without parsing them.
+func loadRoutes(path string, selection RouteSelection) ([]*Route, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[int]bool, len(selection.RouteIDs))
+	for _, id := range selection.RouteIDs {
+		wanted[id] = true
+	}
+
+	summary := &LoadSummary{Skipped: make(map[string][]string)}
+	indexes := make(map[string]map[int]indexEntry)
+	seen := make(map[int]string)
+	routes := make([]*Route, 0)
+
+	err := filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			summary.skip("unreadable", file)
+			if entry != nil && entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if selection.MaxRoutes > 0 && len(routes) >= selection.MaxRoutes {
+			return fs.SkipAll
+		}
+
+		match := routeFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			if !generatorFilePattern.MatchString(entry.Name()) {
+				summary.skip("unrecognized name", file)
+			}
+			return nil
+		}
+		fileID, _ := strconv.Atoi(match[1])
+
+		// Consult the directory's metadata index before parsing the file
+		dir := filepath.Dir(file)
+		index, loaded := indexes[dir]
+		if !loaded {
+			index, err = loadMetadataIndex(dir)
+			if err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			indexes[dir] = index
+		}
+		if meta, ok := index[fileID]; ok && !meta.Success {
+			summary.skip("failed route (metadata index)", file)
+			return nil
+		}
+		if len(wanted) > 0 && !wanted[fileID] {
+			summary.skip("not selected", file)
+			return nil
+		}
+
+		var route Route
+		if err := readJSONFile(file, &route); err != nil {
+			if strings.HasSuffix(file, ".gz") {
+				summary.skip("corrupt gzip or JSON", file)
+			} else {
+				summary.skip("invalid JSON", file)
+			}
+			return nil
+		}
+		if !route.Metadata.Success {
+			summary.skip("failed route", file)
+			return nil
+		}
+		if len(decodePolyline(route.Route.Geometry)) < 2 {
+			summary.skip("geometry has fewer than 2 points", file)
+			return nil
+		}
+		if previous, duplicate := seen[route.Metadata.ID]; duplicate {
+			summary.skip("duplicate route ID", file+" (also "+previous+")")
+			return nil
+		}
+		seen[route.Metadata.ID] = file
+
+		routes = append(routes, &route)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summary.Loaded = len(routes)
+	summary.Log()
+
+	return routes, nil
+}
+
+// loadRouteFile loads one route file, plain or gzip-compressed
+func loadRouteFile(path string) (*Route, error) {
+	var route Route
+	if err := readJSONFile(path, &route); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if !route.Metadata.Success {
+		return nil, fmt.Errorf("%s is a failed route", path)
+	}
+	if len(decodePolyline(route.Route.Geometry)) < 2 {
+		return nil, fmt.Errorf("%s has fewer than 2 geometry points", path)
+	}
+	return &route, nil
+}
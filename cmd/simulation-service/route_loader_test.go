@@ -0,0 +1,118 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeRouteFile writes a route with a three-point geometry, gzip-compressed when the
+// name ends in .gz
+func writeRouteFile(t *testing.T, path string, id int, success bool) {
+	t.Helper()
+	data := fmt.Sprintf(`{"metadata": {"id": %d, "distance": 300, "duration": 20, "success": %t, "profile": "car"},
+		"route": {"geometry": "_t{xE_avxHgEkHgEkH"}}`, id, success)
+	writeFile(t, path, data)
+}
+
+// writeFile writes a file and its directories, gzip-compressed when the name ends in .gz
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if filepath.Ext(path) != ".gz" {
+		file.WriteString(data)
+		return
+	}
+	writer := gzip.NewWriter(file)
+	writer.Write([]byte(data))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	dir := t.TempDir()
+	writeRouteFile(t, filepath.Join(dir, "route_000001.json"), 1, true)
+	writeRouteFile(t, filepath.Join(dir, "route_000002.json.gz"), 2, true)
+	writeRouteFile(t, filepath.Join(dir, "batch_a", "route_000003.json"), 3, true)
+	writeRouteFile(t, filepath.Join(dir, "batch_a", "deeper", "route_000004.json.gz"), 4, true)
+	// Skipped: failed in the metadata index, failed in the file, duplicate ID, corrupt
+	// gzip, invalid JSON, unrecognized names
+	writeRouteFile(t, filepath.Join(dir, "batch_b", "route_000005.json"), 5, true)
+	writeFile(t, filepath.Join(dir, "batch_b", "metadata.json"), `[{"id": 5, "success": false}]`)
+	writeRouteFile(t, filepath.Join(dir, "batch_b", "route_000006.json"), 6, false)
+	writeRouteFile(t, filepath.Join(dir, "batch_b", "route_000007.json"), 1, true)
+	writeFile(t, filepath.Join(dir, "route_000008.json.gz.tmp"), "")
+	writeFile(t, filepath.Join(dir, "batch_b", "route_000009.json"), `{"metadata": `)
+	writeFile(t, filepath.Join(dir, "route_000010.json.gz"), "not gzip")
+	writeFile(t, filepath.Join(dir, "notes.txt"), "routes for the demo")
+
+	tests := []struct {
+		name      string
+		selection RouteSelection
+		want      []int
+	}{
+		{"everything", RouteSelection{}, []int{1, 2, 3, 4}},
+		{"selected IDs", RouteSelection{RouteIDs: []int{2, 4, 5}}, []int{2, 4}},
+		{"max routes in walk order", RouteSelection{MaxRoutes: 2}, []int{3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := loadRoutes(dir, tt.selection)
+			if err != nil {
+				t.Fatalf("loadRoutes: %v", err)
+			}
+			var ids []int
+			for _, route := range routes {
+				ids = append(ids, route.Metadata.ID)
+			}
+			slices.Sort(ids)
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("loaded routes %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	if _, err := loadRoutes(filepath.Join(dir, "missing"), RouteSelection{}); err == nil {
+		t.Error("loading a missing directory succeeded")
+	}
+}
+
+func TestLoadRouteFile(t *testing.T) {
+	dir := t.TempDir()
+	writeRouteFile(t, filepath.Join(dir, "route_000001.json.gz"), 1, true)
+	writeRouteFile(t, filepath.Join(dir, "route_000002.json"), 2, false)
+	writeFile(t, filepath.Join(dir, "route_000003.json"),
+		`{"metadata": {"id": 3, "success": true}, "route": {"geometry": "_t{xE_avxH"}}`)
+
+	tests := []struct {
+		file string
+		ok   bool
+	}{
+		{"route_000001.json.gz", true},
+		{"route_000002.json", false}, // failed route
+		{"route_000003.json", false}, // single geometry point
+		{"route_000004.json", false}, // missing
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			route, err := loadRouteFile(filepath.Join(dir, tt.file))
+			if tt.ok && (err != nil || route.Metadata.ID != 1) {
+				t.Errorf("loadRouteFile = %v, %v", route, err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("loadRouteFile succeeded")
+			}
+		})
+	}
+}
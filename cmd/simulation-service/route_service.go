@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"vehicle-tracking-simulation/internal/route-service/models"
+)
+
+// RouteServiceConfig locates the route service used for routes requested at runtime
+type RouteServiceConfig struct {
+	BaseURL string `yaml:"base_url"` // default http://localhost:8080
+	Timeout string `yaml:"timeout"`  // default 30s
+}
+
+// RouteServiceClient fetches routes between coordinates from the route service
+type RouteServiceClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewRouteServiceClient creates a client for the configured route service
+func NewRouteServiceClient(cfg RouteServiceConfig) *RouteServiceClient {
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+	return &RouteServiceClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: parseDuration(cfg.Timeout, 30*time.Second)},
+	}
+}
+
+// FindRoute asks the route service for a route and wraps it like a generated route
+// file, so it can be driven like a loaded route. The caller assigns the route ID.
+func (c *RouteServiceClient) FindRoute(start, end models.Coordinate, profile string) (*Route, error) {
+	payload, err := json.Marshal(models.RouteRequest{StartCoordinate: start, EndCoordinate: end, Profile: profile})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal route request: %w", err)
+	}
+	resp, err := c.client.Post(c.baseURL+"/api/v1/route", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to request route: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read route response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("route service returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var routeResp models.RouteResponse
+	if err := json.Unmarshal(body, &routeResp); err != nil {
+		return nil, fmt.Errorf("failed to parse route response: %w", err)
+	}
+	if routeResp.Code != "Ok" || len(routeResp.Routes) == 0 {
+		return nil, fmt.Errorf("no route found: %s %s", routeResp.Code, routeResp.Message)
+	}
+
+	// The route file's "route" object is the route service's route
+	data, err := json.Marshal(routeResp.Routes[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert route: %w", err)
+	}
+	route := &Route{}
+	if err := json.Unmarshal(data, &route.Route); err != nil {
+		return nil, fmt.Errorf("failed to convert route: %w", err)
+	}
+	if len(decodePolyline(route.Route.Geometry)) < 2 {
+		return nil, fmt.Errorf("route geometry has fewer than 2 points")
+	}
+
+	route.Metadata.GeneratedAt = time.Now().Format(time.RFC3339)
+	route.Metadata.StartLat, route.Metadata.StartLng = start.Latitude, start.Longitude
+	route.Metadata.EndLat, route.Metadata.EndLng = end.Latitude, end.Longitude
+	route.Metadata.Profile = profile
+	route.Metadata.Distance = routeResp.Routes[0].Distance
+	route.Metadata.Duration = routeResp.Routes[0].Duration
+	route.Metadata.Success = true
+	return route, nil
+}
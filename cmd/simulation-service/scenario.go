@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"vehicle-tracking-simulation/internal/route-service/models"
+)
+
+// Scenario actions
+const (
+	ScenarioPause        = "pause"             // stand still, keep reporting
+	ScenarioResume       = "resume"            // drive on after pause or stop
+	ScenarioStop         = "stop"              // switch the device off, e.g. a reboot with a duration
+	ScenarioSpeed        = "speed"             // multiply the vehicle's speed by factor
+	ScenarioDivert       = "divert"            // drive to coordinates on a route from the route service
+	ScenarioConnectivity = "drop_connectivity" // lose coverage for duration, buffering telemetry
+	ScenarioDrainBattery = "drain_battery"     // set the battery to level percent
+	ScenarioAlarm        = "alarm"             // send an alarm event
+)
+
+// Scenario is a script of actions applied to vehicles at simulation-time offsets
+type Scenario struct {
+	Groups  map[string][]int `yaml:"groups"` // named sets of vehicle IDs
+	Actions []ScenarioAction `yaml:"actions"`
+}
+
+// ScenarioAction is one scripted action. Its targets are the listed vehicles, a
+// group, or every vehicle of a type; the group "all" is the whole fleet.
+type ScenarioAction struct {
+	At          string             `yaml:"at"` // offset from the simulation start, e.g. "20m"
+	Action      string             `yaml:"action"`
+	Vehicles    []int              `yaml:"vehicles"`
+	Group       string             `yaml:"group"`
+	VehicleType string             `yaml:"vehicle_type"`
+	Duration    string             `yaml:"duration"` // pause, stop and speed revert after it; required by drop_connectivity
+	Factor      float64            `yaml:"factor"`   // speed
+	To          *models.Coordinate `yaml:"to"`       // divert: latitude and longitude
+	Profile     string             `yaml:"profile"`  // divert: route service profile, default the route's
+	Level       float64            `yaml:"level"`    // drain_battery: percent
+	Alarm       string             `yaml:"alarm"`    // alarm: e.g. "panic" or "tamper"
+
+	at       time.Duration
+	duration time.Duration
+}
+
+// LoadScenario reads and validates a scenario file
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var scenario Scenario
+	if err := yaml.Unmarshal(data, &scenario); err != nil {
+		return nil, err
+	}
+	for i := range scenario.Actions {
+		if err := scenario.validate(&scenario.Actions[i]); err != nil {
+			return nil, fmt.Errorf("action %d: %w", i+1, err)
+		}
+	}
+	return &scenario, nil
+}
+
+// validate checks an action and parses its durations
+func (s *Scenario) validate(a *ScenarioAction) error {
+	var err error
+	if a.at, err = time.ParseDuration(a.At); err != nil || a.at < 0 {
+		return fmt.Errorf("invalid at %q: must be a non-negative duration such as 20m", a.At)
+	}
+	if a.Duration != "" {
+		if a.duration, err = time.ParseDuration(a.Duration); err != nil || a.duration <= 0 {
+			return fmt.Errorf("invalid duration %q", a.Duration)
+		}
+	}
+
+	targets := 0
+	for _, set := range []bool{len(a.Vehicles) > 0, a.Group != "", a.VehicleType != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return fmt.Errorf("needs exactly one of vehicles, group or vehicle_type")
+	}
+	if _, ok := s.Groups[a.Group]; a.Group != "" && a.Group != "all" && !ok {
+		return fmt.Errorf("unknown group %q", a.Group)
+	}
+
+	switch a.Action {
+	case ScenarioPause, ScenarioResume, ScenarioStop:
+	case ScenarioSpeed:
+		if a.Factor <= 0 {
+			return fmt.Errorf("speed needs a positive factor")
+		}
+	case ScenarioDivert:
+		if a.To == nil {
+			return fmt.Errorf("divert needs to: {latitude, longitude}")
+		}
+	case ScenarioConnectivity:
+		if a.duration == 0 {
+			return fmt.Errorf("drop_connectivity needs a duration")
+		}
+	case ScenarioDrainBattery:
+		if a.Level < 0 || a.Level > 100 {
+			return fmt.Errorf("drain_battery level must be 0-100")
+		}
+	case ScenarioAlarm:
+		if a.Alarm == "" {
+			a.Alarm = "panic"
+		}
+	default:
+		return fmt.Errorf("unknown action %q", a.Action)
+	}
+	return nil
+}
+
+// describe names the action and its parameters for the log
+func (a *ScenarioAction) describe() string {
+	switch a.Action {
+	case ScenarioSpeed:
+		return fmt.Sprintf("speed x%.2f", a.Factor)
+	case ScenarioDivert:
+		return fmt.Sprintf("divert to %.5f,%.5f", a.To.Latitude, a.To.Longitude)
+	case ScenarioConnectivity:
+		return fmt.Sprintf("drop_connectivity for %s", a.duration)
+	case ScenarioDrainBattery:
+		return fmt.Sprintf("drain_battery to %.0f%%", a.Level)
+	case ScenarioAlarm:
+		return "alarm " + a.Alarm
+	}
+	if a.duration > 0 {
+		return fmt.Sprintf("%s for %s", a.Action, a.duration)
+	}
+	return a.Action
+}
+
+// scenarioStep is an action, or the automatic revert of one, due at an offset
+type scenarioStep struct {
+	at     time.Duration
+	action *ScenarioAction
+	revert bool
+}
+
+// ScenarioRunner applies a scenario's actions on the engine's tick loop. Steps due at
+// the same offset run in file order, so a run is reproducible.
+type ScenarioRunner struct {
+	scenario *Scenario
+	start    time.Time
+	steps    []scenarioStep  // pending, ordered by offset
+	factors  map[int]float64 // speed factors to restore when a speed action reverts
+}
+
+// NewScenarioRunner schedules a scenario from the simulation start
+func NewScenarioRunner(scenario *Scenario, start time.Time) *ScenarioRunner {
+	runner := &ScenarioRunner{scenario: scenario, start: start, factors: make(map[int]float64)}
+	for i := range scenario.Actions {
+		runner.schedule(scenarioStep{at: scenario.Actions[i].at, action: &scenario.Actions[i]})
+	}
+	log.Printf("Scenario: %d actions scheduled", len(scenario.Actions))
+	return runner
+}
+
+// schedule adds a step after every pending step due at the same offset or earlier
+func (r *ScenarioRunner) schedule(step scenarioStep) {
+	i := sort.Search(len(r.steps), func(i int) bool { return r.steps[i].at > step.at })
+	r.steps = append(r.steps, scenarioStep{})
+	copy(r.steps[i+1:], r.steps[i:])
+	r.steps[i] = step
+}
+
+// Apply runs every step due by now. The engine calls it at the start of a tick
+// while holding mu.
+func (r *ScenarioRunner) Apply(e *Engine, now time.Time) {
+	for len(r.steps) > 0 && !r.start.Add(r.steps[0].at).After(now) {
+		step := r.steps[0]
+		r.steps = r.steps[1:]
+		r.apply(e, step, now)
+	}
+}
+
+// apply runs one step on its target vehicles and logs it
+func (r *ScenarioRunner) apply(e *Engine, step scenarioStep, now time.Time) {
+	action := step.action
+	vehicles := r.targets(e, action)
+	name := action.describe()
+	if step.revert {
+		name = "end of " + name
+	}
+
+	var applied []string
+	for _, vehicle := range vehicles {
+		if err := r.applyTo(e, vehicle, step, now); err != nil {
+			log.Printf("Scenario: t+%s %s on vehicle %d failed: %v", step.at, name, vehicle.VehicleID, err)
+			continue
+		}
+		applied = append(applied, fmt.Sprint(vehicle.VehicleID))
+	}
+	log.Printf("Scenario: t+%s %s applied to %d vehicles [%s] at %s", step.at, name, len(applied),
+		strings.Join(applied, " "), now.Format(time.RFC3339))
+
+	if !step.revert && action.duration > 0 && action.Action != ScenarioConnectivity {
+		r.schedule(scenarioStep{at: step.at + action.duration, action: action, revert: true})
+	}
+}
+
+// targets resolves an action's vehicles, skipping removed and retired ones
+func (r *ScenarioRunner) targets(e *Engine, action *ScenarioAction) []*VehicleSimulator {
+	ids := action.Vehicles
+	if action.Group != "" && action.Group != "all" {
+		ids = r.scenario.Groups[action.Group]
+	}
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var vehicles []*VehicleSimulator
+	for _, vehicle := range e.vehicles {
+		if vehicle.Removed || vehicle.Retired {
+			continue
+		}
+		switch {
+		case action.Group == "all",
+			action.VehicleType != "" && vehicle.TypeName == action.VehicleType,
+			wanted[vehicle.VehicleID]:
+			vehicles = append(vehicles, vehicle)
+			delete(wanted, vehicle.VehicleID)
+		}
+	}
+	for id := range wanted {
+		log.Printf("Warning: scenario vehicle %d is not simulated", id)
+	}
+	return vehicles
+}
+
+// applyTo applies a step to one vehicle
+func (r *ScenarioRunner) applyTo(e *Engine, v *VehicleSimulator, step scenarioStep, now time.Time) error {
+	action := step.action
+	switch action.Action {
+	case ScenarioPause, ScenarioStop:
+		if step.revert {
+			e.apply(v, ScenarioResume)
+		} else {
+			e.apply(v, action.Action)
+		}
+	case ScenarioResume:
+		e.apply(v, ScenarioResume)
+	case ScenarioSpeed:
+		if step.revert {
+			v.SpeedFactor = r.factors[v.VehicleID]
+			delete(r.factors, v.VehicleID)
+		} else {
+			if _, saved := r.factors[v.VehicleID]; !saved {
+				r.factors[v.VehicleID] = v.SpeedFactor
+			}
+			v.SpeedFactor = action.Factor
+		}
+	case ScenarioDivert:
+		return e.divert(v, *action.To, action.Profile)
+	case ScenarioConnectivity:
+		if v.Connectivity == nil {
+			v.Connectivity = NewConnectivityState(e.config.Simulation.Connectivity, v.Rand)
+		}
+		v.Connectivity.Outage(now.Add(action.duration))
+	case ScenarioDrainBattery:
+		if v.Energy == nil {
+			return fmt.Errorf("vehicle has no energy model")
+		}
+		v.Energy.Drain(action.Level)
+	case ScenarioAlarm:
+		if v.Stopped {
+			return fmt.Errorf("device is stopped")
+		}
+		event := e.newEvent(v, EventAlarm)
+		event.Alarm = action.Alarm
+		e.sendEvent(v, &event)
+	}
+	return nil
+}
+
+// divert sends a vehicle from its current position to the destination on a route
+// from the route service. The tick waits for the route service.
+func (e *Engine) divert(v *VehicleSimulator, to models.Coordinate, profile string) error {
+	if profile == "" {
+		profile = v.Route.Metadata.Profile
+	}
+	if profile == "" {
+		profile = "car"
+	}
+	lat, lon, _ := v.position()
+	route, err := e.routes.FindRoute(models.Coordinate{Latitude: lat, Longitude: lon}, to, profile)
+	if err != nil {
+		return err
+	}
+
+	// The diverted route keeps the vehicle's route ID, so topics and events stay the same
+	route.Metadata.ID = v.Route.Metadata.ID
+	v.Route = route
+	v.RouteIterator = NewRouteIterator(route)
+	v.DistanceTraveled = 0
+	v.Parked = false
+	if v.Kinematics != nil {
+		v.Kinematics.Constraints = nil
+		v.Kinematics.next = 0
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// TelemetrySink receives the telemetry and lifecycle events published by the simulation
+type TelemetrySink interface {
+	SendTelemetry(v *VehicleSimulator, telemetry *Telemetry) error
+	SendEvent(v *VehicleSimulator, event *VehicleEvent) error
+	Close() error
+}
+
+// asyncSink is a sink that can complete sends in the background. done is called once
+// per message with the result, possibly from another goroutine.
+type asyncSink interface {
+	SendTelemetryAsync(v *VehicleSimulator, telemetry *Telemetry, done func(error))
+	SendEventAsync(v *VehicleSimulator, event *VehicleEvent, done func(error))
+}
+
+// vehicleSink is a sink that sets up each vehicle, e.g. with a connection of its own,
+// and needs to set up vehicles added at runtime and release removed ones too
+type vehicleSink interface {
+	AddVehicle(v *VehicleSimulator) error
+	RemoveVehicle(v *VehicleSimulator) error
+}
+
+// SinkConfig configures one telemetry sink
+type SinkConfig struct {
+	Type string `yaml:"type"` // "mqtt", "http", "tcp", "udp", "stdout", "nmea" or "tracker"
+
+	// HTTP
+	URL           string            `yaml:"url"`             // telemetry batches are POSTed here
+	EventURL      string            `yaml:"event_url"`       // events are POSTed here; not sent when empty
+	Headers       map[string]string `yaml:"headers"`         // extra request headers, e.g. Authorization
+	BatchSize     int               `yaml:"batch_size"`      // telemetry per request, default 100
+	BatchTimeout  string            `yaml:"batch_timeout"`   // simulated time after which a partial batch is sent, default 5s
+	BatchMaxBytes int               `yaml:"batch_max_bytes"` // encoded size limit of a request body, 0 = unlimited
+	Timeout       string            `yaml:"timeout"`         // per request, default 10s
+	MaxRetries    int               `yaml:"max_retries"`     // default 3
+	RetryBackoff  string            `yaml:"retry_backoff"`   // first retry delay, doubled per attempt, default 1s
+	QueueSize     int               `yaml:"queue_size"`      // requests waiting to be posted, default 100
+	Encoding      string            `yaml:"encoding"`        // "json" (default), "protobuf", "cbor" or "msgpack"
+
+	// TCP, UDP and tracker
+	Address string `yaml:"address"` // host:port
+
+	// NMEA
+	Listen     string `yaml:"listen"`      // TCP server address, default ":10110"
+	PerVehicle bool   `yaml:"per_vehicle"` // one port per vehicle counting up from the listen port
+	Directory  string `yaml:"directory"`   // write vehicle_<id>.nmea files here instead of serving TCP
+
+	// Binary tracker emulation
+	Protocol          string `yaml:"protocol"`           // "teltonika" (Codec 8), "codec8e" or "gt06"
+	IMEIPrefix        string `yaml:"imei_prefix"`        // IMEIs are prefix + vehicle ID + Luhn digit
+	AckTimeout        string `yaml:"ack_timeout"`        // wait for login and record ACKs, default 5s
+	MaxPending        int    `yaml:"max_pending"`        // unacknowledged records kept per device, default 10000
+	HeartbeatInterval string `yaml:"heartbeat_interval"` // GT06 status packets, simulated time, default 3m
+}
+
+// FanOutSink sends everything to several sinks. A failing sink does not stop the others.
+type FanOutSink struct {
+	Sinks []TelemetrySink
+	Names []string
+}
+
+// SendTelemetry sends the telemetry to every sink
+func (f *FanOutSink) SendTelemetry(v *VehicleSimulator, telemetry *Telemetry) error {
+	var errs []error
+	for i, sink := range f.Sinks {
+		if err := sink.SendTelemetry(v, telemetry); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SendEvent sends the event to every sink
+func (f *FanOutSink) SendEvent(v *VehicleSimulator, event *VehicleEvent) error {
+	var errs []error
+	for i, sink := range f.Sinks {
+		if err := sink.SendEvent(v, event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SendTelemetryAsync sends the telemetry to every sink and calls done once all of them
+// have finished. Asynchronous sinks do not hold up the others.
+func (f *FanOutSink) SendTelemetryAsync(v *VehicleSimulator, telemetry *Telemetry, done func(error)) {
+	f.sendAsync(done,
+		func(sink TelemetrySink) error { return sink.SendTelemetry(v, telemetry) },
+		func(sink asyncSink, done func(error)) { sink.SendTelemetryAsync(v, telemetry, done) })
+}
+
+// SendEventAsync sends the event to every sink and calls done once all of them have finished
+func (f *FanOutSink) SendEventAsync(v *VehicleSimulator, event *VehicleEvent, done func(error)) {
+	f.sendAsync(done,
+		func(sink TelemetrySink) error { return sink.SendEvent(v, event) },
+		func(sink asyncSink, done func(error)) { sink.SendEventAsync(v, event, done) })
+}
+
+// sendAsync sends one message to every sink, asynchronously where the sink supports it,
+// and calls done with the joined errors after the last sink has finished
+func (f *FanOutSink) sendAsync(done func(error), send func(TelemetrySink) error, sendAsync func(asyncSink, func(error))) {
+	var mu sync.Mutex
+	remaining := len(f.Sinks)
+	var errs []error
+	finish := func(name string) func(error) {
+		return func(err error) {
+			mu.Lock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+			remaining--
+			last := remaining == 0
+			mu.Unlock()
+			if last {
+				done(errors.Join(errs...))
+			}
+		}
+	}
+
+	for i, sink := range f.Sinks {
+		if async, ok := sink.(asyncSink); ok {
+			sendAsync(async, finish(f.Names[i]))
+		} else {
+			finish(f.Names[i])(send(sink))
+		}
+	}
+}
+
+// AddVehicle sets up a vehicle added at runtime in the sinks that need it
+func (f *FanOutSink) AddVehicle(v *VehicleSimulator) error {
+	var errs []error
+	for i, sink := range f.Sinks {
+		if setup, ok := sink.(vehicleSink); ok {
+			if err := setup.AddVehicle(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.Names[i], err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RemoveVehicle releases what the sinks hold for a removed vehicle
+func (f *FanOutSink) RemoveVehicle(v *VehicleSimulator) error {
+	var errs []error
+	for i, sink := range f.Sinks {
+		if setup, ok := sink.(vehicleSink); ok {
+			if err := setup.RemoveVehicle(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.Names[i], err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close flushes and closes every sink
+func (f *FanOutSink) Close() error {
+	var errs []error
+	for i, sink := range f.Sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sinkConfigs returns the configured sinks, or MQTT when there are none
+func sinkConfigs(config *Config) []SinkConfig {
+	if len(config.Sinks) == 0 {
+		return []SinkConfig{{Type: "mqtt"}}
+	}
+	return config.Sinks
+}
+
+// sinkTypes returns the type of every sink of the run
+func sinkTypes(config *Config) []string {
+	var types []string
+	for _, cfg := range sinkConfigs(config) {
+		types = append(types, cfg.Type)
+	}
+	return types
+}
+
+// newSinks creates the configured sinks; without any, telemetry goes to MQTT. MQTT
+// publishes are asynchronous when an in-flight limiter is given, and its overflow
+// setting also applies to the HTTP request queue.
+func newSinks(config *Config, simulators []*VehicleSimulator, clock Clock, inflight *InflightLimiter) (*FanOutSink, error) {
+	fanOut := &FanOutSink{}
+	for i, cfg := range sinkConfigs(config) {
+		var sink TelemetrySink
+		var err error
+		switch cfg.Type {
+		case "mqtt":
+			sink, err = NewMQTTSink(config, simulators, clock, inflight)
+		case "http":
+			sink, err = NewHTTPSink(cfg, clock, inflight)
+		case "tcp", "udp":
+			sink, err = NewStreamSink(cfg.Type, cfg.Address)
+		case "stdout":
+			sink = NewStdoutSink()
+		case "nmea":
+			sink, err = NewNMEASink(cfg, simulators)
+		case "tracker":
+			sink, err = NewTrackerSink(cfg)
+		default:
+			err = fmt.Errorf("unknown sink type: %q", cfg.Type)
+		}
+		if err != nil {
+			fanOut.Close()
+			return nil, fmt.Errorf("sink %d (%s): %w", i+1, cfg.Type, err)
+		}
+		fanOut.Sinks = append(fanOut.Sinks, sink)
+		fanOut.Names = append(fanOut.Names, cfg.Type)
+		log.Printf("Publishing telemetry to %s sink", cfg.Type)
+	}
+	return fanOut, nil
+}
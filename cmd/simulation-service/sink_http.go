@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPSink POSTs telemetry batches and events to an ingest endpoint, as JSON or in a
+// binary payload encoding. Requests are queued and posted by a background goroutine,
+// so retries and slow responses do not hold up the tick.
+type HTTPSink struct {
+	URL          string
+	EventURL     string
+	Headers      map[string]string
+	MaxRetries   int
+	RetryBackoff time.Duration
+	Encoding     PayloadEncoding
+	client       *http.Client
+	batches      *TelemetryBatchSender
+	inflight     *InflightLimiter // counts requests dropped by overflow: drop; nil always waits
+	queue        chan httpRequest
+	done         chan struct{}
+	closing      atomic.Bool // the last batches wait for room in the queue
+}
+
+// httpRequest is a body waiting to be posted
+type httpRequest struct {
+	url     string
+	body    payloadMessage
+	records int // telemetry records or events in the body
+}
+
+// NewHTTPSink creates an HTTP sink. Telemetry is batched by count and simulated time
+// like MQTT batches; each batch is one request. When the request queue is full, the
+// engine overflow setting decides between waiting and dropping.
+func NewHTTPSink(cfg SinkConfig, clock Clock, inflight *InflightLimiter) (*HTTPSink, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	encoding, err := parsePayloadEncoding(cfg.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	maxRetries := cfg.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	} else if maxRetries == 0 {
+		maxRetries = 3
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = 100
+	}
+
+	sink := &HTTPSink{
+		URL:          cfg.URL,
+		EventURL:     cfg.EventURL,
+		Headers:      cfg.Headers,
+		MaxRetries:   maxRetries,
+		RetryBackoff: parseDuration(cfg.RetryBackoff, time.Second),
+		Encoding:     encoding,
+		client:       &http.Client{Timeout: parseDuration(cfg.Timeout, 10*time.Second)},
+		inflight:     inflight,
+		queue:        make(chan httpRequest, queueSize),
+		done:         make(chan struct{}),
+	}
+	go sink.run()
+	sink.batches = NewTelemetryBatchSender(batchSize, parseDuration(cfg.BatchTimeout, 5*time.Second), clock,
+		func(_ string, batch *BatchTelemetry) error {
+			return sink.enqueue(sink.URL, batch, len(batch.Vehicles), sink.closing.Load())
+		})
+	sink.batches.MaxBytes = cfg.BatchMaxBytes
+	sink.batches.Encoding = encoding
+	sink.batches.Start()
+	return sink, nil
+}
+
+// run posts queued requests in order until the queue is closed
+func (s *HTTPSink) run() {
+	defer close(s.done)
+	for req := range s.queue {
+		if err := s.post(req.url, req.body); err != nil {
+			log.Printf("HTTP sink: failed to post %d records to %s: %v", req.records, req.url, err)
+		}
+	}
+}
+
+// enqueue hands a body to the poster. Unless wait is set, a full queue with
+// overflow: drop discards the request and counts its records as dropped.
+func (s *HTTPSink) enqueue(url string, body payloadMessage, records int, wait bool) error {
+	req := httpRequest{url: url, body: body, records: records}
+	if wait || s.inflight == nil || !s.inflight.drop {
+		s.queue <- req
+		return nil
+	}
+	select {
+	case s.queue <- req:
+		return nil
+	default:
+		s.inflight.dropped.Add(int64(records))
+		return errPublishDropped
+	}
+}
+
+// post sends an encoded body, retrying network errors, 429 and 5xx responses with
+// exponential backoff
+func (s *HTTPSink) post(url string, body payloadMessage) error {
+	data, err := s.Encoding.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	backoff := s.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = s.postOnce(url, data)
+		if err == nil {
+			return nil
+		}
+		if _, permanent := err.(permanentHTTPError); permanent || attempt >= s.MaxRetries {
+			return err
+		}
+		log.Printf("HTTP sink: %v, retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// permanentHTTPError is a response that retrying will not fix
+type permanentHTTPError struct {
+	status string
+}
+
+func (e permanentHTTPError) Error() string {
+	return "request rejected: " + e.status
+}
+
+// postOnce makes a single request
+func (s *HTTPSink) postOnce(url string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return permanentHTTPError{status: err.Error()}
+	}
+	req.Header.Set("Content-Type", s.Encoding.ContentType())
+	for name, value := range s.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("server returned %s", resp.Status)
+	default:
+		return permanentHTTPError{status: resp.Status}
+	}
+}
+
+// SendTelemetry adds the telemetry to the current batch and queues it when full
+func (s *HTTPSink) SendTelemetry(v *VehicleSimulator, telemetry *Telemetry) error {
+	return s.batches.AddTelemetry(s.URL, *telemetry)
+}
+
+// SendTelemetryAsync adds the telemetry to the current batch; a full batch that finds
+// the queue full may be dropped. done is called once the batch is queued.
+func (s *HTTPSink) SendTelemetryAsync(v *VehicleSimulator, telemetry *Telemetry, done func(error)) {
+	done(s.SendTelemetry(v, telemetry))
+}
+
+// SendEvent queues a lifecycle event when an event URL is configured, waiting for room
+// in the queue
+func (s *HTTPSink) SendEvent(v *VehicleSimulator, event *VehicleEvent) error {
+	return s.queueEvent(event, true)
+}
+
+// SendEventAsync queues a lifecycle event like SendEvent, but drops it when the queue
+// is full and overflow is drop
+func (s *HTTPSink) SendEventAsync(v *VehicleSimulator, event *VehicleEvent, done func(error)) {
+	done(s.queueEvent(event, false))
+}
+
+// queueEvent queues a copy of an event for the event URL
+func (s *HTTPSink) queueEvent(event *VehicleEvent, wait bool) error {
+	if s.EventURL == "" {
+		return nil
+	}
+	queued := *event
+	return s.enqueue(s.EventURL, &queued, 1, wait)
+}
+
+// Close queues the last partial batches and waits until every queued request is posted
+func (s *HTTPSink) Close() error {
+	s.closing.Store(true)
+	err := s.batches.Close()
+	close(s.queue)
+	<-s.done
+	return err
+}
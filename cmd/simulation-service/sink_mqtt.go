@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// MQTTSink publishes telemetry, events and batches to the MQTT broker, through each
+// vehicle's own connection in per-device mode
+type MQTTSink struct {
+	Client   *MQTTPublisher
+	Topics   *TopicTemplates
+	QoS      byte
+	Retain   bool
+	Encoding PayloadEncoding
+	GroupBy  string // template splitting batches that share a topic
+	batches  *TelemetryBatchSender
+	inflight *InflightLimiter
+	devices  *deviceClients // per-device mode only
+}
+
+// NewMQTTSink validates the MQTT configuration and connects to the broker
+func NewMQTTSink(config *Config, simulators []*VehicleSimulator, clock Clock, inflight *InflightLimiter) (*MQTTSink, error) {
+	if config.MQTT.QoS < 0 || config.MQTT.QoS > 2 {
+		return nil, fmt.Errorf("invalid QoS %d: must be 0, 1 or 2", config.MQTT.QoS)
+	}
+	encoding, err := parsePayloadEncoding(config.MQTT.PayloadEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload_encoding: %w", err)
+	}
+	topics, err := NewTopicTemplates(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topics: %w", err)
+	}
+	perDevice := config.MQTT.ConnectionMode == "per_device"
+	if !perDevice && config.MQTT.ConnectionMode != "" && config.MQTT.ConnectionMode != "shared" {
+		return nil, fmt.Errorf("invalid connection_mode %q: must be shared or per_device", config.MQTT.ConnectionMode)
+	}
+
+	// With per-device connections the shared client publishes batches
+	client, err := connectMQTT(config.MQTT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to broker: %w", err)
+	}
+
+	client.inflight = inflight
+	sink := &MQTTSink{
+		Client:   client,
+		Topics:   topics,
+		QoS:      byte(config.MQTT.QoS),
+		Retain:   config.MQTT.Retain,
+		Encoding: encoding,
+		GroupBy:  config.MQTT.Batch.GroupBy,
+		inflight: inflight,
+	}
+	batchSize := config.MQTT.Batch.Size
+	if batchSize <= 0 {
+		batchSize = 10
+	}
+	sink.batches = NewTelemetryBatchSender(batchSize, parseDuration(config.MQTT.Batch.Timeout, 30*time.Second), clock, sink.sendBatch)
+	sink.batches.MaxBytes = config.MQTT.Batch.MaxBytes
+	sink.batches.Encoding = encoding
+	if perDevice {
+		sink.devices, err = createDeviceClients(config, simulators, topics, inflight)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to create device connections: %w", err)
+		}
+	}
+	sink.batches.Start()
+	return sink, nil
+}
+
+// AddVehicle gives a vehicle added at runtime its own connection in per-device mode
+func (s *MQTTSink) AddVehicle(v *VehicleSimulator) error {
+	if s.devices == nil {
+		return nil
+	}
+	return s.devices.Add(v)
+}
+
+// RemoveVehicle disconnects a removed vehicle's own connection in per-device mode
+func (s *MQTTSink) RemoveVehicle(v *VehicleSimulator) error {
+	if s.devices != nil {
+		s.devices.Remove(v)
+	}
+	return nil
+}
+
+// device returns the connection a vehicle publishes through
+func (s *MQTTSink) device(v *VehicleSimulator) *MQTTPublisher {
+	if v.MQTT != nil {
+		return v.MQTT
+	}
+	return s.Client
+}
+
+// SendTelemetry publishes the telemetry, adds it to the vehicle's batch and waits
+// for the broker
+func (s *MQTTSink) SendTelemetry(v *VehicleSimulator, telemetry *Telemetry) error {
+	result := make(chan error, 1)
+	s.SendTelemetryAsync(v, telemetry, func(err error) { result <- err })
+	return <-result
+}
+
+// SendTelemetryAsync publishes the telemetry and adds it to the vehicle's batch.
+// done receives the result of the individual publish.
+func (s *MQTTSink) SendTelemetryAsync(v *VehicleSimulator, telemetry *Telemetry, done func(error)) {
+	// Only live positions are retained, so a replayed backlog never
+	// replaces the last known position
+	retain := s.Retain && !telemetry.Replayed
+	sendTelemetry(s.device(v), s.Topics.TelemetryTopic(v), s.QoS, retain, s.Encoding, telemetry, done)
+
+	// Also add to batch; batch failures are not the vehicle's
+	if err := s.batches.AddTelemetry(s.batchKey(v), *telemetry); err != nil {
+		log.Printf("Failed to publish batch telemetry: %v", err)
+	}
+}
+
+// batchKey is the batch topic, followed by the vehicle's group when group_by is set.
+// The separator is NUL, which MQTT topics cannot contain.
+func (s *MQTTSink) batchKey(v *VehicleSimulator) string {
+	key := s.Topics.BatchTopic(v)
+	if s.GroupBy != "" {
+		key += "\x00" + s.Topics.expand(s.GroupBy, v)
+	}
+	return key
+}
+
+// sendBatch publishes a batch on the topic of its key
+func (s *MQTTSink) sendBatch(key string, batch *BatchTelemetry) error {
+	topic, _, _ := strings.Cut(key, "\x00")
+	return SendBatchTelemetry(s.Client, topic, s.QoS, s.Encoding, batch)
+}
+
+// SendEvent publishes a lifecycle event and waits for the broker
+func (s *MQTTSink) SendEvent(v *VehicleSimulator, event *VehicleEvent) error {
+	result := make(chan error, 1)
+	s.SendEventAsync(v, event, func(err error) { result <- err })
+	return <-result
+}
+
+// SendEventAsync publishes a lifecycle event and reports the result to done
+func (s *MQTTSink) SendEventAsync(v *VehicleSimulator, event *VehicleEvent, done func(error)) {
+	sendEvent(s.device(v), s.Topics.EventTopic(v), s.QoS, s.Encoding, event, done)
+}
+
+// Close publishes partial batches, waits for outstanding acknowledgements and
+// disconnects the device and shared connections
+func (s *MQTTSink) Close() error {
+	err := s.batches.Close()
+	if s.inflight != nil && !s.inflight.Wait(10*time.Second) {
+		log.Printf("Warning: %d MQTT publishes still unacknowledged at shutdown", s.inflight.Inflight())
+	}
+	if s.devices != nil {
+		s.devices.Close()
+	}
+	s.Client.Close()
+	return err
+}
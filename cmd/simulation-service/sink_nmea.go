@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nmeaServer streams NMEA sentences to every connected TCP client
+type nmeaServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	clients  map[net.Conn]struct{}
+}
+
+// newNMEAServer listens on address and accepts clients in the background
+func newNMEAServer(address string) (*nmeaServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	server := &nmeaServer{listener: listener, clients: make(map[net.Conn]struct{})}
+	go server.accept()
+	return server, nil
+}
+
+// accept registers clients until the listener is closed
+func (s *nmeaServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("NMEA server on %s stopped accepting: %v", s.listener.Addr(), err)
+			}
+			return
+		}
+		s.mu.Lock()
+		s.clients[conn] = struct{}{}
+		s.mu.Unlock()
+	}
+}
+
+// broadcast writes data to every client, dropping clients that cannot keep up
+func (s *nmeaServer) broadcast(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.clients {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write(data); err != nil {
+			conn.Close()
+			delete(s.clients, conn)
+		}
+	}
+}
+
+// close stops listening and disconnects all clients
+func (s *nmeaServer) close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.clients {
+		conn.Close()
+		delete(s.clients, conn)
+	}
+	return err
+}
+
+// NMEASink serves $GPRMC, $GPGGA and $GPVTG sentences over TCP, either multiplexed
+// on one port with tag blocks naming the vehicle or on one port per vehicle, or
+// writes them to one file per vehicle
+type NMEASink struct {
+	Directory string
+	shared    *nmeaServer
+	vehicles  map[int]*nmeaServer
+	host      string // per-vehicle ports: the next vehicle is served on host:nextPort
+	nextPort  int
+	mu        sync.Mutex // guards files
+	files     map[int]*telemetryFile
+}
+
+// NewNMEASink creates the TCP servers or the output directory
+func NewNMEASink(cfg SinkConfig, simulators []*VehicleSimulator) (*NMEASink, error) {
+	sink := &NMEASink{
+		Directory: cfg.Directory,
+		vehicles:  make(map[int]*nmeaServer),
+		files:     make(map[int]*telemetryFile),
+	}
+	if cfg.Directory != "" {
+		if err := os.MkdirAll(cfg.Directory, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create NMEA directory: %w", err)
+		}
+		log.Printf("Writing NMEA sentences to %s", cfg.Directory)
+		return sink, nil
+	}
+
+	listen := cfg.Listen
+	if listen == "" {
+		listen = ":10110"
+	}
+	if !cfg.PerVehicle {
+		server, err := newNMEAServer(listen)
+		if err != nil {
+			return nil, err
+		}
+		sink.shared = server
+		log.Printf("Serving multiplexed NMEA for %d vehicles on %s", len(simulators), server.listener.Addr())
+		return sink, nil
+	}
+
+	// One port per vehicle, counting up from the listen port in simulator order
+	host, portText, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", listen, err)
+	}
+	basePort, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen port %q: %w", portText, err)
+	}
+	for i, simulator := range simulators {
+		server, err := newNMEAServer(net.JoinHostPort(host, strconv.Itoa(basePort+i)))
+		if err != nil {
+			sink.Close()
+			return nil, err
+		}
+		sink.vehicles[simulator.VehicleID] = server
+	}
+	sink.host, sink.nextPort = host, basePort+len(simulators)
+	log.Printf("Serving NMEA for %d vehicles on ports %d-%d", len(simulators), basePort, basePort+len(simulators)-1)
+	return sink, nil
+}
+
+// AddVehicle serves a vehicle added at runtime on the next port in per-vehicle mode
+func (s *NMEASink) AddVehicle(v *VehicleSimulator) error {
+	if s.nextPort == 0 {
+		return nil
+	}
+	address := net.JoinHostPort(s.host, strconv.Itoa(s.nextPort))
+	server, err := newNMEAServer(address)
+	if err != nil {
+		return err
+	}
+	s.vehicles[v.VehicleID] = server
+	s.nextPort++
+	log.Printf("Serving NMEA for vehicle %d on %s", v.VehicleID, address)
+	return nil
+}
+
+// RemoveVehicle stops serving a removed vehicle and closes its file
+func (s *NMEASink) RemoveVehicle(v *VehicleSimulator) error {
+	var errs []error
+	if server, exists := s.vehicles[v.VehicleID]; exists {
+		errs = append(errs, server.close())
+		delete(s.vehicles, v.VehicleID)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if file, exists := s.files[v.VehicleID]; exists {
+		errs = append(errs, file.close())
+		delete(s.files, v.VehicleID)
+	}
+	return errors.Join(errs...)
+}
+
+// SendTelemetry encodes the telemetry as NMEA sentences. Replayed points are skipped:
+// the sentences come from the receiver, which has no connectivity backlog.
+func (s *NMEASink) SendTelemetry(v *VehicleSimulator, telemetry *Telemetry) error {
+	if telemetry.Replayed {
+		return nil
+	}
+
+	if s.Directory != "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		file, exists := s.files[v.VehicleID]
+		if !exists {
+			var err error
+			path := filepath.Join(s.Directory, fmt.Sprintf("vehicle_%06d.nmea", v.VehicleID))
+			file, err = openTelemetryFile(path, "nmea")
+			if err != nil {
+				return err
+			}
+			s.files[v.VehicleID] = file
+		}
+		if err := file.write(telemetry); err != nil {
+			return err
+		}
+		return file.writer.Flush()
+	}
+
+	var lines strings.Builder
+	prefix := ""
+	server := s.vehicles[v.VehicleID]
+	if server == nil {
+		server = s.shared
+		prefix = nmeaTagBlock(v.VehicleID)
+	}
+	if server == nil {
+		return nil
+	}
+	for _, sentence := range EncodeNMEA(telemetry) {
+		lines.WriteString(prefix + sentence + "\r\n")
+	}
+	server.broadcast([]byte(lines.String()))
+	return nil
+}
+
+// SendEvent ignores lifecycle events, which have no NMEA representation
+func (s *NMEASink) SendEvent(v *VehicleSimulator, event *VehicleEvent) error {
+	return nil
+}
+
+// Close stops the servers and closes the files
+func (s *NMEASink) Close() error {
+	var errs []error
+	if s.shared != nil {
+		errs = append(errs, s.shared.close())
+	}
+	for _, server := range s.vehicles {
+		errs = append(errs, server.close())
+	}
+	for _, file := range s.files {
+		errs = append(errs, file.close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// streamRetryInterval is the delay between TCP connection attempts
+const streamRetryInterval = 5 * time.Second
+
+// StreamSink writes telemetry and events as JSON lines to a TCP connection, UDP
+// datagrams or stdout. Events carry a "type" field, telemetry does not.
+type StreamSink struct {
+	Network string // "tcp", "udp" or "" for stdout
+	Address string
+	mu      sync.Mutex
+	writer  io.Writer
+	conn    net.Conn
+	retryAt time.Time // no reconnect attempts before this after a failed dial
+	dropped int       // lines lost while disconnected
+}
+
+// NewStreamSink creates a TCP or UDP line sink. TCP connects lazily and reconnects
+// after write errors, so the receiver can be started after the simulator; lines
+// written while it is unreachable are dropped.
+func NewStreamSink(network, address string) (*StreamSink, error) {
+	if address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	sink := &StreamSink{Network: network, Address: address}
+	if network == "udp" {
+		if err := sink.dial(); err != nil {
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+// NewStdoutSink creates a sink printing JSON lines to stdout
+func NewStdoutSink() *StreamSink {
+	return &StreamSink{writer: os.Stdout}
+}
+
+// dial opens the network connection, at most once every streamRetryInterval
+func (s *StreamSink) dial() error {
+	if time.Now().Before(s.retryAt) {
+		s.dropped++
+		return nil
+	}
+	conn, err := net.DialTimeout(s.Network, s.Address, 5*time.Second)
+	if err != nil {
+		s.retryAt = time.Now().Add(streamRetryInterval)
+		s.dropped++
+		return fmt.Errorf("failed to connect to %s (retrying in %s): %w", s.Address, streamRetryInterval, err)
+	}
+	if s.dropped > 0 {
+		log.Printf("Connected to %s after dropping %d lines", s.Address, s.dropped)
+		s.dropped = 0
+	}
+	s.conn = conn
+	s.writer = conn
+	return nil
+}
+
+// writeLine writes one JSON document followed by a newline; for UDP each line is
+// one datagram
+func (s *StreamSink) writeLine(value payloadMessage) error {
+	data, err := EncodingJSON.Marshal(value)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer == nil {
+		if err := s.dial(); err != nil || s.writer == nil {
+			return err
+		}
+	}
+	if _, err := s.writer.Write(data); err != nil {
+		if s.Network == "udp" && errors.Is(err, syscall.ECONNREFUSED) {
+			// Nobody is listening yet; datagrams are fire and forget
+			return nil
+		}
+		if s.Network != "tcp" {
+			return err
+		}
+		// Reconnect once; the line is lost if that fails too
+		s.conn.Close()
+		s.conn, s.writer = nil, nil
+		if err := s.dial(); err != nil || s.writer == nil {
+			return err
+		}
+		_, err = s.writer.Write(data)
+		return err
+	}
+	return nil
+}
+
+// SendTelemetry writes the telemetry as a JSON line
+func (s *StreamSink) SendTelemetry(v *VehicleSimulator, telemetry *Telemetry) error {
+	return s.writeLine(telemetry)
+}
+
+// SendEvent writes the event as a JSON line
+func (s *StreamSink) SendEvent(v *VehicleSimulator, event *VehicleEvent) error {
+	return s.writeLine(event)
+}
+
+// Close closes the network connection
+func (s *StreamSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.writer = nil, nil
+	return err
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// trackerProtocol is the device side of a binary tracker protocol
+type trackerProtocol interface {
+	// login identifies the device by IMEI and waits for the server to accept it
+	login(conn net.Conn, imei string, timeout time.Duration) error
+	// send transmits records and returns how many of them the server acknowledged
+	send(conn net.Conn, records []trackerRecord, timeout time.Duration) (int, error)
+	// maxRecords is the largest number of records passed to one send call
+	maxRecords() int
+}
+
+// newTrackerProtocol creates the protocol state of one device
+func newTrackerProtocol(cfg SinkConfig, vehicleID int) (trackerProtocol, error) {
+	switch cfg.Protocol {
+	case "", "teltonika", "codec8":
+		return &teltonikaProtocol{codec: teltonikaCodec8}, nil
+	case "codec8e":
+		return &teltonikaProtocol{codec: teltonikaCodec8E}, nil
+	case "gt06":
+		return &gt06Protocol{
+			cellID:            vehicleID & 0xFFFFFF,
+			heartbeatInterval: parseDuration(cfg.HeartbeatInterval, 3*time.Minute),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown tracker protocol: %q", cfg.Protocol)
+	}
+}
+
+// trackerIMEI derives a valid 15-digit IMEI from a prefix and the vehicle ID
+func trackerIMEI(prefix string, vehicleID int) string {
+	if len(prefix) > 13 {
+		prefix = prefix[:13]
+	}
+	serial := strconv.Itoa(vehicleID)
+	body := prefix
+	for len(body)+len(serial) < 14 {
+		body += "0"
+	}
+	body = (body + serial)[:14]
+
+	// Luhn check digit
+	sum := 0
+	for i := 0; i < 14; i++ {
+		digit := int(body[13-i] - '0')
+		if i%2 == 0 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return body + strconv.Itoa((10-sum%10)%10)
+}
+
+// trackerDevice is one emulated tracker with its own connection. Records wait in
+// pending until the server acknowledges them and are resent after failures.
+type trackerDevice struct {
+	vehicleID  int
+	imei       string
+	address    string
+	protocol   trackerProtocol
+	ackTimeout time.Duration
+	maxPending int
+
+	input   chan trackerRecord
+	done    chan struct{}
+	conn    net.Conn
+	pending []trackerRecord
+
+	// counters, read after the device stopped
+	sent     int
+	resent   int
+	dropped  int
+	failures int
+}
+
+// run sends records until input is closed, then tries once more to deliver the backlog.
+// After a failure, records are only queued until the retry backoff has passed.
+func (d *trackerDevice) run() {
+	defer close(d.done)
+	defer func() {
+		if d.conn != nil {
+			d.conn.Close()
+		}
+	}()
+
+	backoff := time.Second
+	var retry <-chan time.Time
+	for {
+		select {
+		case record, ok := <-d.input:
+			if !ok {
+				d.flush()
+				return
+			}
+			d.enqueue(record)
+			if retry != nil {
+				continue
+			}
+		case <-retry:
+			retry = nil
+		}
+
+		if err := d.flush(); err != nil {
+			d.failures++
+			log.Printf("Tracker %s (vehicle %d): %v; %d records pending, retrying in %s",
+				d.imei, d.vehicleID, err, len(d.pending), backoff)
+			retry = time.After(backoff)
+			backoff = min(2*backoff, time.Minute)
+		} else {
+			backoff = time.Second
+		}
+	}
+}
+
+// enqueue adds a record, dropping the oldest one when the backlog is full
+func (d *trackerDevice) enqueue(record trackerRecord) {
+	if len(d.pending) >= d.maxPending {
+		d.pending = d.pending[1:]
+		d.dropped++
+	}
+	d.pending = append(d.pending, record)
+}
+
+// flush connects if needed and sends pending records until all are acknowledged
+func (d *trackerDevice) flush() error {
+	for len(d.pending) > 0 {
+		if d.conn == nil {
+			conn, err := net.DialTimeout("tcp", d.address, d.ackTimeout)
+			if err != nil {
+				return err
+			}
+			if err := d.protocol.login(conn, d.imei, d.ackTimeout); err != nil {
+				conn.Close()
+				return fmt.Errorf("login failed: %w", err)
+			}
+			d.conn = conn
+		}
+
+		batch := d.pending
+		if len(batch) > d.protocol.maxRecords() {
+			batch = batch[:d.protocol.maxRecords()]
+		}
+		acked, err := d.protocol.send(d.conn, batch, d.ackTimeout)
+		d.pending = d.pending[acked:]
+		d.sent += acked
+		if err != nil || acked < len(batch) {
+			// Unacknowledged records are resent on a fresh connection
+			d.resent += len(batch) - acked
+			d.conn.Close()
+			d.conn = nil
+			if err == nil {
+				err = fmt.Errorf("server acknowledged %d of %d records", acked, len(batch))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// TrackerSink emulates one binary-protocol tracker per vehicle, each with its own
+// TCP connection to the tracking server
+type TrackerSink struct {
+	cfg      SinkConfig
+	mu       sync.Mutex
+	devices  map[int]*trackerDevice
+	removed  []*trackerDevice // of removed vehicles, delivering their backlog
+	overflow int              // records dropped because a device could not keep up
+}
+
+// NewTrackerSink validates the protocol; devices connect when they have data
+func NewTrackerSink(cfg SinkConfig) (*TrackerSink, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	if _, err := newTrackerProtocol(cfg, 0); err != nil {
+		return nil, err
+	}
+	if cfg.IMEIPrefix == "" {
+		cfg.IMEIPrefix = "35693803"
+	}
+	return &TrackerSink{cfg: cfg, devices: make(map[int]*trackerDevice)}, nil
+}
+
+// device returns the emulator of a vehicle, starting it on first use
+func (s *TrackerSink) device(vehicleID int) *trackerDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if device, exists := s.devices[vehicleID]; exists {
+		return device
+	}
+
+	protocol, _ := newTrackerProtocol(s.cfg, vehicleID)
+	maxPending := s.cfg.MaxPending
+	if maxPending <= 0 {
+		maxPending = 10000
+	}
+	device := &trackerDevice{
+		vehicleID:  vehicleID,
+		imei:       trackerIMEI(s.cfg.IMEIPrefix, vehicleID),
+		address:    s.cfg.Address,
+		protocol:   protocol,
+		ackTimeout: parseDuration(s.cfg.AckTimeout, 5*time.Second),
+		maxPending: maxPending,
+		input:      make(chan trackerRecord, 256),
+		done:       make(chan struct{}),
+	}
+	s.devices[vehicleID] = device
+	go device.run()
+	return device
+}
+
+// SendTelemetry hands the record to the vehicle's tracker without waiting for the network
+func (s *TrackerSink) SendTelemetry(v *VehicleSimulator, telemetry *Telemetry) error {
+	select {
+	case s.device(v.VehicleID).input <- newTrackerRecord(v, telemetry):
+		return nil
+	default:
+		s.mu.Lock()
+		s.overflow++
+		s.mu.Unlock()
+		return fmt.Errorf("tracker for vehicle %d is not keeping up, record dropped", v.VehicleID)
+	}
+}
+
+// AddVehicle does nothing; a tracker connects when it first has data
+func (s *TrackerSink) AddVehicle(v *VehicleSimulator) error {
+	return nil
+}
+
+// RemoveVehicle stops a removed vehicle's tracker. It delivers its backlog and closes
+// its connection in the background.
+func (s *TrackerSink) RemoveVehicle(v *VehicleSimulator) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if device, exists := s.devices[v.VehicleID]; exists {
+		close(device.input)
+		delete(s.devices, v.VehicleID)
+		s.removed = append(s.removed, device)
+	}
+	return nil
+}
+
+// SendEvent ignores lifecycle events; trackers only report positions
+func (s *TrackerSink) SendEvent(v *VehicleSimulator, event *VehicleEvent) error {
+	return nil
+}
+
+// Close stops every tracker after a last attempt to deliver its backlog
+func (s *TrackerSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent, resent, dropped, pending := 0, 0, s.overflow, 0
+	devices := s.removed
+	for _, device := range s.devices {
+		close(device.input)
+		devices = append(devices, device)
+	}
+	for _, device := range devices {
+		<-device.done
+		sent += device.sent
+		resent += device.resent
+		dropped += device.dropped
+		pending += len(device.pending)
+	}
+	log.Printf("Trackers: %d records acknowledged, %d resent, %d dropped, %d undelivered",
+		sent, resent, dropped, pending)
+	return nil
+}
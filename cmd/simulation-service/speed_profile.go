@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// minProfileSpeed keeps vehicles moving through segments annotated with near-zero speeds (m/s)
+const minProfileSpeed = 0.5
+
+// annotationSegment is one OSRM annotation entry: a segment between two geometry coordinates
+type annotationSegment struct {
+	distance float64
+	speed    float64
+}
+
+// routeAnnotations flattens the per-leg OSRM annotations of a route
+func routeAnnotations(route *Route) []annotationSegment {
+	var segments []annotationSegment
+	for _, leg := range route.Route.Legs {
+		if leg.Annotation == nil {
+			continue
+		}
+		a := leg.Annotation
+		count := len(a.Speed)
+		if len(a.Distance) > count {
+			count = len(a.Distance)
+		}
+		for i := 0; i < count; i++ {
+			var segment annotationSegment
+			if i < len(a.Distance) {
+				segment.distance = a.Distance[i]
+			}
+			if i < len(a.Speed) {
+				segment.speed = a.Speed[i]
+			}
+			// Derive speed from distance and duration when OSRM did not report it
+			if segment.speed <= 0 && i < len(a.Duration) && a.Duration[i] > 0 {
+				segment.speed = segment.distance / a.Duration[i]
+			}
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// buildSegmentSpeeds maps the route's OSRM annotations onto the iterator's geometry
+// segments. Annotations line up one-to-one with the full overview geometry; when the
+// counts differ the annotations are matched by fraction of the route distance instead.
+func buildSegmentSpeeds(ri *RouteIterator, route *Route) []float64 {
+	annotations := routeAnnotations(route)
+	if len(annotations) == 0 || len(ri.SegmentLengths) == 0 {
+		return nil
+	}
+
+	// Fallback for unusable entries: the route's average speed
+	fallback := 20.0
+	if route.Metadata.Duration > 0 && route.Metadata.Distance > 0 {
+		fallback = route.Metadata.Distance / route.Metadata.Duration
+	}
+	usable := func(speed float64) float64 {
+		if math.IsNaN(speed) || math.IsInf(speed, 0) || speed <= 0 {
+			return fallback
+		}
+		return math.Max(speed, minProfileSpeed)
+	}
+
+	speeds := make([]float64, len(ri.SegmentLengths))
+	if len(annotations) == len(speeds) {
+		for i, annotation := range annotations {
+			speeds[i] = usable(annotation.speed)
+		}
+		return speeds
+	}
+
+	// Cumulative annotation distance, falling back to equal weights
+	cumulative := make([]float64, len(annotations))
+	total := 0.0
+	for i, annotation := range annotations {
+		weight := annotation.distance
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		cumulative[i] = total
+	}
+
+	for i := range speeds {
+		fraction := 0.0
+		if ri.TotalLength > 0 {
+			fraction = (ri.SegmentStarts[i] + ri.SegmentLengths[i]/2) / ri.TotalLength
+		}
+		index := sort.SearchFloat64s(cumulative, fraction*total)
+		if index >= len(annotations) {
+			index = len(annotations) - 1
+		}
+		speeds[i] = usable(annotations[index].speed)
+	}
+	return speeds
+}
+
+// SegmentAt returns the index of the segment containing the given distance along the route
+func (ri *RouteIterator) SegmentAt(distance float64) int {
+	index := sort.Search(len(ri.SegmentStarts), func(i int) bool {
+		return ri.SegmentStarts[i] > distance
+	}) - 1
+	if index < 0 {
+		return 0
+	}
+	return index
+}
+
+// SpeedAt returns the annotated speed at the given distance, if the route has annotations
+func (ri *RouteIterator) SpeedAt(distance float64) (float64, bool) {
+	if ri.SegmentSpeeds == nil {
+		return 0, false
+	}
+	return ri.SegmentSpeeds[ri.SegmentAt(distance)], true
+}
+
+// AdvanceAlongProfile moves from distance for dt seconds following the annotated
+// segment speeds scaled by factor, and returns the distance covered. Movement stops
+// at the end of the route.
+func (ri *RouteIterator) AdvanceAlongProfile(distance, dt, factor float64) float64 {
+	position := distance
+	remaining := dt
+	for remaining > 0 && position < ri.TotalLength {
+		i := ri.SegmentAt(position)
+		speed := math.Max(ri.SegmentSpeeds[i]*factor, minProfileSpeed)
+
+		toSegmentEnd := ri.SegmentStarts[i] + ri.SegmentLengths[i] - position
+		if toSegmentEnd <= 0 {
+			// Zero-length or floating point leftover at the last segment
+			break
+		}
+
+		timeToSegmentEnd := toSegmentEnd / speed
+		if timeToSegmentEnd >= remaining {
+			position += speed * remaining
+			remaining = 0
+		} else {
+			position += toSegmentEnd
+			remaining -= timeToSegmentEnd
+		}
+	}
+	return position - distance
+}
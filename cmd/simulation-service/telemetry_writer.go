@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// OutputConfig defines where telemetry goes when the simulation does not publish to MQTT
+type OutputConfig struct {
+	Mode        string `yaml:"mode"`         // "mqtt" (default) or "file"
+	Format      string `yaml:"format"`       // "jsonl", "csv", "geojson" or "nmea"
+	Directory   string `yaml:"directory"`    // output directory for file mode
+	Split       string `yaml:"split"`        // "none", "vehicle" or "window"
+	Window      string `yaml:"window"`       // window length when split is "window", e.g. "1h"
+	MaxDuration string `yaml:"max_duration"` // optional cap on simulated time, e.g. "24h"
+	Report      string `yaml:"report"`       // JSON run report written when live mode stops, default "run_report.json"
+}
+
+// csvHeader lists the CSV columns in the order written by csvRecord
+var csvHeader = []string{"vehicle_id", "timestamp", "lat", "lon", "spd", "hdg", "alt", "acc", "battery", "signal", "fuel", "odometer", "engine_hours", "replayed"}
+
+// csvRecord converts telemetry into a CSV row
+func csvRecord(t *Telemetry) []string {
+	fuel := ""
+	if t.Fuel != nil {
+		fuel = strconv.FormatFloat(*t.Fuel, 'f', 1, 64)
+	}
+	return []string{
+		strconv.Itoa(t.VehicleID),
+		strconv.FormatInt(t.Timestamp, 10),
+		strconv.FormatFloat(t.Lat, 'f', 6, 64),
+		strconv.FormatFloat(t.Lon, 'f', 6, 64),
+		strconv.FormatFloat(t.Speed, 'f', 2, 64),
+		strconv.FormatFloat(t.Heading, 'f', 1, 64),
+		strconv.FormatFloat(t.Altitude, 'f', 1, 64),
+		strconv.FormatFloat(t.Accuracy, 'f', 1, 64),
+		strconv.FormatFloat(t.Battery, 'f', 1, 64),
+		strconv.FormatFloat(t.Signal, 'f', 1, 64),
+		fuel,
+		strconv.FormatFloat(t.Odometer, 'f', 3, 64),
+		strconv.FormatFloat(t.EngineHours, 'f', 4, 64),
+		strconv.FormatBool(t.Replayed),
+	}
+}
+
+// telemetryFile is a single open output file in one of the supported formats
+type telemetryFile struct {
+	format  string
+	tagged  bool // prefix NMEA sentences with a tag block naming the vehicle
+	file    *os.File
+	writer  *bufio.Writer
+	csv     *csv.Writer
+	records int
+}
+
+// openTelemetryFile creates the file and writes any format header
+func openTelemetryFile(path, format string) (*telemetryFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+
+	tf := &telemetryFile{
+		format: format,
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+
+	switch format {
+	case "csv":
+		tf.csv = csv.NewWriter(tf.writer)
+		err = tf.csv.Write(csvHeader)
+	case "geojson":
+		_, err = tf.writer.WriteString(`{"type":"FeatureCollection","features":[` + "\n")
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write header to %s: %w", path, err)
+	}
+
+	return tf, nil
+}
+
+// write appends one telemetry record
+func (tf *telemetryFile) write(t *Telemetry) error {
+	defer func() { tf.records++ }()
+
+	switch tf.format {
+	case "csv":
+		row := csvRecord(t)
+		if t.fault == nil {
+			return tf.csv.Write(row)
+		}
+		if t.fault.field != "" {
+			row = t.fault.applyCSV(row)
+		}
+		if t.fault.cut == 0 {
+			return tf.csv.Write(row)
+		}
+		// A truncated row is cut short like an encoded payload and ends the line
+		var line bytes.Buffer
+		lineWriter := csv.NewWriter(&line)
+		lineWriter.Write(row)
+		lineWriter.Flush()
+		tf.csv.Flush()
+		if err := tf.csv.Error(); err != nil {
+			return err
+		}
+		_, err := tf.writer.Write(append(t.fault.truncate(bytes.TrimSuffix(line.Bytes(), []byte("\n"))), '\n'))
+		return err
+	case "nmea":
+		prefix := ""
+		if tf.tagged {
+			prefix = nmeaTagBlock(t.VehicleID)
+		}
+		for _, sentence := range EncodeNMEA(t) {
+			if _, err := tf.writer.WriteString(prefix + sentence + "\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "geojson":
+		// Properties carry nan and null faults like JSON payloads. NaN is not valid
+		// JSON, so the feature is put together without re-encoding them.
+		properties, err := EncodingJSON.Marshal(t)
+		if err != nil {
+			return err
+		}
+		geometry, err := json.Marshal(struct {
+			Type        string     `json:"type"`
+			Coordinates [2]float64 `json:"coordinates"`
+		}{Type: "Point", Coordinates: [2]float64{t.Lon, t.Lat}})
+		if err != nil {
+			return err
+		}
+		feature := `{"type":"Feature","geometry":` + string(geometry) + `,"properties":` + string(properties) + `}`
+		if tf.records > 0 {
+			if _, err := tf.writer.WriteString(",\n"); err != nil {
+				return err
+			}
+		}
+		_, err = tf.writer.WriteString(feature)
+		return err
+	default:
+		data, err := EncodingJSON.Marshal(t)
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		_, err = tf.writer.Write(data)
+		return err
+	}
+}
+
+// close writes any format footer and closes the file
+func (tf *telemetryFile) close() error {
+	switch tf.format {
+	case "csv":
+		tf.csv.Flush()
+		if err := tf.csv.Error(); err != nil {
+			tf.file.Close()
+			return err
+		}
+	case "geojson":
+		if _, err := tf.writer.WriteString("\n]}\n"); err != nil {
+			tf.file.Close()
+			return err
+		}
+	}
+	if err := tf.writer.Flush(); err != nil {
+		tf.file.Close()
+		return err
+	}
+	return tf.file.Close()
+}
+
+// FileTelemetryWriter writes telemetry to JSON Lines, CSV, GeoJSON or NMEA files,
+// optionally split per vehicle or per simulation-time window
+type FileTelemetryWriter struct {
+	Directory string
+	Format    string
+	Split     string
+	Window    time.Duration
+
+	files        map[string]*telemetryFile
+	events       *telemetryFile
+	filesWritten int
+	recordsTotal int
+}
+
+// NewFileTelemetryWriter creates a writer from the output configuration
+func NewFileTelemetryWriter(cfg OutputConfig) (*FileTelemetryWriter, error) {
+	format := cfg.Format
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "csv" && format != "geojson" && format != "nmea" {
+		return nil, fmt.Errorf("unsupported output format: %s", format)
+	}
+
+	split := cfg.Split
+	if split == "" {
+		split = "none"
+	}
+	if split != "none" && split != "vehicle" && split != "window" {
+		return nil, fmt.Errorf("unsupported output split: %s", split)
+	}
+
+	directory := cfg.Directory
+	if directory == "" {
+		directory = "./telemetry_output"
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	return &FileTelemetryWriter{
+		Directory: directory,
+		Format:    format,
+		Split:     split,
+		Window:    parseDuration(cfg.Window, time.Hour),
+		files:     make(map[string]*telemetryFile),
+	}, nil
+}
+
+// fileName returns the output file name for a telemetry record
+func (w *FileTelemetryWriter) fileName(t *Telemetry) string {
+	switch w.Split {
+	case "vehicle":
+		return fmt.Sprintf("vehicle_%06d.%s", t.VehicleID, w.Format)
+	case "window":
+		windowStart := time.Unix(t.Timestamp, 0).UTC().Truncate(w.Window)
+		return fmt.Sprintf("telemetry_%s.%s", windowStart.Format("20060102T150405Z"), w.Format)
+	default:
+		return "telemetry." + w.Format
+	}
+}
+
+// Write appends a telemetry record to the file it belongs to
+func (w *FileTelemetryWriter) Write(t *Telemetry) error {
+	// Windows stay open until Close: replayed points can arrive late for an earlier window
+	name := w.fileName(t)
+	file, exists := w.files[name]
+	if !exists {
+		var err error
+		file, err = openTelemetryFile(filepath.Join(w.Directory, name), w.Format)
+		if err != nil {
+			return err
+		}
+		file.tagged = w.Split != "vehicle"
+		w.files[name] = file
+		w.filesWritten++
+	}
+
+	if err := file.write(t); err != nil {
+		return fmt.Errorf("failed to write telemetry to %s: %w", name, err)
+	}
+	w.recordsTotal++
+	return nil
+}
+
+// WriteEvent appends a lifecycle event to events.jsonl in the output directory
+func (w *FileTelemetryWriter) WriteEvent(event *VehicleEvent) error {
+	if w.events == nil {
+		file, err := openTelemetryFile(filepath.Join(w.Directory, "events.jsonl"), "jsonl")
+		if err != nil {
+			return err
+		}
+		w.events = file
+		w.filesWritten++
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := w.events.writer.Write(data); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	return nil
+}
+
+// closeFiles closes every open file
+func (w *FileTelemetryWriter) closeFiles() error {
+	var firstErr error
+	for name, file := range w.files {
+		if err := file.close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close %s: %w", name, err)
+		}
+		delete(w.files, name)
+	}
+	return firstErr
+}
+
+// Close flushes and closes all output files
+func (w *FileTelemetryWriter) Close() error {
+	err := w.closeFiles()
+	if w.events != nil {
+		if closeErr := w.events.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		w.events = nil
+	}
+	return err
+}
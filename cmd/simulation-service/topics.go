@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TopicTemplates builds the MQTT topics a vehicle publishes to. Templates may contain
+// {fleet}, {vehicle_id}, {route_id} and {vehicle_type} placeholders.
+type TopicTemplates struct {
+	Fleet     string
+	Telemetry string
+	Events    string
+	Batch     string
+	Suffix    string // payload encoding indicator appended to every topic
+}
+
+// NewTopicTemplates resolves the configured templates. Without templates every vehicle
+// shares the plain topic, with "_events" and "_batch" suffixes for events and batches.
+func NewTopicTemplates(config *Config) (*TopicTemplates, error) {
+	tt := &TopicTemplates{
+		Fleet:     config.MQTT.Fleet,
+		Telemetry: config.MQTT.TopicTemplate,
+		Events:    config.MQTT.EventTopicTemplate,
+		Batch:     config.MQTT.BatchTopicTemplate,
+	}
+	if tt.Fleet == "" {
+		tt.Fleet = "default"
+	}
+	if tt.Telemetry == "" {
+		tt.Telemetry = config.MQTT.Topic
+	}
+	if tt.Events == "" {
+		tt.Events = config.MQTT.Topic + "_events"
+	}
+	if tt.Batch == "" {
+		tt.Batch = config.MQTT.Topic + "_batch"
+	}
+
+	encoding, err := parsePayloadEncoding(config.MQTT.PayloadEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if config.MQTT.EncodingTopicSuffix == nil || *config.MQTT.EncodingTopicSuffix {
+		tt.Suffix = encoding.TopicSuffix()
+	}
+
+	for name, template := range map[string]string{"topic_template": tt.Telemetry,
+		"event_topic_template": tt.Events, "batch_topic_template": tt.Batch} {
+		if template == "" {
+			return nil, fmt.Errorf("%s is empty and no topic is configured", name)
+		}
+		if strings.ContainsAny(template, "+#") {
+			return nil, fmt.Errorf("%s %q must not contain MQTT wildcards", name, template)
+		}
+	}
+	return tt, nil
+}
+
+// expand fills in the placeholders of a template for one vehicle
+func (tt *TopicTemplates) expand(template string, v *VehicleSimulator) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	return strings.NewReplacer(
+		"{fleet}", tt.Fleet,
+		"{vehicle_id}", strconv.Itoa(v.VehicleID),
+		"{route_id}", strconv.Itoa(v.Route.Metadata.ID),
+		"{vehicle_type}", v.TypeName,
+	).Replace(template)
+}
+
+// TelemetryTopic returns the topic of a vehicle's individual telemetry
+func (tt *TopicTemplates) TelemetryTopic(v *VehicleSimulator) string {
+	return tt.expand(tt.Telemetry, v) + tt.Suffix
+}
+
+// EventTopic returns the topic of a vehicle's lifecycle events
+func (tt *TopicTemplates) EventTopic(v *VehicleSimulator) string {
+	return tt.expand(tt.Events, v) + tt.Suffix
+}
+
+// BatchTopic returns the topic a vehicle's telemetry is batched under. Vehicles whose
+// batch topics expand to the same string share a batch.
+func (tt *TopicTemplates) BatchTopic(v *VehicleSimulator) string {
+	return tt.expand(tt.Batch, v) + tt.Suffix
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// GT06 protocol numbers
+const (
+	gt06Login     = 0x01
+	gt06Location  = 0x12
+	gt06Heartbeat = 0x13
+)
+
+// crc16ITU computes the CRC-ITU (CRC-16/X-25) checksum used by GT06 packets
+func crc16ITU(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+// encodeGT06Packet frames a GT06 packet: start bits, length, protocol number,
+// content, serial number, CRC and stop bits
+func encodeGT06Packet(protocol byte, content []byte, serial uint16) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(1 + len(content) + 2 + 2)) // protocol + content + serial + CRC
+	body.WriteByte(protocol)
+	body.Write(content)
+	binary.Write(&body, binary.BigEndian, serial)
+
+	var packet bytes.Buffer
+	packet.Write([]byte{0x78, 0x78})
+	packet.Write(body.Bytes())
+	binary.Write(&packet, binary.BigEndian, crc16ITU(body.Bytes()))
+	packet.Write([]byte{0x0D, 0x0A})
+	return packet.Bytes()
+}
+
+// readGT06Packet reads one packet and returns its protocol number, content and serial
+func readGT06Packet(reader io.Reader) (byte, []byte, uint16, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, 0, err
+	}
+	if header[0] != 0x78 || header[1] != 0x78 {
+		return 0, nil, 0, fmt.Errorf("invalid start bits % X", header[:2])
+	}
+	length := int(header[2])
+	if length < 5 {
+		return 0, nil, 0, fmt.Errorf("invalid packet length %d", length)
+	}
+	rest := make([]byte, length+2) // protocol ... CRC, stop bits
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return 0, nil, 0, err
+	}
+
+	body := append([]byte{header[2]}, rest[:length-2]...)
+	if crc := binary.BigEndian.Uint16(rest[length-2 : length]); crc != crc16ITU(body) {
+		return 0, nil, 0, fmt.Errorf("CRC mismatch")
+	}
+	serial := binary.BigEndian.Uint16(rest[length-4 : length-2])
+	return rest[0], rest[1 : length-4], serial, nil
+}
+
+// gt06TerminalID encodes a 15-digit IMEI as 8 BCD bytes with a leading zero
+func gt06TerminalID(imei string) []byte {
+	digits := "0" + imei
+	id := make([]byte, 8)
+	for i := 0; i < 8; i++ {
+		id[i] = (digits[2*i]-'0')<<4 | (digits[2*i+1] - '0')
+	}
+	return id
+}
+
+// encodeGT06Location builds the content of a location packet
+func encodeGT06Location(r trackerRecord, cellID int) []byte {
+	var content bytes.Buffer
+	t := r.Time.UTC()
+	content.Write([]byte{byte(t.Year() % 100), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second())})
+	content.WriteByte(0xC0 | byte(math.Min(15, float64(r.Satellites))))
+	binary.Write(&content, binary.BigEndian, uint32(math.Round(math.Abs(r.Lat)*1800000)))
+	binary.Write(&content, binary.BigEndian, uint32(math.Round(math.Abs(r.Lon)*1800000)))
+	content.WriteByte(byte(math.Min(255, float64(r.Speed))))
+
+	// Course and status: bit 12 positioned, bit 11 west, bit 10 north, bits 0-9 course
+	status := uint16(r.Heading&0x3FF) | 1<<12
+	if r.Lon < 0 {
+		status |= 1 << 11
+	}
+	if r.Lat >= 0 {
+		status |= 1 << 10
+	}
+	binary.Write(&content, binary.BigEndian, status)
+
+	// Serving cell: MCC, MNC, LAC and a per-vehicle cell ID
+	binary.Write(&content, binary.BigEndian, uint16(432))
+	content.WriteByte(11)
+	binary.Write(&content, binary.BigEndian, uint16(0x1000))
+	content.Write([]byte{byte(cellID >> 16), byte(cellID >> 8), byte(cellID)})
+	return content.Bytes()
+}
+
+// decodeGT06Location parses the content of a location packet, for the test server
+func decodeGT06Location(content []byte) (trackerRecord, error) {
+	if len(content) < 18 {
+		return trackerRecord{}, fmt.Errorf("location packet too short")
+	}
+	record := trackerRecord{
+		Time: time.Date(2000+int(content[0]), time.Month(content[1]), int(content[2]),
+			int(content[3]), int(content[4]), int(content[5]), 0, time.UTC),
+		Satellites: int(content[6] & 0x0F),
+		Lat:        float64(binary.BigEndian.Uint32(content[7:11])) / 1800000,
+		Lon:        float64(binary.BigEndian.Uint32(content[11:15])) / 1800000,
+		Speed:      int(content[15]),
+	}
+	status := binary.BigEndian.Uint16(content[16:18])
+	record.Heading = int(status & 0x3FF)
+	if status&(1<<10) == 0 {
+		record.Lat = -record.Lat
+	}
+	if status&(1<<11) != 0 {
+		record.Lon = -record.Lon
+	}
+	return record, nil
+}
+
+// gt06Protocol emulates a GT06 (Concox) tracker. Login and heartbeat packets are
+// acknowledged by the server; location packets are not, as in the protocol.
+type gt06Protocol struct {
+	cellID            int
+	heartbeatInterval time.Duration
+	serial            uint16
+	lastHeartbeat     time.Time
+}
+
+// nextSerial returns the next information serial number
+func (p *gt06Protocol) nextSerial() uint16 {
+	p.serial++
+	return p.serial
+}
+
+// request writes a packet and waits for the server's response with the same protocol number
+func (p *gt06Protocol) request(conn net.Conn, protocol byte, content []byte, timeout time.Duration) error {
+	serial := p.nextSerial()
+	if _, err := conn.Write(encodeGT06Packet(protocol, content, serial)); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	replyProtocol, _, replySerial, err := readGT06Packet(conn)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement: %w", err)
+	}
+	if replyProtocol != protocol || replySerial != serial {
+		return fmt.Errorf("unexpected acknowledgement 0x%02X/%d for 0x%02X/%d", replyProtocol, replySerial, protocol, serial)
+	}
+	return nil
+}
+
+// login sends the terminal ID and waits for the server's response
+func (p *gt06Protocol) login(conn net.Conn, imei string, timeout time.Duration) error {
+	p.serial = 0
+	p.lastHeartbeat = time.Time{}
+	return p.request(conn, gt06Login, gt06TerminalID(imei), timeout)
+}
+
+// maxRecords is the number of records sent per call
+func (p *gt06Protocol) maxRecords() int {
+	return 10
+}
+
+// send writes location packets, preceded by a heartbeat carrying battery and signal
+// whenever heartbeat_interval of simulated time has passed
+func (p *gt06Protocol) send(conn net.Conn, records []trackerRecord, timeout time.Duration) (int, error) {
+	for i, record := range records {
+		if p.lastHeartbeat.IsZero() || record.Time.Sub(p.lastHeartbeat) >= p.heartbeatInterval {
+			if err := p.request(conn, gt06Heartbeat, gt06HeartbeatContent(record), timeout); err != nil {
+				return i, err
+			}
+			p.lastHeartbeat = record.Time
+		}
+		if _, err := conn.Write(encodeGT06Packet(gt06Location, encodeGT06Location(record, p.cellID), p.nextSerial())); err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+// gt06HeartbeatContent builds the status information of a heartbeat packet
+func gt06HeartbeatContent(r trackerRecord) []byte {
+	info := byte(1 << 6) // GPS tracking on
+	if r.Ignition {
+		info |= 1 << 1 // ACC high
+	}
+	voltage := byte(math.Max(0, math.Min(6, math.Round(float64(r.Battery)/100*6))))
+	gsm := byte(math.Max(0, math.Min(4, math.Round(float64(r.Signal)/25))))
+	return []byte{info, voltage, gsm, 0x00, 0x02} // no alarm, English
+}
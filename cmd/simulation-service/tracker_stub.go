@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// trackerStub is a minimal tracking server for testing the tracker emulators offline.
+// It detects Teltonika or GT06 per connection, validates every packet, logs the
+// decoded records and acknowledges them, optionally losing a fraction of the ACKs.
+type trackerStub struct {
+	ackLoss float64
+	mu      sync.Mutex
+	rng     *rand.Rand
+	records int
+	devices map[string]bool
+}
+
+// runTrackerStub serves the test server until the process is stopped
+func runTrackerStub(address string, ackLoss float64) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	log.Printf("Tracker test server listening on %s (Teltonika Codec 8/8E and GT06, ACK loss %.0f%%)",
+		listener.Addr(), ackLoss*100)
+
+	stub := &trackerStub{ackLoss: ackLoss, rng: rand.New(rand.NewSource(1)), devices: make(map[string]bool)}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go stub.serve(conn)
+	}
+}
+
+// loseAck decides whether to withhold an acknowledgement
+func (s *trackerStub) loseAck() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Float64() < s.ackLoss
+}
+
+// logRecord prints a decoded record and counts it
+func (s *trackerStub) logRecord(imei string, r trackerRecord) {
+	s.mu.Lock()
+	s.records++
+	s.devices[imei] = true
+	total, devices := s.records, len(s.devices)
+	s.mu.Unlock()
+
+	fuel := "-"
+	if r.Fuel != nil {
+		fuel = fmt.Sprintf("%d%%", *r.Fuel)
+	}
+	log.Printf("[%s] %s lat=%.6f lon=%.6f alt=%dm spd=%dkm/h hdg=%d sats=%d ign=%t bat=%d%% gsm=%d%% fuel=%s odo=%.0fm (%d records from %d devices)",
+		imei, r.Time.Format("2006-01-02T15:04:05Z"), r.Lat, r.Lon, r.Altitude, r.Speed, r.Heading,
+		r.Satellites, r.Ignition, r.Battery, r.Signal, fuel, r.Odometer, total, devices)
+}
+
+// serve handles one device connection
+func (s *trackerStub) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	start, err := reader.Peek(2)
+	if err != nil {
+		return
+	}
+
+	if start[0] == 0x78 && start[1] == 0x78 {
+		err = s.serveGT06(conn, reader)
+	} else {
+		err = s.serveTeltonika(conn, reader)
+	}
+	if err != nil && err != io.EOF {
+		log.Printf("Connection from %s closed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// serveTeltonika accepts the IMEI and acknowledges AVL packets with their record count
+func (s *trackerStub) serveTeltonika(conn net.Conn, reader *bufio.Reader) error {
+	var length uint16
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	imei := make([]byte, length)
+	if _, err := io.ReadFull(reader, imei); err != nil {
+		return err
+	}
+	log.Printf("Teltonika device %s logged in from %s", imei, conn.RemoteAddr())
+	if _, err := conn.Write([]byte{0x01}); err != nil {
+		return err
+	}
+
+	for {
+		var header struct {
+			Preamble uint32
+			Length   uint32
+		}
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			return err
+		}
+		if header.Preamble != 0 || header.Length > 1<<20 {
+			return fmt.Errorf("invalid AVL packet header")
+		}
+		data := make([]byte, header.Length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		var crc uint32
+		if err := binary.Read(reader, binary.BigEndian, &crc); err != nil {
+			return err
+		}
+		if uint16(crc) != crc16IBM(data) {
+			return fmt.Errorf("CRC mismatch")
+		}
+
+		records, err := decodeTeltonikaPacket(data)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			s.logRecord(string(imei), record)
+		}
+		if s.loseAck() {
+			log.Printf("[%s] withholding ACK for %d records", imei, len(records))
+			continue
+		}
+		ack := make([]byte, 4)
+		binary.BigEndian.PutUint32(ack, uint32(len(records)))
+		if _, err := conn.Write(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// serveGT06 answers login and heartbeat packets and logs location packets
+func (s *trackerStub) serveGT06(conn net.Conn, reader *bufio.Reader) error {
+	imei := "unknown"
+	for {
+		protocol, content, serial, err := readGT06Packet(reader)
+		if err != nil {
+			return err
+		}
+
+		switch protocol {
+		case gt06Login:
+			if len(content) >= 8 {
+				imei = fmt.Sprintf("%x", content[:8])[1:]
+			}
+			log.Printf("GT06 device %s logged in from %s", imei, conn.RemoteAddr())
+		case gt06Heartbeat:
+			if len(content) >= 3 {
+				log.Printf("[%s] heartbeat: acc=%t voltage=%d/6 gsm=%d/4",
+					imei, content[0]&(1<<1) != 0, content[1], content[2])
+			}
+		case gt06Location:
+			record, err := decodeGT06Location(content)
+			if err != nil {
+				return err
+			}
+			s.logRecord(imei, record)
+			continue
+		default:
+			log.Printf("[%s] ignoring protocol 0x%02X", imei, protocol)
+			continue
+		}
+
+		if s.loseAck() {
+			log.Printf("[%s] withholding response to 0x%02X", imei, protocol)
+			continue
+		}
+		if _, err := conn.Write(encodeGT06Packet(protocol, nil, serial)); err != nil {
+			return err
+		}
+	}
+}
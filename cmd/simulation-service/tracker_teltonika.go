@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// Teltonika codec IDs
+const (
+	teltonikaCodec8  = 0x08
+	teltonikaCodec8E = 0x8E
+)
+
+// Teltonika AVL IO element IDs reported by the emulator
+const (
+	teltonikaIOIgnition     = 239 // 1 byte, 0/1
+	teltonikaIOMovement     = 240 // 1 byte, 0/1
+	teltonikaIOGSMSignal    = 21  // 1 byte, 0-5
+	teltonikaIOBatteryLevel = 113 // 1 byte, %
+	teltonikaIOFuelLevel    = 89  // 1 byte, %
+	teltonikaIOOdometer     = 16  // 4 bytes, meters
+)
+
+// trackerRecord is one position report in the units binary tracker protocols use
+type trackerRecord struct {
+	Time       time.Time
+	Lat, Lon   float64
+	Altitude   int     // meters
+	Heading    int     // degrees 0-359
+	Speed      int     // km/h
+	Satellites int     // in use
+	Ignition   bool    // engine on
+	Moving     bool    // speed above walking pace
+	Battery    int     // device or traction battery, %
+	Fuel       *int    // fuel level %, fuel vehicles only
+	Signal     int     // GSM signal strength, %
+	Odometer   float64 // meters
+}
+
+// newTrackerRecord converts a telemetry record
+func newTrackerRecord(v *VehicleSimulator, t *Telemetry) trackerRecord {
+	record := trackerRecord{
+		Time:       time.Unix(t.Timestamp, 0).UTC(),
+		Lat:        t.Lat,
+		Lon:        t.Lon,
+		Altitude:   int(math.Round(t.Altitude)),
+		Heading:    int(math.Round(math.Mod(t.Heading+360, 360))) % 360,
+		Speed:      int(math.Round(t.Speed)),
+		Satellites: nmeaSatellites(nmeaHDOP(t.Accuracy)),
+		Ignition:   v.EngineOn(),
+		Moving:     t.Speed > 0.5,
+		Battery:    int(math.Round(t.Battery)),
+		Signal:     int(math.Round(t.Signal)),
+		Odometer:   t.Odometer * 1000,
+	}
+	if t.Fuel != nil {
+		fuel := int(math.Round(*t.Fuel))
+		record.Fuel = &fuel
+	}
+	return record
+}
+
+// crc16IBM computes the CRC-16/IBM (ARC) checksum used by Teltonika packets
+func crc16IBM(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// boolByte converts a flag to a 0/1 IO value
+func boolByte(value bool) uint64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// teltonikaIO is one IO element with its value width in bytes
+type teltonikaIO struct {
+	id    uint16
+	width int
+	value uint64
+}
+
+// teltonikaIOElements returns the IO elements of a record
+func teltonikaIOElements(r trackerRecord) []teltonikaIO {
+	gsm := uint64(math.Max(0, math.Min(5, math.Round(float64(r.Signal)/20))))
+	elements := []teltonikaIO{
+		{teltonikaIOIgnition, 1, boolByte(r.Ignition)},
+		{teltonikaIOMovement, 1, boolByte(r.Moving)},
+		{teltonikaIOGSMSignal, 1, gsm},
+		{teltonikaIOBatteryLevel, 1, uint64(math.Max(0, math.Min(100, float64(r.Battery))))},
+	}
+	if r.Fuel != nil {
+		elements = append(elements, teltonikaIO{teltonikaIOFuelLevel, 1, uint64(math.Max(0, math.Min(100, float64(*r.Fuel))))})
+	}
+	return append(elements, teltonikaIO{teltonikaIOOdometer, 4, uint64(math.Max(0, r.Odometer))})
+}
+
+// encodeTeltonikaRecord appends one AVL record in Codec 8 or Codec 8E layout
+func encodeTeltonikaRecord(buf *bytes.Buffer, codec byte, r trackerRecord) {
+	binary.Write(buf, binary.BigEndian, uint64(r.Time.UnixMilli()))
+	buf.WriteByte(0) // priority: low
+
+	// GPS element
+	binary.Write(buf, binary.BigEndian, int32(math.Round(r.Lon*1e7)))
+	binary.Write(buf, binary.BigEndian, int32(math.Round(r.Lat*1e7)))
+	binary.Write(buf, binary.BigEndian, int16(r.Altitude))
+	binary.Write(buf, binary.BigEndian, uint16(r.Heading))
+	buf.WriteByte(byte(r.Satellites))
+	binary.Write(buf, binary.BigEndian, uint16(r.Speed))
+
+	// IO element: Codec 8 uses 1-byte IDs and counts, Codec 8E 2-byte ones
+	writeN := func(n int) {
+		if codec == teltonikaCodec8E {
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		} else {
+			buf.WriteByte(byte(n))
+		}
+	}
+	elements := teltonikaIOElements(r)
+	writeN(0) // event IO ID: periodic record
+	writeN(len(elements))
+	for _, width := range []int{1, 2, 4, 8} {
+		var group []teltonikaIO
+		for _, element := range elements {
+			if element.width == width {
+				group = append(group, element)
+			}
+		}
+		writeN(len(group))
+		for _, element := range group {
+			writeN(int(element.id))
+			switch width {
+			case 1:
+				buf.WriteByte(byte(element.value))
+			case 2:
+				binary.Write(buf, binary.BigEndian, uint16(element.value))
+			case 4:
+				binary.Write(buf, binary.BigEndian, uint32(element.value))
+			case 8:
+				binary.Write(buf, binary.BigEndian, element.value)
+			}
+		}
+	}
+	if codec == teltonikaCodec8E {
+		writeN(0) // no variable-length elements
+	}
+}
+
+// encodeTeltonikaPacket builds an AVL data packet carrying the records
+func encodeTeltonikaPacket(codec byte, records []trackerRecord) []byte {
+	var data bytes.Buffer
+	data.WriteByte(codec)
+	data.WriteByte(byte(len(records)))
+	for _, record := range records {
+		encodeTeltonikaRecord(&data, codec, record)
+	}
+	data.WriteByte(byte(len(records)))
+
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.BigEndian, uint32(0)) // preamble
+	binary.Write(&packet, binary.BigEndian, uint32(data.Len()))
+	packet.Write(data.Bytes())
+	binary.Write(&packet, binary.BigEndian, uint32(crc16IBM(data.Bytes())))
+	return packet.Bytes()
+}
+
+// teltonikaProtocol emulates a Teltonika FMB device speaking Codec 8 or 8E
+type teltonikaProtocol struct {
+	codec byte
+}
+
+// login sends the IMEI and waits for the server to accept it
+func (p *teltonikaProtocol) login(conn net.Conn, imei string, timeout time.Duration) error {
+	packet := make([]byte, 2, 2+len(imei))
+	binary.BigEndian.PutUint16(packet, uint16(len(imei)))
+	packet = append(packet, imei...)
+	if _, err := conn.Write(packet); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("no login reply: %w", err)
+	}
+	if reply[0] != 0x01 {
+		return fmt.Errorf("server rejected IMEI %s", imei)
+	}
+	return nil
+}
+
+// maxRecords is the number of records sent per packet
+func (p *teltonikaProtocol) maxRecords() int {
+	return 25
+}
+
+// send writes one AVL packet and returns the number of records the server acknowledged
+func (p *teltonikaProtocol) send(conn net.Conn, records []trackerRecord, timeout time.Duration) (int, error) {
+	if _, err := conn.Write(encodeTeltonikaPacket(p.codec, records)); err != nil {
+		return 0, err
+	}
+
+	ack := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return 0, fmt.Errorf("no acknowledgement: %w", err)
+	}
+	accepted := int(binary.BigEndian.Uint32(ack))
+	if accepted > len(records) {
+		accepted = len(records)
+	}
+	return accepted, nil
+}
+
+// decodeTeltonikaPacket parses the data field of an AVL packet (codec ID through the
+// second record count) into records, for the test server
+func decodeTeltonikaPacket(data []byte) ([]trackerRecord, error) {
+	reader := bytes.NewReader(data)
+	codec, _ := reader.ReadByte()
+	if codec != teltonikaCodec8 && codec != teltonikaCodec8E {
+		return nil, fmt.Errorf("unsupported codec 0x%02X", codec)
+	}
+	count, _ := reader.ReadByte()
+
+	readN := func() (int, error) {
+		if codec == teltonikaCodec8E {
+			var n uint16
+			err := binary.Read(reader, binary.BigEndian, &n)
+			return int(n), err
+		}
+		n, err := reader.ReadByte()
+		return int(n), err
+	}
+
+	records := make([]trackerRecord, 0, count)
+	for i := 0; i < int(count); i++ {
+		var header struct {
+			Timestamp  uint64
+			Priority   uint8
+			Lon, Lat   int32
+			Altitude   int16
+			Angle      uint16
+			Satellites uint8
+			Speed      uint16
+		}
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		record := trackerRecord{
+			Time:       time.UnixMilli(int64(header.Timestamp)).UTC(),
+			Lat:        float64(header.Lat) / 1e7,
+			Lon:        float64(header.Lon) / 1e7,
+			Altitude:   int(header.Altitude),
+			Heading:    int(header.Angle),
+			Satellites: int(header.Satellites),
+			Speed:      int(header.Speed),
+		}
+
+		if _, err := readN(); err != nil { // event IO ID
+			return nil, err
+		}
+		if _, err := readN(); err != nil { // total IO count
+			return nil, err
+		}
+		for _, width := range []int{1, 2, 4, 8} {
+			n, err := readN()
+			if err != nil {
+				return nil, err
+			}
+			for j := 0; j < n; j++ {
+				id, err := readN()
+				if err != nil {
+					return nil, err
+				}
+				value := make([]byte, 8)
+				if _, err := io.ReadFull(reader, value[8-width:]); err != nil {
+					return nil, err
+				}
+				applyTeltonikaIO(&record, id, binary.BigEndian.Uint64(value))
+			}
+		}
+		if codec == teltonikaCodec8E {
+			n, err := readN()
+			if err != nil {
+				return nil, err
+			}
+			for j := 0; j < n; j++ {
+				if _, err := readN(); err != nil {
+					return nil, err
+				}
+				length, err := readN()
+				if err != nil {
+					return nil, err
+				}
+				if _, err := reader.Seek(int64(length), io.SeekCurrent); err != nil {
+					return nil, err
+				}
+			}
+		}
+		records = append(records, record)
+	}
+
+	if trailer, err := reader.ReadByte(); err != nil || trailer != count {
+		return nil, fmt.Errorf("record count mismatch")
+	}
+	return records, nil
+}
+
+// applyTeltonikaIO stores a decoded IO element in the record
+func applyTeltonikaIO(record *trackerRecord, id int, value uint64) {
+	switch id {
+	case teltonikaIOIgnition:
+		record.Ignition = value != 0
+	case teltonikaIOMovement:
+		record.Moving = value != 0
+	case teltonikaIOGSMSignal:
+		record.Signal = int(value) * 20
+	case teltonikaIOBatteryLevel:
+		record.Battery = int(value)
+	case teltonikaIOFuelLevel:
+		fuel := int(value)
+		record.Fuel = &fuel
+	case teltonikaIOOdometer:
+		record.Odometer = float64(value)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTrackerCRC(t *testing.T) {
+	tests := []struct {
+		name string
+		crc  func([]byte) uint16
+		data string
+		want uint16
+	}{
+		// Check values of the CRC catalogue for "123456789"
+		{"IBM check", crc16IBM, hex.EncodeToString([]byte("123456789")), 0xBB3D},
+		{"ITU check", crc16ITU, hex.EncodeToString([]byte("123456789")), 0x906E},
+		// Codec 8 example from the Teltonika protocol documentation
+		{"Teltonika AVL data", crc16IBM,
+			"08010000016B40D8EA30010000000000000000000000000000000105021503010101425E0F01F10000601A014E000000000000000001",
+			0xC7CF},
+		// Login example from the GT06 protocol documentation
+		{"GT06 login", crc16ITU, "0D0101234567890123450001", 0x8CDD},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.crc(mustHex(t, tt.data)); got != tt.want {
+				t.Errorf("CRC %04X, want %04X", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGT06Packet(t *testing.T) {
+	packet := encodeGT06Packet(gt06Login, gt06TerminalID("123456789012345"), 1)
+	if want := mustHex(t, "78780D01012345678901234500018CDD0D0A"); !bytes.Equal(packet, want) {
+		t.Fatalf("login packet % X, want % X", packet, want)
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		ok     bool
+	}{
+		{"valid", packet, true},
+		{"bad start bits", append([]byte{0x79}, packet[1:]...), false},
+		{"bad CRC", append(append([]byte{}, packet[:len(packet)-3]...), 0x00, 0x0D, 0x0A), false},
+		{"short length", mustHex(t, "787804010001"), false},
+		{"cut short", packet[:10], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protocol, content, serial, err := readGT06Packet(bytes.NewReader(tt.packet))
+			if !tt.ok {
+				if err == nil {
+					t.Error("invalid packet accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readGT06Packet: %v", err)
+			}
+			if protocol != gt06Login || serial != 1 || !bytes.Equal(content, gt06TerminalID("123456789012345")) {
+				t.Errorf("read protocol %02X, serial %d, content % X", protocol, serial, content)
+			}
+		})
+	}
+}
+
+func TestGT06Location(t *testing.T) {
+	tests := []struct {
+		name   string
+		record trackerRecord
+	}{
+		{"north east", trackerRecord{Lat: 35.7219, Lon: 51.3347, Speed: 48, Heading: 271, Satellites: 9}},
+		{"south west", trackerRecord{Lat: -33.4489, Lon: -70.6693, Speed: 0, Heading: 0, Satellites: 4}},
+		{"equator", trackerRecord{Lat: 0, Lon: 0.5, Speed: 255, Heading: 359, Satellites: 12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.record.Time = time.Date(2026, 1, 5, 8, 30, 15, 0, time.UTC)
+			packet := encodeGT06Packet(gt06Location, encodeGT06Location(tt.record, 0x1234), 7)
+			protocol, content, _, err := readGT06Packet(bytes.NewReader(packet))
+			if err != nil || protocol != gt06Location {
+				t.Fatalf("readGT06Packet: protocol %02X, %v", protocol, err)
+			}
+			got, err := decodeGT06Location(content)
+			if err != nil {
+				t.Fatalf("decodeGT06Location: %v", err)
+			}
+			if !got.Time.Equal(tt.record.Time) || got.Speed != tt.record.Speed || got.Heading != tt.record.Heading ||
+				got.Satellites != tt.record.Satellites {
+				t.Errorf("decoded %+v, want %+v", got, tt.record)
+			}
+			// Coordinates are in 1/30000 minutes
+			if diff := got.Lat - tt.record.Lat; diff > 1e-6 || diff < -1e-6 {
+				t.Errorf("latitude %f, want %f", got.Lat, tt.record.Lat)
+			}
+			if diff := got.Lon - tt.record.Lon; diff > 1e-6 || diff < -1e-6 {
+				t.Errorf("longitude %f, want %f", got.Lon, tt.record.Lon)
+			}
+		})
+	}
+}
+
+func TestTeltonikaPacket(t *testing.T) {
+	fuel := 64
+	records := []trackerRecord{
+		{Time: time.Date(2026, 1, 5, 8, 30, 15, 0, time.UTC), Lat: 35.7219, Lon: 51.3347, Altitude: 1190,
+			Heading: 271, Speed: 48, Satellites: 9, Ignition: true, Moving: true, Battery: 87, Fuel: &fuel,
+			Signal: 80, Odometer: 12345},
+		{Time: time.Date(2026, 1, 5, 8, 30, 20, 0, time.UTC), Lat: -33.4489, Lon: -70.6693, Altitude: -12,
+			Satellites: 4, Battery: 100, Signal: 0},
+	}
+
+	for _, codec := range []byte{teltonikaCodec8, teltonikaCodec8E} {
+		t.Run(hex.EncodeToString([]byte{codec}), func(t *testing.T) {
+			packet := encodeTeltonikaPacket(codec, records)
+			if !bytes.Equal(packet[:4], []byte{0, 0, 0, 0}) {
+				t.Errorf("preamble % X", packet[:4])
+			}
+			length := int(packet[4])<<24 | int(packet[5])<<16 | int(packet[6])<<8 | int(packet[7])
+			if length != len(packet)-12 {
+				t.Fatalf("data length %d, packet carries %d bytes", length, len(packet)-12)
+			}
+			data := packet[8 : 8+length]
+			crc := int(packet[len(packet)-2])<<8 | int(packet[len(packet)-1])
+			if uint16(crc) != crc16IBM(data) {
+				t.Errorf("CRC %04X, want %04X", crc, crc16IBM(data))
+			}
+
+			decoded, err := decodeTeltonikaPacket(data)
+			if err != nil {
+				t.Fatalf("decodeTeltonikaPacket: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, records) {
+				t.Errorf("decoded\n%+v\nwant\n%+v", decoded, records)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// viewerPage draws the vehicles of the position feed on a map, or on a plain canvas
+// when the map library cannot be loaded
+//
+//go:embed viewer.html
+var viewerPage []byte
+
+// serveViewer handles GET /
+func serveViewer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(viewerPage)
+}